@@ -0,0 +1,70 @@
+// Command knet-agent is the static capture agent knet runs inside ephemeral
+// debug containers. It implements the part of tcpdump's command line knet
+// uses and doubles as sleep, so that a scratch image only needs this binary.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/Tim-0731-Hzt/knet/pkg/agent"
+	"github.com/Tim-0731-Hzt/knet/pkg/pcap"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func main() {
+	if filepath.Base(os.Args[0]) == "sleep" {
+		sleep(os.Args[1:])
+		return
+	}
+	if err := capture(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func capture() error {
+	fs := flag.NewFlagSet("tcpdump", flag.ExitOnError)
+	iface := fs.String("i", "any", "interface to capture on")
+	snaplen := fs.Uint("s", pcap.DefaultSnapLen, "snapshot length")
+	output := fs.String("w", "-", "file to write the capture to, - for stdout")
+	count := fs.Int("c", 0, "exit after this many packets")
+	fileSize := fs.Int64("C", 0, "rotate the output file after this many million bytes")
+	interval := fs.Int("G", 0, "rotate the output file after this many seconds")
+	fileCount := fs.Int("W", 0, "number of rotated files to keep")
+	_ = fs.Bool("U", true, "packet-buffered output, always enabled")
+	_ = fs.Parse(os.Args[1:])
+
+	if *snaplen == 0 {
+		*snaplen = pcap.DefaultSnapLen
+	}
+	if *output == "-" && (*fileSize > 0 || *interval > 0) {
+		return fmt.Errorf("-C and -G require -w with a file name")
+	}
+	w, err := agent.NewWriter(*output, pcap.Header{SnapLen: uint32(*snaplen), LinkType: pcap.LinkTypeEthernet}, agent.RotateOptions{
+		FileSize:  *fileSize * 1000000,
+		Interval:  time.Duration(*interval) * time.Second,
+		FileCount: *fileCount,
+	})
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	return agent.Capture(*iface, strings.Join(fs.Args(), " "), uint32(*snaplen), *count, w)
+}
+
+func sleep(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: sleep SECONDS")
+		os.Exit(1)
+	}
+	seconds, err := strconv.ParseFloat(args[0], 64)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	time.Sleep(time.Duration(seconds * float64(time.Second)))
+}
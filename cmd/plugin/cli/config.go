@@ -2,7 +2,9 @@ package cli
 
 import (
 	"github.com/Tim-0731-Hzt/knet/pkg/plugin"
+	"github.com/Tim-0731-Hzt/knet/pkg/wait"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 func init() {
@@ -24,6 +26,91 @@ func init() {
 		},
 	}
 	configCmd.Flags().BoolVar(&c.DebugConsole, "debug_console", false, "enable debug console")
+	addKataDeployImageFlags(configCmd.Flags(), &c.Image)
+	configCmd.Flags().DurationVar(&c.Timeout, "timeout", wait.DefaultTimeout, "how long to wait for kata-deploy to be ready")
+
+	g := plugin.NewConfigGetService()
+	var getCmd = &cobra.Command{
+		Use:   "get KEY",
+		Short: "show a setting of the kata configuration of each node",
+		Example: `kubectl knet config get hypervisor.default_vcpus
+kubectl knet config get agent.debug_console_enabled --hypervisor qemu --nodes node-1`,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := g.Complete(cmd, args); err != nil {
+				return err
+			}
+			if err := g.Validate(); err != nil {
+				return err
+			}
+			if err := g.Run(); err != nil {
+				return err
+			}
+			return nil
+		},
+	}
+	addKataConfigTargetFlags(getCmd.Flags(), &g.Targets)
+	configCmd.AddCommand(getCmd)
+
+	s := plugin.NewConfigSetService()
+	var setCmd = &cobra.Command{
+		Use:   "set KEY=VALUE...",
+		Short: "change settings of the kata configuration of each node",
+		Example: `kubectl knet config set hypervisor.default_memory=4096 --hypervisor qemu
+kubectl knet config set runtime.enable_debug=true agent.kernel_modules=vfio,vfio_pci --nodes node-1,node-2`,
+		Args:         cobra.MinimumNArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := s.Complete(cmd, args); err != nil {
+				return err
+			}
+			if err := s.Validate(); err != nil {
+				return err
+			}
+			if err := s.Run(); err != nil {
+				return err
+			}
+			return nil
+		},
+	}
+	addKataConfigTargetFlags(setCmd.Flags(), &s.Targets)
+	addKataDeployImageFlags(setCmd.Flags(), &s.Image)
+	setCmd.Flags().DurationVar(&s.Timeout, "timeout", wait.DefaultTimeout, "how long to wait for kata-deploy to be ready")
+	configCmd.AddCommand(setCmd)
+
+	d := plugin.NewConfigDiffService()
+	var diffCmd = &cobra.Command{
+		Use:   "diff",
+		Short: "show the nodes whose kata configuration differs from the others",
+		Example: `kubectl knet config diff
+kubectl knet config diff --reference ./configuration-qemu.toml --nodes node-1,node-2`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := d.Complete(cmd, args); err != nil {
+				return err
+			}
+			if err := d.Validate(); err != nil {
+				return err
+			}
+			if err := d.Run(); err != nil {
+				return err
+			}
+			return nil
+		},
+	}
+	diffCmd.Flags().StringSliceVar(&d.Targets.Hypervisors, "hypervisor", nil, "hypervisors whose configuration to compare, every configuration-*.toml by default")
+	diffCmd.Flags().StringSliceVar(&d.Targets.Nodes, "nodes", nil, "names of the nodes to compare, every node running kata-deploy by default")
+	diffCmd.Flags().StringVar(&d.Reference, "reference", "", "configuration-<hypervisor>.toml or a directory of them to compare against instead of the majority of the nodes")
+	configCmd.AddCommand(diffCmd)
 
 	cmd.AddCommand(configCmd)
 }
+
+// addKataConfigTargetFlags adds the flags selecting the kata configurations
+// config get and set work on.
+func addKataConfigTargetFlags(flags *pflag.FlagSet, targets *plugin.KataConfigTargets) {
+	flags.StringSliceVar(&targets.Hypervisors, "hypervisor", nil, "hypervisors whose configuration to use, every installed one by default")
+	flags.StringSliceVar(&targets.Nodes, "nodes", nil, "names of the nodes, every node running kata-deploy by default")
+}
@@ -0,0 +1,53 @@
+/*
+Copyright © 2023 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cli
+
+import (
+	"github.com/Tim-0731-Hzt/knet/pkg/plugin"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	c := plugin.NewCpService()
+	var cpCmd = &cobra.Command{
+		Use:   "cp [NAMESPACE/]POD:SRC DEST | SRC [NAMESPACE/]POD:DEST",
+		Short: "copy files and directories into and out of a kata guest",
+		Example: `kubectl knet cp nginx:/var/log/messages ./messages
+kubectl knet cp ./strace nginx:/usr/local/bin/strace`,
+		Args:         cobra.ExactArgs(2),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			err := c.Complete(cmd, args)
+			if err != nil {
+				return err
+			}
+			err = c.Validate()
+			if err != nil {
+				return err
+			}
+			err = c.Run()
+			if err != nil {
+				return err
+			}
+			return nil
+		},
+	}
+	cpCmd.Flags().StringVarP(&c.UserSpecifiedNamespace, "namespace", "n", "", "namespace (optional)")
+	cpCmd.Flags().StringVarP(&c.UserSpecifiedContainer, "container", "c", "", "container (optional), defaults to the pod's default container")
+
+	cmd.AddCommand(cpCmd)
+}
@@ -2,6 +2,7 @@ package cli
 
 import (
 	"github.com/Tim-0731-Hzt/knet/pkg/plugin"
+	"github.com/Tim-0731-Hzt/knet/pkg/wait"
 	"github.com/spf13/cobra"
 )
 
@@ -15,6 +16,10 @@ func init() {
 			if err != nil {
 				return err
 			}
+			err = d.Validate()
+			if err != nil {
+				return err
+			}
 			err = d.Run()
 			if err != nil {
 				return err
@@ -22,6 +27,9 @@ func init() {
 			return nil
 		},
 	}
+	addKataDeployImageFlags(deleteCmd.Flags(), &d.Image)
+	deleteCmd.Flags().DurationVar(&d.Timeout, "timeout", wait.DefaultTimeout, "how long to wait for each step of the cleanup")
+	addDryRunFlag(deleteCmd.Flags(), &d.DryRun)
 
 	cmd.AddCommand(deleteCmd)
 }
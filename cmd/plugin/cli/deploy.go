@@ -2,19 +2,26 @@ package cli
 
 import (
 	"github.com/Tim-0731-Hzt/knet/pkg/plugin"
+	"github.com/Tim-0731-Hzt/knet/pkg/wait"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	v1 "k8s.io/api/core/v1"
 )
 
 func init() {
+	d := plugin.NewDeployService()
 	var deployCmd = &cobra.Command{
 		Use:   "deploy",
 		Short: "deploy kata containers on each node",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			d := plugin.NewDeployService()
 			err := d.Complete(cmd, args)
 			if err != nil {
 				return err
 			}
+			err = d.Validate()
+			if err != nil {
+				return err
+			}
 			err = d.Run()
 			if err != nil {
 				return err
@@ -22,5 +29,66 @@ func init() {
 			return nil
 		},
 	}
+	addKataDeployImageFlags(deployCmd.Flags(), &d.Image)
+	deployCmd.Flags().StringVar(&d.Rollout.NodeSelector, "node-selector", "", "label selector of the nodes to install kata on, e.g. '!node-role.kubernetes.io/control-plane'")
+	deployCmd.Flags().StringSliceVar(&d.Rollout.Nodes, "nodes", nil, "names of the nodes to install kata on")
+	deployCmd.Flags().IntVar(&d.Rollout.Canary, "canary", 0, "install kata on this many nodes only and stop")
+	addHypervisorFlags(deployCmd.Flags(), &d.Hypervisors)
+	deployCmd.Flags().IntVar(&d.Rollout.BatchSize, "batch-size", 0, "install kata on this many nodes at a time, all at once by default")
+	deployCmd.Flags().DurationVar(&d.Timeout, "timeout", wait.DefaultTimeout, "how long to wait for kata to be installed on each batch of nodes")
+	addDryRunFlag(deployCmd.Flags(), &d.DryRun)
+	deployCmd.Flags().BoolVar(&d.ForceConflicts, "force-conflicts", false, "take over fields of the kata objects other field managers own")
+	deployCmd.Flags().BoolVar(&d.Resume, "resume", false, "continue a deploy that failed or was interrupted instead of undoing it")
+
+	r := plugin.NewRenderService()
+	var renderCmd = &cobra.Command{
+		Use:   "render",
+		Short: "print the objects deploy creates instead of creating them",
+		Example: `kubectl knet deploy render --hypervisors qemu --tag 3.1.0 -o yaml
+kubectl knet deploy render -o kustomize --output-dir kata`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := r.Complete(cmd, args); err != nil {
+				return err
+			}
+			if err := r.Validate(); err != nil {
+				return err
+			}
+			return r.Run()
+		},
+	}
+	addKataDeployImageFlags(renderCmd.Flags(), &r.Image)
+	addHypervisorFlags(renderCmd.Flags(), &r.Hypervisors)
+	renderCmd.Flags().StringVarP(&r.Output, "output", "o", "yaml", "yaml, json or kustomize")
+	renderCmd.Flags().StringVar(&r.OutputDir, "output-dir", "", "directory the kustomize output is written to")
+	deployCmd.AddCommand(renderCmd)
+
 	cmd.AddCommand(deployCmd)
 }
+
+// addKataDeployImageFlags adds the flags selecting the kata-deploy image,
+// the image section of the config file provides the values of unset flags.
+func addKataDeployImageFlags(flags *pflag.FlagSet, image *plugin.KataDeployImage) {
+	flags.StringVar(&image.Repository, "image", plugin.DefaultKataDeployImage, "kata-deploy image (config image.repository)")
+	flags.StringVar(&image.Tag, "tag", plugin.DefaultKataDeployTag, "kata-deploy image tag (config image.tag)")
+	flags.StringVar(&image.Digest, "digest", "", "kata-deploy image digest, overrides --tag (config image.digest)")
+	flags.StringVar(&image.PullPolicy, "image-pull-policy", string(v1.PullAlways), "Always, IfNotPresent or Never (config image.pullPolicy)")
+	flags.StringSliceVar(&image.PullSecrets, "image-pull-secret", nil, "image pull secret in kube-system, can be repeated (config image.pullSecrets)")
+}
+
+// addHypervisorFlags adds the flags selecting the hypervisors and overriding
+// their RuntimeClasses.
+func addHypervisorFlags(flags *pflag.FlagSet, hypervisors *plugin.Hypervisors) {
+	flags.StringSliceVar(&hypervisors.Names, "hypervisors", nil, "hypervisors to install, qemu, clh, fc and dragonball by default")
+	flags.StringArrayVar(&hypervisors.Overheads, "overhead", nil, "RuntimeClass pod overhead HYPERVISOR=CPU/MEMORY, e.g. qemu=500m/256Mi, can be repeated")
+	flags.StringArrayVar(&hypervisors.Tolerations, "toleration", nil, "RuntimeClass toleration HYPERVISOR=KEY[=VALUE]:EFFECT, can be repeated")
+	flags.StringArrayVar(&hypervisors.NodeSelectors, "runtime-node-selector", nil, "RuntimeClass node selector HYPERVISOR=KEY=VALUE, can be repeated")
+}
+
+// addDryRunFlag adds --dry-run, given without a value it is a client dry
+// run.
+func addDryRunFlag(flags *pflag.FlagSet, dryRun *string) {
+	flags.StringVar(dryRun, "dry-run", "none", "none, client to only print the changes, or server to also have the API server validate them")
+	flags.Lookup("dry-run").NoOptDefVal = "client"
+}
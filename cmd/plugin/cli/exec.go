@@ -16,7 +16,6 @@ limitations under the License.
 package cli
 
 import (
-	"fmt"
 	"github.com/Tim-0731-Hzt/knet/pkg/plugin"
 	"github.com/spf13/viper"
 
@@ -26,9 +25,13 @@ import (
 func init() {
 	e := plugin.NewExecService()
 	var execCmd = &cobra.Command{
-		Use: "exec",
+		Use:   "exec [POD] [-- COMMAND [args...]]",
+		Short: "open the debug console of a kata guest or run a command in it",
+		Example: `kubectl knet exec nginx
+kubectl knet exec nginx -- ip addr
+kubectl knet exec nginx -c sidecar -- ip route`,
+		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			fmt.Println("exec called")
 			err := e.Complete(cmd, args)
 			if err != nil {
 				return err
@@ -52,5 +55,11 @@ func init() {
 	_ = viper.BindEnv("pod", "KUBECTL_PLUGINS_LOCAL_FLAG_POD")
 	_ = viper.BindPFlag("pod", cmd.Flags().Lookup("pod"))
 
+	execCmd.Flags().StringVarP(&e.UserSpecifiedContainer, "container", "c", "", "container (optional), defaults to the pod's default container")
+
+	execCmd.Flags().BoolVar(&e.DebugConsole, "debug-console", true, "enable the debug console of the pod's hypervisor on its node for the session")
+	execCmd.Flags().StringVar(&e.Record, "record", "", "record the interactive session to FILE in asciinema v2 format")
+	execCmd.Flags().BoolVar(&e.AuditEvent, "audit-event", false, "record who opened the session and for how long in events on the pod")
+
 	cmd.AddCommand(execCmd)
 }
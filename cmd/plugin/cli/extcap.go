@@ -0,0 +1,22 @@
+package cli
+
+import (
+	"github.com/Tim-0731-Hzt/knet/pkg/plugin"
+)
+
+var extcap = plugin.NewExtcapService()
+
+func init() {
+	flags := cmd.Flags()
+	flags.BoolVar(&extcap.Interfaces, "extcap-interfaces", false, "list pods as wireshark extcap interfaces")
+	flags.BoolVar(&extcap.Dlts, "extcap-dlts", false, "list the data link types of an extcap interface")
+	flags.BoolVar(&extcap.Config, "extcap-config", false, "list the configuration options of an extcap interface")
+	flags.BoolVar(&extcap.Capture, "capture", false, "start an extcap capture")
+	flags.StringVar(&extcap.Version, "extcap-version", "", "wireshark extcap protocol version")
+	flags.StringVar(&extcap.Interface, "extcap-interface", "", "extcap interface to operate on")
+	flags.StringVar(&extcap.Fifo, "fifo", "", "fifo the extcap capture is written to")
+	flags.StringVar(&extcap.CaptureFilter, "extcap-capture-filter", "", "capture filter passed to tcpdump")
+	for _, name := range []string{"extcap-interfaces", "extcap-dlts", "extcap-config", "capture", "extcap-version", "extcap-interface", "fifo", "extcap-capture-filter"} {
+		_ = flags.MarkHidden(name)
+	}
+}
@@ -0,0 +1,60 @@
+/*
+Copyright © 2023 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cli
+
+import (
+	"github.com/Tim-0731-Hzt/knet/pkg/plugin"
+
+	"github.com/spf13/cobra"
+)
+
+var kataCmd = &cobra.Command{
+	Use:   "kata",
+	Short: "inspect kata sandboxes",
+}
+
+func init() {
+	d := plugin.NewDiagService()
+	var diagCmd = &cobra.Command{
+		Use:   "diag POD",
+		Short: "collect guest and host diagnostics of a kata pod into a tarball",
+		Example: `kubectl knet kata diag nginx
+kubectl knet kata diag -n prod nginx -o nginx-diag.tar.gz`,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			err := d.Complete(cmd, args)
+			if err != nil {
+				return err
+			}
+			err = d.Validate()
+			if err != nil {
+				return err
+			}
+			err = d.Run()
+			if err != nil {
+				return err
+			}
+			return nil
+		},
+	}
+	diagCmd.Flags().StringVarP(&d.UserSpecifiedNamespace, "namespace", "n", "", "namespace (optional)")
+	diagCmd.Flags().StringVarP(&d.UserSpecifiedContainer, "container", "c", "", "container (optional), defaults to the pod's default container")
+	diagCmd.Flags().StringVarP(&d.Output, "output", "o", "", "tarball to write, defaults to kata-diag-POD-TIME.tar.gz")
+
+	kataCmd.AddCommand(diagCmd)
+	cmd.AddCommand(kataCmd)
+}
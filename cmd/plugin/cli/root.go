@@ -5,24 +5,43 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/Tim-0731-Hzt/knet/pkg/kube"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"k8s.io/cli-runtime/pkg/genericclioptions"
+	utilexec "k8s.io/client-go/util/exec"
 )
 
 var (
 	KubernetesConfigFlags *genericclioptions.ConfigFlags
+	configFile            string
 )
 
 var cmd = &cobra.Command{
 	Use:   "knet",
 	Short: "Perform network diagnose on pods running in a kubernetes cluster.",
 	RunE: func(cmd *cobra.Command, args []string) error {
+		if extcap.Requested() {
+			if err := extcap.Complete(cmd, args); err != nil {
+				return err
+			}
+			if err := extcap.Validate(); err != nil {
+				return err
+			}
+			return extcap.Run()
+		}
 		err := errors.New("must also specify a subcommand like info or tcpdump")
 		return err
 	},
 }
 
+func init() {
+	// subcommands own their namespace flag
+	kube.KubernetesConfigFlags.Namespace = nil
+	kube.KubernetesConfigFlags.AddFlags(cmd.PersistentFlags())
+	cmd.PersistentFlags().StringVar(&configFile, "config", "", "config file (default $HOME/.knet.yaml)")
+}
+
 func RootCmd() *cobra.Command {
 	cobra.OnInitialize(initConfig)
 	return cmd
@@ -30,6 +49,10 @@ func RootCmd() *cobra.Command {
 
 func InitAndExecute() {
 	if err := RootCmd().Execute(); err != nil {
+		// exit codes of commands run in a guest are passed on as they are
+		if exitErr, ok := err.(utilexec.ExitError); ok {
+			os.Exit(exitErr.ExitStatus())
+		}
 		fmt.Println(err)
 		os.Exit(1)
 	}
@@ -37,4 +60,21 @@ func InitAndExecute() {
 
 func initConfig() {
 	viper.AutomaticEnv()
+	if configFile != "" {
+		viper.SetConfigFile(configFile)
+	} else {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return
+		}
+		viper.AddConfigPath(home)
+		viper.SetConfigName(".knet")
+	}
+	if err := viper.ReadInConfig(); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); ok && configFile == "" {
+			return
+		}
+		fmt.Println(err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,33 @@
+package cli
+
+import (
+	"github.com/Tim-0731-Hzt/knet/pkg/plugin"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	s := plugin.NewStatusService()
+	var statusCmd = &cobra.Command{
+		Use:   "status",
+		Short: "show the kata installation of each node",
+		Example: `kubectl knet status
+kubectl knet status --node-selector kvm=true -o yaml`,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := s.Complete(cmd, args); err != nil {
+				return err
+			}
+			if err := s.Validate(); err != nil {
+				return err
+			}
+			if err := s.Run(); err != nil {
+				return err
+			}
+			return nil
+		},
+	}
+	statusCmd.Flags().StringVar(&s.NodeSelector, "node-selector", "", "label selector of the nodes to show")
+	statusCmd.Flags().StringVarP(&s.Output, "output", "o", "table", "table, json or yaml")
+
+	cmd.AddCommand(statusCmd)
+}
@@ -16,12 +16,17 @@ limitations under the License.
 package cli
 
 import (
+	"github.com/Tim-0731-Hzt/knet/pkg/kube"
 	"github.com/Tim-0731-Hzt/knet/pkg/plugin"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"time"
 )
 
-var tcpdumpExample = "kubectl kdbg tcpdump -n default -p nginx | termshark -r -"
+var tcpdumpExample = `kubectl kdbg tcpdump -n default -p nginx | termshark -r -
+kubectl kdbg tcpdump -n default -p nginx -p redis --serve :2002
+kubectl kdbg tcpdump -n default -p nginx -p redis --upload s3://captures/incident-42
+kubectl kdbg tcpdump -n default -p nginx --trigger --pre-trigger 1m --post-trigger 30s`
 
 func init() {
 	c := plugin.NewTcpdumpConfig()
@@ -54,6 +59,16 @@ func init() {
 	_ = viper.BindPFlag("namespace", cmd.Flags().Lookup("namespace"))
 
 	tcpdumpCmd.Flags().StringSliceVarP(&t.Config.UserSpecifiedPodsName, "pod", "p", []string{}, "pod(optional)")
+	tcpdumpCmd.Flags().StringVarP(&t.Config.Filter, "filter", "f", "", "tcpdump filter expression (optional)")
+	tcpdumpCmd.Flags().StringVar(&t.Config.Image, "image", kube.DefaultCaptureImage, "debug container image providing /usr/bin/tcpdump, e.g. nicolaka/netshoot")
+	tcpdumpCmd.Flags().StringVar(&t.Config.Upload, "upload", "", "upload the captures to s3://bucket/prefix when the capture stops (optional)")
+	tcpdumpCmd.Flags().StringVar(&t.Config.S3Endpoint, "s3-endpoint", "", "S3-compatible endpoint, defaults to $AWS_ENDPOINT_URL or AWS S3 (optional)")
+	tcpdumpCmd.Flags().DurationVar(&t.Config.PresignExpiry, "presign-expiry", 24*time.Hour, "validity of the printed pre-signed URL")
+	tcpdumpCmd.Flags().BoolVar(&t.Config.Trigger, "trigger", false, "buffer the capture in memory and save it when a pod restarts, is OOMKilled or fails its probes")
+	tcpdumpCmd.Flags().DurationVar(&t.Config.PreTrigger, "pre-trigger", 30*time.Second, "capture saved from before the trigger")
+	tcpdumpCmd.Flags().DurationVar(&t.Config.PostTrigger, "post-trigger", 30*time.Second, "capture saved from after the trigger")
+	tcpdumpCmd.Flags().IntVar(&t.Config.TriggerBufferSize, "trigger-buffer-size", 256<<20, "maximum bytes buffered per pod for --trigger")
+	tcpdumpCmd.Flags().StringVar(&t.Config.Serve, "serve", "", "serve the merged capture as pcap over TCP on this address, e.g. :2002 (optional)")
 
 	cmd.AddCommand(tcpdumpCmd)
 }
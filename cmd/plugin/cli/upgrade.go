@@ -0,0 +1,39 @@
+package cli
+
+import (
+	"github.com/Tim-0731-Hzt/knet/pkg/plugin"
+	"github.com/Tim-0731-Hzt/knet/pkg/wait"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	u := plugin.NewUpgradeService()
+	var upgradeCmd = &cobra.Command{
+		Use:   "upgrade",
+		Short: "upgrade kata containers node by node",
+		Example: `kubectl knet upgrade --to 3.2.0
+kubectl knet upgrade --to 3.2.0 --max-unavailable 3 --drain`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := u.Complete(cmd, args); err != nil {
+				return err
+			}
+			if err := u.Validate(); err != nil {
+				return err
+			}
+			if err := u.Run(); err != nil {
+				return err
+			}
+			return nil
+		},
+	}
+	upgradeCmd.Flags().StringVar(&u.To, "to", "", "kata-deploy image tag to upgrade to")
+	addKataDeployImageFlags(upgradeCmd.Flags(), &u.Image)
+	upgradeCmd.Flags().IntVar(&u.MaxUnavailable, "max-unavailable", 1, "upgrade this many nodes at a time")
+	upgradeCmd.Flags().BoolVar(&u.Drain, "drain", false, "cordon nodes running kata pods and evict the kata pods, instead of refusing to upgrade them")
+	upgradeCmd.Flags().BoolVar(&u.Rollback, "rollback", true, "roll the upgraded nodes back to the previous image when the upgrade fails")
+	upgradeCmd.Flags().DurationVar(&u.Timeout, "timeout", wait.DefaultTimeout, "how long to wait for each batch of nodes and for evictions")
+
+	cmd.AddCommand(upgradeCmd)
+}
@@ -0,0 +1,110 @@
+//go:build linux
+// +build linux
+
+package agent
+
+import (
+	"github.com/Tim-0731-Hzt/knet/pkg/pcap"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"net"
+	"time"
+	"unsafe"
+)
+
+// Capture reads ethernet frames from an AF_PACKET socket bound to iface, or
+// to all interfaces for "any", and hands every frame accepted by the filter
+// to w until count packets were written or an error occurs.
+func Capture(iface string, filter string, snaplen uint32, count int, w *Writer) error {
+	// with protocol 0 the socket receives nothing until it is bound, so no
+	// frame gets in before the filter is attached or from other interfaces
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, 0)
+	if err != nil {
+		return errors.Wrap(err, "failed to open packet socket")
+	}
+	defer unix.Close(fd)
+
+	if filter != "" {
+		program, err := CompileFilter(filter, snaplen)
+		if err != nil {
+			return err
+		}
+		sockFilter := make([]unix.SockFilter, len(program))
+		for i, ins := range program {
+			sockFilter[i] = unix.SockFilter{Code: ins.Op, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+		}
+		fprog := unix.SockFprog{Len: uint16(len(sockFilter)), Filter: (*unix.SockFilter)(unsafe.Pointer(&sockFilter[0]))}
+		if err := unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &fprog); err != nil {
+			return errors.Wrap(err, "failed to attach filter")
+		}
+	}
+
+	// have the kernel stamp every frame when it captures it, frames read in
+	// a burst would otherwise all get the time they were read at
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TIMESTAMPNS, 1); err != nil {
+		return errors.Wrap(err, "failed to enable packet timestamps")
+	}
+
+	ifindex := 0
+	if iface != "any" {
+		i, err := net.InterfaceByName(iface)
+		if err != nil {
+			return err
+		}
+		ifindex = i.Index
+	}
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: ifindex}); err != nil {
+		return errors.Wrapf(err, "failed to bind to %s", iface)
+	}
+
+	buf := make([]byte, snaplen)
+	oob := make([]byte, unix.CmsgSpace(int(unsafe.Sizeof(unix.Timespec{}))))
+	for written := 0; count == 0 || written < count; {
+		n, oobn, _, from, err := unix.Recvmsg(fd, buf, oob, unix.MSG_TRUNC)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			return err
+		}
+		// frames of interfaces without an ethernet header, e.g. tunnels,
+		// cannot be written with the ethernet link type
+		if ll, ok := from.(*unix.SockaddrLinklayer); ok && ll.Hatype != unix.ARPHRD_ETHER && ll.Hatype != unix.ARPHRD_LOOPBACK {
+			continue
+		}
+		capLen := n
+		if capLen > len(buf) {
+			capLen = len(buf)
+		}
+		p := &pcap.Packet{
+			Timestamp:      captureTime(oob[:oobn]),
+			OriginalLength: uint32(n),
+			Data:           buf[:capLen],
+		}
+		if err := w.WritePacket(p); err != nil {
+			return err
+		}
+		written++
+	}
+	return nil
+}
+
+// captureTime returns the SO_TIMESTAMPNS time the kernel captured a frame
+// at, or now if the control messages carry none.
+func captureTime(oob []byte) time.Time {
+	messages, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return time.Now()
+	}
+	for _, m := range messages {
+		if m.Header.Level == unix.SOL_SOCKET && m.Header.Type == unix.SCM_TIMESTAMPNS && len(m.Data) >= int(unsafe.Sizeof(unix.Timespec{})) {
+			ts := (*unix.Timespec)(unsafe.Pointer(&m.Data[0]))
+			return time.Unix(ts.Unix())
+		}
+	}
+	return time.Now()
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package agent
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Capture is only implemented on linux, which provides AF_PACKET sockets.
+func Capture(iface string, filter string, snaplen uint32, count int, w *Writer) error {
+	return errors.New("packet capture is only supported on linux")
+}
@@ -0,0 +1,416 @@
+package agent
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"golang.org/x/net/bpf"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// CompileFilter compiles a tcpdump filter expression for ethernet frames to
+// a classic BPF program accepting up to snaplen bytes of matching packets.
+//
+// Only the subset of the pcap-filter language knet needs is supported:
+// the protocols ip, ip6, arp, tcp, udp, icmp and icmp6, the primitives
+// [src|dst] host, [src|dst] net and [src|dst] port, optionally qualified by
+// tcp or udp, combined with and, or, not and parentheses.
+func CompileFilter(expr string, snaplen uint32) ([]bpf.RawInstruction, error) {
+	p := &parser{tokens: tokenize(expr)}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, errors.Errorf("syntax error in filter expression near %q", p.tokens[p.pos])
+	}
+	g := &generator{labels: make(map[int]int)}
+	accept, reject := g.newLabel(), g.newLabel()
+	g.gen(node, accept, reject)
+	g.place(accept)
+	g.emit(bpf.RetConstant{Val: snaplen})
+	g.place(reject)
+	g.emit(bpf.RetConstant{Val: 0})
+	program, err := g.resolve()
+	if err != nil {
+		return nil, err
+	}
+	return bpf.Assemble(program)
+}
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	etherTypeARP  = 0x0806
+
+	ipProtoICMP   = 1
+	ipProtoTCP    = 6
+	ipProtoUDP    = 17
+	ipProtoICMPv6 = 58
+
+	etherHeaderLen = 14
+)
+
+// node is a boolean filter expression.
+type node interface{}
+
+type and struct{ left, right node }
+type or struct{ left, right node }
+type not struct{ x node }
+
+// cmp matches when the masked value at an absolute offset equals val, a
+// zero mask compares the whole value.
+type cmp struct {
+	off  uint32
+	size int
+	mask uint32
+	val  uint32
+}
+
+// ipv4Port matches a TCP or UDP port behind an IPv4 header of variable
+// length.
+type ipv4Port struct {
+	dst  bool
+	port uint32
+}
+
+func anyOf(nodes ...node) node {
+	n := nodes[0]
+	for _, m := range nodes[1:] {
+		n = or{n, m}
+	}
+	return n
+}
+
+func allOf(nodes ...node) node {
+	n := nodes[0]
+	for _, m := range nodes[1:] {
+		n = and{n, m}
+	}
+	return n
+}
+
+func etherType(t uint32) node {
+	return cmp{off: 12, size: 2, val: t}
+}
+
+func ipv4Proto(proto uint32) node {
+	return and{etherType(etherTypeIPv4), cmp{off: etherHeaderLen + 9, size: 1, val: proto}}
+}
+
+func ipv6Proto(proto uint32) node {
+	return and{etherType(etherTypeIPv6), cmp{off: etherHeaderLen + 6, size: 1, val: proto}}
+}
+
+func proto(name string) (node, bool) {
+	switch name {
+	case "ip":
+		return etherType(etherTypeIPv4), true
+	case "ip6":
+		return etherType(etherTypeIPv6), true
+	case "arp":
+		return etherType(etherTypeARP), true
+	case "tcp":
+		return or{ipv4Proto(ipProtoTCP), ipv6Proto(ipProtoTCP)}, true
+	case "udp":
+		return or{ipv4Proto(ipProtoUDP), ipv6Proto(ipProtoUDP)}, true
+	case "icmp":
+		return ipv4Proto(ipProtoICMP), true
+	case "icmp6":
+		return ipv6Proto(ipProtoICMPv6), true
+	}
+	return nil, false
+}
+
+func hostNode(dir string, ip net.IP, mask net.IPMask) node {
+	if ip4 := ip.To4(); ip4 != nil {
+		m := uint32(0xffffffff)
+		if mask != nil {
+			m = binary.BigEndian.Uint32(mask[len(mask)-4:])
+		}
+		if m == 0 {
+			// /0 matches every address, like the zero words of IPv6
+			return etherType(etherTypeIPv4)
+		}
+		v := binary.BigEndian.Uint32(ip4) & m
+		src := cmp{off: etherHeaderLen + 12, size: 4, mask: m, val: v}
+		dst := cmp{off: etherHeaderLen + 16, size: 4, mask: m, val: v}
+		return and{etherType(etherTypeIPv4), direction(dir, src, dst)}
+	}
+	ip16 := ip.To16()
+	if mask == nil {
+		mask = net.CIDRMask(128, 128)
+	}
+	address := func(off uint32) node {
+		var words []node
+		for i := uint32(0); i < 16; i += 4 {
+			m := binary.BigEndian.Uint32(mask[i:])
+			if m == 0 {
+				continue
+			}
+			words = append(words, cmp{off: off + i, size: 4, mask: m, val: binary.BigEndian.Uint32(ip16[i:]) & m})
+		}
+		if len(words) == 0 {
+			return etherType(etherTypeIPv6)
+		}
+		return allOf(words...)
+	}
+	return and{etherType(etherTypeIPv6), direction(dir, address(etherHeaderLen+8), address(etherHeaderLen+24))}
+}
+
+func portNode(dir string, port uint32, protocols []uint32) node {
+	var v4, v6 []node
+	for _, p := range protocols {
+		v4 = append(v4, cmp{off: etherHeaderLen + 9, size: 1, val: p})
+		v6 = append(v6, cmp{off: etherHeaderLen + 6, size: 1, val: p})
+	}
+	ipv4 := allOf(
+		etherType(etherTypeIPv4),
+		anyOf(v4...),
+		// only the first fragment carries the transport header
+		cmp{off: etherHeaderLen + 6, size: 2, mask: 0x1fff, val: 0},
+		direction(dir, ipv4Port{port: port}, ipv4Port{dst: true, port: port}),
+	)
+	// like tcpdump, IPv6 extension headers are not followed
+	ipv6 := allOf(
+		etherType(etherTypeIPv6),
+		anyOf(v6...),
+		direction(dir,
+			cmp{off: etherHeaderLen + 40, size: 2, val: port},
+			cmp{off: etherHeaderLen + 42, size: 2, val: port}),
+	)
+	return or{ipv4, ipv6}
+}
+
+func direction(dir string, src node, dst node) node {
+	switch dir {
+	case "src":
+		return src
+	case "dst":
+		return dst
+	}
+	return or{src, dst}
+}
+
+func tokenize(expr string) []string {
+	expr = strings.NewReplacer("(", " ( ", ")", " ) ", "!", " ! ").Replace(expr)
+	return strings.Fields(expr)
+}
+
+type parser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *parser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *parser) next() string {
+	t := p.peek()
+	if t != "" {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" || p.peek() == "||" {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = or{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "and" || p.peek() == "&&" {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = and{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (node, error) {
+	switch p.peek() {
+	case "not", "!":
+		p.next()
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return not{x}, nil
+	case "(":
+		p.next()
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, errors.New("missing ) in filter expression")
+		}
+		return x, nil
+	}
+	return p.parsePrimitive()
+}
+
+func (p *parser) parsePrimitive() (node, error) {
+	t := p.next()
+	if t == "" {
+		return nil, errors.New("unexpected end of filter expression")
+	}
+	var protocols []uint32
+	protoName := ""
+	if t == "tcp" || t == "udp" {
+		switch p.peek() {
+		case "port", "src", "dst":
+			protoName = t
+			t = p.next()
+		}
+	}
+	switch protoName {
+	case "tcp":
+		protocols = []uint32{ipProtoTCP}
+	case "udp":
+		protocols = []uint32{ipProtoUDP}
+	default:
+		protocols = []uint32{ipProtoTCP, ipProtoUDP}
+	}
+	dir := ""
+	if t == "src" || t == "dst" {
+		dir = t
+		t = p.next()
+	}
+	if protoName != "" && t != "port" {
+		return nil, errors.Errorf("%s can only qualify port in filter expression", protoName)
+	}
+	switch t {
+	case "host":
+		arg := p.next()
+		ip := net.ParseIP(arg)
+		if ip == nil {
+			return nil, errors.Errorf("invalid host %q in filter expression", arg)
+		}
+		return hostNode(dir, ip, nil), nil
+	case "net":
+		arg := p.next()
+		_, ipNet, err := net.ParseCIDR(arg)
+		if err != nil {
+			return nil, errors.Errorf("invalid net %q in filter expression", arg)
+		}
+		return hostNode(dir, ipNet.IP, ipNet.Mask), nil
+	case "port":
+		arg := p.next()
+		port, err := strconv.ParseUint(arg, 10, 16)
+		if err != nil {
+			return nil, errors.Errorf("invalid port %q in filter expression", arg)
+		}
+		return portNode(dir, uint32(port), protocols), nil
+	}
+	if dir == "" && protoName == "" {
+		if n, ok := proto(t); ok {
+			return n, nil
+		}
+	}
+	return nil, errors.Errorf("unsupported filter primitive %q", t)
+}
+
+// generator emits instructions jumping to symbolic labels which are
+// resolved to relative offsets once the whole program is known.
+type generator struct {
+	insns     []pending
+	labels    map[int]int
+	nextLabel int
+}
+
+type pending struct {
+	insn            bpf.Instruction
+	jump            *bpf.JumpIf
+	onTrue, onFalse int
+}
+
+func (g *generator) newLabel() int {
+	g.nextLabel++
+	return g.nextLabel
+}
+
+func (g *generator) place(label int) {
+	g.labels[label] = len(g.insns)
+}
+
+func (g *generator) emit(insn bpf.Instruction) {
+	g.insns = append(g.insns, pending{insn: insn})
+}
+
+func (g *generator) jumpEqual(val uint32, t int, f int) {
+	g.insns = append(g.insns, pending{jump: &bpf.JumpIf{Cond: bpf.JumpEqual, Val: val}, onTrue: t, onFalse: f})
+}
+
+func (g *generator) gen(n node, t int, f int) {
+	switch n := n.(type) {
+	case and:
+		mid := g.newLabel()
+		g.gen(n.left, mid, f)
+		g.place(mid)
+		g.gen(n.right, t, f)
+	case or:
+		mid := g.newLabel()
+		g.gen(n.left, t, mid)
+		g.place(mid)
+		g.gen(n.right, t, f)
+	case not:
+		g.gen(n.x, f, t)
+	case cmp:
+		g.emit(bpf.LoadAbsolute{Off: n.off, Size: n.size})
+		if n.mask != 0 {
+			g.emit(bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: n.mask})
+		}
+		g.jumpEqual(n.val, t, f)
+	case ipv4Port:
+		off := uint32(etherHeaderLen)
+		if n.dst {
+			off += 2
+		}
+		g.emit(bpf.LoadMemShift{Off: etherHeaderLen})
+		g.emit(bpf.LoadIndirect{Off: off, Size: 2})
+		g.jumpEqual(n.port, t, f)
+	}
+}
+
+func (g *generator) resolve() ([]bpf.Instruction, error) {
+	program := make([]bpf.Instruction, len(g.insns))
+	for i, p := range g.insns {
+		if p.jump == nil {
+			program[i] = p.insn
+			continue
+		}
+		skipTrue := g.labels[p.onTrue] - i - 1
+		skipFalse := g.labels[p.onFalse] - i - 1
+		if skipTrue > 255 || skipFalse > 255 {
+			return nil, errors.New("filter expression is too complex")
+		}
+		jump := *p.jump
+		jump.SkipTrue, jump.SkipFalse = uint8(skipTrue), uint8(skipFalse)
+		program[i] = jump
+	}
+	return program, nil
+}
@@ -0,0 +1,277 @@
+package agent
+
+import (
+	"encoding/binary"
+	"golang.org/x/net/bpf"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+const snaplen = 262144
+
+// tcpdumpPrograms are `tcpdump -dd -y EN10MB` outputs of libpcap 1.10.
+// libpcap also matches ARP and RARP for host and net and SCTP for port,
+// which knet leaves out, so the corpus only compares what both support.
+var tcpdumpPrograms = []struct {
+	filter  string
+	program []bpf.RawInstruction
+	ipOnly  bool
+}{
+	{"ip", []bpf.RawInstruction{
+		{Op: 0x28, Jt: 0, Jf: 0, K: 0x0000000c},
+		{Op: 0x15, Jt: 0, Jf: 1, K: 0x00000800},
+		{Op: 0x6, Jt: 0, Jf: 0, K: 0x00040000},
+		{Op: 0x6, Jt: 0, Jf: 0, K: 0x00000000},
+	}, false},
+	{"ip6", []bpf.RawInstruction{
+		{Op: 0x28, Jt: 0, Jf: 0, K: 0x0000000c},
+		{Op: 0x15, Jt: 0, Jf: 1, K: 0x000086dd},
+		{Op: 0x6, Jt: 0, Jf: 0, K: 0x00040000},
+		{Op: 0x6, Jt: 0, Jf: 0, K: 0x00000000},
+	}, false},
+	{"arp", []bpf.RawInstruction{
+		{Op: 0x28, Jt: 0, Jf: 0, K: 0x0000000c},
+		{Op: 0x15, Jt: 0, Jf: 1, K: 0x00000806},
+		{Op: 0x6, Jt: 0, Jf: 0, K: 0x00040000},
+		{Op: 0x6, Jt: 0, Jf: 0, K: 0x00000000},
+	}, false},
+	{"tcp", []bpf.RawInstruction{
+		{Op: 0x28, Jt: 0, Jf: 0, K: 0x0000000c},
+		{Op: 0x15, Jt: 0, Jf: 5, K: 0x000086dd},
+		{Op: 0x30, Jt: 0, Jf: 0, K: 0x00000014},
+		{Op: 0x15, Jt: 6, Jf: 0, K: 0x00000006},
+		{Op: 0x15, Jt: 0, Jf: 6, K: 0x0000002c},
+		{Op: 0x30, Jt: 0, Jf: 0, K: 0x00000036},
+		{Op: 0x15, Jt: 3, Jf: 4, K: 0x00000006},
+		{Op: 0x15, Jt: 0, Jf: 3, K: 0x00000800},
+		{Op: 0x30, Jt: 0, Jf: 0, K: 0x00000017},
+		{Op: 0x15, Jt: 0, Jf: 1, K: 0x00000006},
+		{Op: 0x6, Jt: 0, Jf: 0, K: 0x00040000},
+		{Op: 0x6, Jt: 0, Jf: 0, K: 0x00000000},
+	}, false},
+	{"port 80", []bpf.RawInstruction{
+		{Op: 0x28, Jt: 0, Jf: 0, K: 0x0000000c},
+		{Op: 0x15, Jt: 0, Jf: 8, K: 0x000086dd},
+		{Op: 0x30, Jt: 0, Jf: 0, K: 0x00000014},
+		{Op: 0x15, Jt: 2, Jf: 0, K: 0x00000084},
+		{Op: 0x15, Jt: 1, Jf: 0, K: 0x00000006},
+		{Op: 0x15, Jt: 0, Jf: 17, K: 0x00000011},
+		{Op: 0x28, Jt: 0, Jf: 0, K: 0x00000036},
+		{Op: 0x15, Jt: 14, Jf: 0, K: 0x00000050},
+		{Op: 0x28, Jt: 0, Jf: 0, K: 0x00000038},
+		{Op: 0x15, Jt: 12, Jf: 13, K: 0x00000050},
+		{Op: 0x15, Jt: 0, Jf: 12, K: 0x00000800},
+		{Op: 0x30, Jt: 0, Jf: 0, K: 0x00000017},
+		{Op: 0x15, Jt: 2, Jf: 0, K: 0x00000084},
+		{Op: 0x15, Jt: 1, Jf: 0, K: 0x00000006},
+		{Op: 0x15, Jt: 0, Jf: 8, K: 0x00000011},
+		{Op: 0x28, Jt: 0, Jf: 0, K: 0x00000014},
+		{Op: 0x45, Jt: 6, Jf: 0, K: 0x00001fff},
+		{Op: 0xb1, Jt: 0, Jf: 0, K: 0x0000000e},
+		{Op: 0x48, Jt: 0, Jf: 0, K: 0x0000000e},
+		{Op: 0x15, Jt: 2, Jf: 0, K: 0x00000050},
+		{Op: 0x48, Jt: 0, Jf: 0, K: 0x00000010},
+		{Op: 0x15, Jt: 0, Jf: 1, K: 0x00000050},
+		{Op: 0x6, Jt: 0, Jf: 0, K: 0x00040000},
+		{Op: 0x6, Jt: 0, Jf: 0, K: 0x00000000},
+	}, false},
+	{"host 10.0.0.1", []bpf.RawInstruction{
+		{Op: 0x28, Jt: 0, Jf: 0, K: 0x0000000c},
+		{Op: 0x15, Jt: 0, Jf: 4, K: 0x00000800},
+		{Op: 0x20, Jt: 0, Jf: 0, K: 0x0000001a},
+		{Op: 0x15, Jt: 8, Jf: 0, K: 0x0a000001},
+		{Op: 0x20, Jt: 0, Jf: 0, K: 0x0000001e},
+		{Op: 0x15, Jt: 6, Jf: 7, K: 0x0a000001},
+		{Op: 0x15, Jt: 1, Jf: 0, K: 0x00000806},
+		{Op: 0x15, Jt: 0, Jf: 5, K: 0x00008035},
+		{Op: 0x20, Jt: 0, Jf: 0, K: 0x0000001c},
+		{Op: 0x15, Jt: 2, Jf: 0, K: 0x0a000001},
+		{Op: 0x20, Jt: 0, Jf: 0, K: 0x00000026},
+		{Op: 0x15, Jt: 0, Jf: 1, K: 0x0a000001},
+		{Op: 0x6, Jt: 0, Jf: 0, K: 0x00040000},
+		{Op: 0x6, Jt: 0, Jf: 0, K: 0x00000000},
+	}, true},
+	{"net 10.0.0.0/8", []bpf.RawInstruction{
+		{Op: 0x28, Jt: 0, Jf: 0, K: 0x0000000c},
+		{Op: 0x15, Jt: 0, Jf: 6, K: 0x00000800},
+		{Op: 0x20, Jt: 0, Jf: 0, K: 0x0000001a},
+		{Op: 0x54, Jt: 0, Jf: 0, K: 0xff000000},
+		{Op: 0x15, Jt: 11, Jf: 0, K: 0x0a000000},
+		{Op: 0x20, Jt: 0, Jf: 0, K: 0x0000001e},
+		{Op: 0x54, Jt: 0, Jf: 0, K: 0xff000000},
+		{Op: 0x15, Jt: 8, Jf: 9, K: 0x0a000000},
+		{Op: 0x15, Jt: 1, Jf: 0, K: 0x00000806},
+		{Op: 0x15, Jt: 0, Jf: 7, K: 0x00008035},
+		{Op: 0x20, Jt: 0, Jf: 0, K: 0x0000001c},
+		{Op: 0x54, Jt: 0, Jf: 0, K: 0xff000000},
+		{Op: 0x15, Jt: 3, Jf: 0, K: 0x0a000000},
+		{Op: 0x20, Jt: 0, Jf: 0, K: 0x00000026},
+		{Op: 0x54, Jt: 0, Jf: 0, K: 0xff000000},
+		{Op: 0x15, Jt: 0, Jf: 1, K: 0x0a000000},
+		{Op: 0x6, Jt: 0, Jf: 0, K: 0x00040000},
+		{Op: 0x6, Jt: 0, Jf: 0, K: 0x00000000},
+	}, true},
+}
+
+func ether(etherType uint16, payload []byte) []byte {
+	frame := make([]byte, etherHeaderLen, etherHeaderLen+len(payload))
+	binary.BigEndian.PutUint16(frame[12:], etherType)
+	return append(frame, payload...)
+}
+
+func transport(src uint16, dst uint16) []byte {
+	header := make([]byte, 20)
+	binary.BigEndian.PutUint16(header[0:], src)
+	binary.BigEndian.PutUint16(header[2:], dst)
+	return header
+}
+
+func ipv4(proto byte, src string, dst string, optionWords int, fragment uint16, payload []byte) []byte {
+	header := make([]byte, 20+4*optionWords)
+	header[0] = 0x40 | byte(5+optionWords)
+	binary.BigEndian.PutUint16(header[6:], fragment)
+	header[9] = proto
+	copy(header[12:], net.ParseIP(src).To4())
+	copy(header[16:], net.ParseIP(dst).To4())
+	return ether(etherTypeIPv4, append(header, payload...))
+}
+
+func ipv6(next byte, src string, dst string, payload []byte) []byte {
+	header := make([]byte, 40)
+	header[0] = 0x60
+	header[6] = next
+	copy(header[8:], net.ParseIP(src).To16())
+	copy(header[24:], net.ParseIP(dst).To16())
+	return ether(etherTypeIPv6, append(header, payload...))
+}
+
+func arpRequest(spa string, tpa string) []byte {
+	body := make([]byte, 28)
+	copy(body[14:], net.ParseIP(spa).To4())
+	copy(body[24:], net.ParseIP(tpa).To4())
+	return ether(etherTypeARP, body)
+}
+
+var corpus = map[string][]byte{
+	"tcp4":     ipv4(ipProtoTCP, "10.0.0.1", "192.168.1.2", 0, 0, transport(1234, 80)),
+	"tcp4opts": ipv4(ipProtoTCP, "192.168.1.2", "10.1.2.3", 1, 0, transport(80, 5555)),
+	"udp4dns":  ipv4(ipProtoUDP, "172.16.0.5", "10.0.0.53", 0, 0, transport(40000, 53)),
+	"frag4":    ipv4(ipProtoUDP, "10.9.9.9", "192.168.1.2", 0, 100, transport(80, 80)),
+	"icmp4":    ipv4(ipProtoICMP, "10.0.0.1", "8.8.8.8", 0, 0, make([]byte, 8)),
+	"tcp6":     ipv6(ipProtoTCP, "fd00::1", "2001:db8::2", transport(443, 50000)),
+	"udp6":     ipv6(ipProtoUDP, "fe80::1", "ff02::fb", transport(5353, 5353)),
+	"icmp6":    ipv6(ipProtoICMPv6, "2001:db8::2", "fd00::1", make([]byte, 8)),
+	"arp":      arpRequest("10.0.0.1", "10.0.0.2"),
+}
+
+func run(t *testing.T, program []bpf.RawInstruction, packet []byte) bool {
+	t.Helper()
+	insns, ok := bpf.Disassemble(program)
+	if !ok {
+		t.Fatalf("program does not disassemble: %v", program)
+	}
+	vm, err := bpf.NewVM(insns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := vm.Run(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n > 0
+}
+
+func TestCompileFilterMatchesTcpdump(t *testing.T) {
+	for _, tt := range tcpdumpPrograms {
+		t.Run(tt.filter, func(t *testing.T) {
+			program, err := CompileFilter(tt.filter, snaplen)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, packet := range corpus {
+				if tt.ipOnly && name == "arp" {
+					continue
+				}
+				if got, want := run(t, program, packet), run(t, tt.program, packet); got != want {
+					t.Errorf("%s: knet accepts %v, tcpdump %v", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCompileFilterEtherTypeIsTcpdumpsProgram(t *testing.T) {
+	program, err := CompileFilter("ip", snaplen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(program, tcpdumpPrograms[0].program) {
+		t.Errorf("got %v, want %v", program, tcpdumpPrograms[0].program)
+	}
+}
+
+func TestCompileFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		match  []string
+	}{
+		{"net 0.0.0.0/0", []string{"frag4", "icmp4", "tcp4", "tcp4opts", "udp4dns"}},
+		{"dst net 0.0.0.0/0", []string{"frag4", "icmp4", "tcp4", "tcp4opts", "udp4dns"}},
+		{"net ::/0", []string{"icmp6", "tcp6", "udp6"}},
+		{"src net 10.0.0.0/8", []string{"frag4", "icmp4", "tcp4"}},
+		{"dst net 10.0.0.0/8", []string{"tcp4opts", "udp4dns"}},
+		{"net fd00::/8", []string{"icmp6", "tcp6"}},
+		{"host fe80::1", []string{"udp6"}},
+		{"src host 10.0.0.1 or dst host fd00::1", []string{"icmp4", "icmp6", "tcp4"}},
+		{"port 80", []string{"tcp4", "tcp4opts"}},
+		{"dst port 53", []string{"udp4dns"}},
+		{"udp port 5353", []string{"udp6"}},
+		{"tcp dst port 443", nil},
+		{"tcp src port 443", []string{"tcp6"}},
+		{"udp port 80", nil},
+		{"icmp", []string{"icmp4"}},
+		{"icmp6", []string{"icmp6"}},
+		{"not arp", []string{"frag4", "icmp4", "icmp6", "tcp4", "tcp4opts", "tcp6", "udp4dns", "udp6"}},
+		{"!ip6 && !arp", []string{"frag4", "icmp4", "tcp4", "tcp4opts", "udp4dns"}},
+		{"ip and (port 53 or icmp)", []string{"icmp4", "udp4dns"}},
+		{"udp or tcp and port 443", []string{"frag4", "tcp6", "udp4dns", "udp6"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			program, err := CompileFilter(tt.filter, snaplen)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for name, packet := range corpus {
+				if run(t, program, packet) {
+					got = append(got, name)
+				}
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.match) {
+				t.Errorf("matches %v, want %v", got, tt.match)
+			}
+		})
+	}
+}
+
+func TestCompileFilterErrors(t *testing.T) {
+	for _, filter := range []string{
+		"",
+		"tcp host 10.0.0.1",
+		"port 70000",
+		"host nope",
+		"net 10.0.0.1",
+		"(ip",
+		"ip ip",
+		"vlan",
+		"src ip",
+	} {
+		if _, err := CompileFilter(filter, snaplen); err == nil {
+			t.Errorf("%q: want an error", filter)
+		}
+	}
+}
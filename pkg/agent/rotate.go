@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"fmt"
+	"github.com/Tim-0731-Hzt/knet/pkg/pcap"
+	"io"
+	"os"
+	"time"
+)
+
+// RotateOptions control when the capture moves on to a new file, mirroring
+// tcpdump's -C, -G and -W flags.
+type RotateOptions struct {
+	// FileSize rotates once the current file exceeds this many bytes.
+	FileSize int64
+	// Interval rotates once the current file is older than this.
+	Interval time.Duration
+	// FileCount limits the number of files, older files are overwritten.
+	FileCount int
+}
+
+// Writer writes packets to stdout or to a set of rotated pcap files named
+// like tcpdump names them: file, file1, file2 and so on.
+type Writer struct {
+	header  pcap.Header
+	name    string
+	options RotateOptions
+	index   int
+	out     io.Writer
+	file    *os.File
+	written int64
+	opened  time.Time
+}
+
+func NewWriter(name string, header pcap.Header, options RotateOptions) (*Writer, error) {
+	w := &Writer{header: header, name: name, options: options}
+	if name == "-" {
+		w.out = os.Stdout
+		return w, w.writeHeader()
+	}
+	return w, w.open()
+}
+
+func (w *Writer) WritePacket(p *pcap.Packet) error {
+	if w.file != nil && w.rotationDue() {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	record := pcap.EncodePacket(p)
+	n, err := w.out.Write(record)
+	w.written += int64(n)
+	return err
+}
+
+func (w *Writer) Close() error {
+	if w.file != nil {
+		return w.file.Close()
+	}
+	return nil
+}
+
+func (w *Writer) rotationDue() bool {
+	if w.options.FileSize > 0 && w.written >= w.options.FileSize {
+		return true
+	}
+	return w.options.Interval > 0 && time.Since(w.opened) >= w.options.Interval
+}
+
+func (w *Writer) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.index++
+	if w.options.FileCount > 0 && w.index >= w.options.FileCount {
+		w.index = 0
+	}
+	return w.open()
+}
+
+func (w *Writer) open() error {
+	name := w.name
+	if w.index > 0 {
+		name = fmt.Sprintf("%s%d", w.name, w.index)
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	w.file, w.out, w.written, w.opened = f, f, 0, time.Now()
+	return w.writeHeader()
+}
+
+func (w *Writer) writeHeader() error {
+	n, err := w.out.Write(pcap.EncodeHeader(w.header))
+	w.written += int64(n)
+	return err
+}
@@ -0,0 +1,129 @@
+package cast
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Header is the first line of a cast file.
+type Header struct {
+	Version   int               `json:"version"`
+	Width     uint16            `json:"width"`
+	Height    uint16            `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Writer writes the output of a session as "o" events and terminal
+// resizes as "r" events. The header is written with the first size, so
+// Resize has to be called before the session starts. Errors do not
+// interrupt the session, they are reported by Close.
+type Writer struct {
+	mu      sync.Mutex
+	w       io.Writer
+	title   string
+	start   time.Time
+	width   uint16
+	height  uint16
+	started bool
+	pending []byte
+	err     error
+}
+
+func NewWriter(w io.Writer, title string) *Writer {
+	return &Writer{w: w, title: title}
+}
+
+// Resize records the terminal size.
+func (c *Writer) Resize(width uint16, height uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.started {
+		c.started = true
+		c.start = time.Now()
+		c.width, c.height = width, height
+		c.encode(Header{
+			Version:   2,
+			Width:     width,
+			Height:    height,
+			Timestamp: c.start.Unix(),
+			Title:     c.title,
+			Env:       map[string]string{"TERM": os.Getenv("TERM"), "SHELL": os.Getenv("SHELL")},
+		})
+		return
+	}
+	if width == c.width && height == c.height {
+		return
+	}
+	c.width, c.height = width, height
+	c.event("r", fmt.Sprintf("%dx%d", width, height))
+}
+
+// Write records output of the session. Multi-byte characters split across
+// writes are held back until they are complete, event data has to be valid
+// UTF-8.
+func (c *Writer) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.started {
+		return len(p), nil
+	}
+	data := append(c.pending, p...)
+	n := len(data) - incompleteSuffix(data)
+	c.pending = append([]byte(nil), data[n:]...)
+	if n > 0 {
+		c.event("o", string(data[:n]))
+	}
+	return len(p), nil
+}
+
+// Close flushes held back output and returns the first error.
+func (c *Writer) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.pending) > 0 {
+		c.event("o", string(c.pending))
+		c.pending = nil
+	}
+	return c.err
+}
+
+func (c *Writer) event(kind string, data string) {
+	c.encode([]interface{}{time.Since(c.start).Seconds(), kind, data})
+}
+
+func (c *Writer) encode(v interface{}) {
+	if c.err != nil {
+		return
+	}
+	line, err := json.Marshal(v)
+	if err != nil {
+		c.err = err
+		return
+	}
+	_, c.err = c.w.Write(append(line, '\n'))
+}
+
+// incompleteSuffix returns the length of a truncated UTF-8 sequence at the
+// end of p.
+func incompleteSuffix(p []byte) int {
+	for i := 1; i < utf8.UTFMax && i <= len(p); i++ {
+		b := p[len(p)-i]
+		if b < 0x80 {
+			return 0
+		}
+		if utf8.RuneStart(b) {
+			if utf8.FullRune(p[len(p)-i:]) {
+				return 0
+			}
+			return i
+		}
+	}
+	return 0
+}
@@ -0,0 +1,67 @@
+package kube
+
+import (
+	"io"
+)
+
+// escapeReader passes a raw terminal input through and detaches the
+// session when the ssh style escape sequence ~. is typed at the beginning
+// of a line. ~~ sends a single ~, a ~ followed by anything else is sent as
+// typed.
+type escapeReader struct {
+	r         io.Reader
+	detach    func()
+	buf       []byte
+	out       []byte
+	lineStart bool
+	tilde     bool
+	detached  bool
+	err       error
+}
+
+func newEscapeReader(r io.Reader, detach func()) *escapeReader {
+	return &escapeReader{r: r, detach: detach, buf: make([]byte, 32*1024), lineStart: true}
+}
+
+func (e *escapeReader) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.detached {
+			return 0, io.EOF
+		}
+		if e.err != nil {
+			return 0, e.err
+		}
+		n, err := e.r.Read(e.buf)
+		e.scan(e.buf[:n])
+		e.err = err
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+func (e *escapeReader) scan(input []byte) {
+	e.out = e.out[:0]
+	for _, c := range input {
+		if e.tilde {
+			e.tilde = false
+			switch c {
+			case '.':
+				e.detached = true
+				e.detach()
+				return
+			case '~':
+				e.out = append(e.out, c)
+				e.lineStart = false
+				continue
+			}
+			e.out = append(e.out, '~')
+		} else if e.lineStart && c == '~' {
+			e.tilde = true
+			continue
+		}
+		e.out = append(e.out, c)
+		// the terminal is raw, enter arrives as a carriage return
+		e.lineStart = c == '\r' || c == '\n'
+	}
+}
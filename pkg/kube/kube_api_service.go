@@ -1,22 +1,28 @@
 package kube
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/Tim-0731-Hzt/knet/pkg/wait"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/crypto/ssh/terminal"
 	"io"
 	apps_v1 "k8s.io/api/apps/v1"
 	api_v1 "k8s.io/api/core/v1"
 	v1 "k8s.io/api/core/v1"
 	node_v1 "k8s.io/api/node/v1"
+	policy_v1 "k8s.io/api/policy/v1"
 	rbac "k8s.io/api/rbac/v1"
 	k_error "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/cli-runtime/pkg/genericclioptions"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -25,18 +31,31 @@ import (
 	utilexec "k8s.io/client-go/util/exec"
 	"k8s.io/kubectl/pkg/cmd/debug"
 	"k8s.io/kubectl/pkg/scheme"
+	"k8s.io/kubectl/pkg/util/interrupt"
+	"k8s.io/kubectl/pkg/util/term"
 	"os"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
 var KubernetesConfigFlags = genericclioptions.NewConfigFlags(true)
 
+// FieldManager owns the fields of the objects knet applies.
+const FieldManager = "knet"
+
+// DefaultCaptureImage is the static knet capture agent built from
+// cmd/agent, it provides /usr/bin/tcpdump and sleep. Releases set it to the
+// image the release workflow pushes with the same tag, so nodes never keep
+// running an agent of another release.
+var DefaultCaptureImage = "docker.io/tim12312/knet-agent:latest"
+
 type KubernetesApiService interface {
 	ExecuteCommand(req ExecCommandRequest) (int, error)
 	CreatePod(podName string) error
 	DeletePod(podName string, ks KubernetesApiService) error
 	GetPod(podName string, namespace string) (*v1.Pod, error)
-	GenerateDebugContainer(podName string, namespace string, containerName string, debugContainerName string) (*v1.Pod, *v1.EphemeralContainer, error)
+	GenerateDebugContainer(podName string, namespace string, containerName string, debugContainerName string, image string) (*v1.Pod, *v1.EphemeralContainer, error)
 	DeployDaemonSet(d *apps_v1.DaemonSet) error
 }
 type KubernetesApiServiceImpl struct {
@@ -45,6 +64,8 @@ type KubernetesApiServiceImpl struct {
 	resultingContext *api.Context
 	targetNamespace  string
 	applier          debug.ProfileApplier
+	// dryRun is passed to the requests changing kata's objects and nodes.
+	dryRun []string
 }
 
 type ExecCommandRequest struct {
@@ -55,6 +76,29 @@ type ExecCommandRequest struct {
 	StdIn     io.Reader
 	StdOut    io.Writer
 	StdErr    io.Writer
+	// Recorder receives the output of interactive sessions.
+	Recorder SessionRecorder
+}
+
+// SessionRecorder records an interactive session, its output and the size
+// of the terminal.
+type SessionRecorder interface {
+	io.Writer
+	Resize(width uint16, height uint16)
+}
+
+// recordedSizeQueue passes terminal resizes on to the recorder.
+type recordedSizeQueue struct {
+	remotecommand.TerminalSizeQueue
+	recorder SessionRecorder
+}
+
+func (q *recordedSizeQueue) Next() *remotecommand.TerminalSize {
+	size := q.TerminalSizeQueue.Next()
+	if size != nil {
+		q.recorder.Resize(size.Width, size.Height)
+	}
+	return size
 }
 
 type Writer struct {
@@ -80,6 +124,12 @@ func NewKubernetesApiServiceImpl() (k *KubernetesApiServiceImpl, err error) {
 	return k, nil
 }
 
+// ServerDryRun makes the API server validate the changes to kata's objects
+// and nodes without persisting them.
+func (k *KubernetesApiServiceImpl) ServerDryRun() {
+	k.dryRun = []string{metav1.DryRunAll}
+}
+
 func (k *KubernetesApiServiceImpl) ExecuteCommand(req ExecCommandRequest) (int, error) {
 	execRequest := k.clientset.CoreV1().RESTClient().Post().Resource("pods").Name(req.PodName).Namespace(req.Namespace).SubResource("exec")
 	execRequest.VersionedParams(&v1.PodExecOptions{
@@ -87,24 +137,26 @@ func (k *KubernetesApiServiceImpl) ExecuteCommand(req ExecCommandRequest) (int,
 		Command:   req.Command,
 		Stdin:     req.StdIn != nil,
 		Stdout:    req.StdOut != nil,
+		Stderr:    req.StdErr != nil,
 		TTY:       false,
 	}, scheme.ParameterCodec)
 	exec, err := remotecommand.NewSPDYExecutor(k.restConfig, "POST", execRequest.URL())
 	if err != nil {
-		return 0, nil
+		return 1, err
 	}
 	err = exec.StreamWithContext(context.TODO(), remotecommand.StreamOptions{
+		Stdin:  req.StdIn,
 		Stdout: req.StdOut,
+		Stderr: req.StdErr,
 		Tty:    false,
 	})
-	var exitCode = 0
 	if err != nil {
 		if exitErr, ok := err.(utilexec.ExitError); ok && exitErr.Exited() {
-			exitCode = exitErr.ExitStatus()
-			return 1, err
+			return exitErr.ExitStatus(), err
 		}
+		return 1, err
 	}
-	return exitCode, nil
+	return 0, nil
 }
 
 func (k *KubernetesApiServiceImpl) CreatePod(podName string) error {
@@ -165,14 +217,129 @@ func (k *KubernetesApiServiceImpl) GetPod(podName string, namespace string) (*v1
 	return k.clientset.CoreV1().Pods(namespace).Get(context.TODO(), podName, metav1.GetOptions{})
 }
 
-func (k *KubernetesApiServiceImpl) GenerateDebugContainer(podName string, namespace string, containerName string, debugContainerName string) (*v1.Pod, *v1.EphemeralContainer, error) {
+func (k *KubernetesApiServiceImpl) GetNode(nodeName string) (*v1.Node, error) {
+	return k.clientset.CoreV1().Nodes().Get(context.TODO(), nodeName, metav1.GetOptions{})
+}
+
+func (k *KubernetesApiServiceImpl) ListRuntimeClasses() ([]node_v1.RuntimeClass, error) {
+	classes, err := k.clientset.NodeV1().RuntimeClasses().List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return classes.Items, nil
+}
+
+func (k *KubernetesApiServiceImpl) GetRuntimeClass(name string) (*node_v1.RuntimeClass, error) {
+	return k.clientset.NodeV1().RuntimeClasses().Get(context.TODO(), name, metav1.GetOptions{})
+}
+
+// CreatePodEvent records a normal event reported by knet on the pod.
+func (k *KubernetesApiServiceImpl) CreatePodEvent(pod *v1.Pod, reason string, message string) error {
+	now := metav1.Now()
+	event := &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", pod.Name, now.UnixNano()),
+			Namespace: pod.Namespace,
+		},
+		InvolvedObject: v1.ObjectReference{
+			Kind:            "Pod",
+			APIVersion:      "v1",
+			Name:            pod.Name,
+			Namespace:       pod.Namespace,
+			UID:             pod.UID,
+			ResourceVersion: pod.ResourceVersion,
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           v1.EventTypeNormal,
+		Source:         v1.EventSource{Component: "knet"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	_, err := k.clientset.CoreV1().Events(pod.Namespace).Create(context.TODO(), event, metav1.CreateOptions{})
+	return err
+}
+
+// CurrentUser describes who talks to the cluster: the impersonated user, or
+// the kubeconfig user of the current context.
+func (k *KubernetesApiServiceImpl) CurrentUser() string {
+	if k.restConfig.Impersonate.UserName != "" {
+		return k.restConfig.Impersonate.UserName
+	}
+	if KubernetesConfigFlags.AuthInfoName != nil && *KubernetesConfigFlags.AuthInfoName != "" {
+		return *KubernetesConfigFlags.AuthInfoName
+	}
+	raw, err := KubernetesConfigFlags.ToRawKubeConfigLoader().RawConfig()
+	if err != nil {
+		return "unknown"
+	}
+	contextName := raw.CurrentContext
+	if KubernetesConfigFlags.Context != nil && *KubernetesConfigFlags.Context != "" {
+		contextName = *KubernetesConfigFlags.Context
+	}
+	if c, ok := raw.Contexts[contextName]; ok && c.AuthInfo != "" {
+		return c.AuthInfo
+	}
+	return "unknown"
+}
+
+func (k *KubernetesApiServiceImpl) ListNodes(selector string) ([]v1.Node, error) {
+	nodes, err := k.clientset.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+	return nodes.Items, nil
+}
+
+// LabelNode sets the label on the node, or removes it when value is nil.
+func (k *KubernetesApiServiceImpl) LabelNode(nodeName string, key string, value *string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"labels": map[string]*string{key: value}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = k.clientset.CoreV1().Nodes().Patch(context.TODO(), nodeName, types.MergePatchType, patch, metav1.PatchOptions{DryRun: k.dryRun})
+	return err
+}
+
+func (k *KubernetesApiServiceImpl) ListPods(namespace string) ([]v1.Pod, error) {
+	pods, err := k.clientset.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return pods.Items, nil
+}
+
+func (k *KubernetesApiServiceImpl) WatchPod(podName string, namespace string) (watch.Interface, error) {
+	return k.clientset.CoreV1().Pods(namespace).Watch(context.TODO(), metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("metadata.name", podName).String(),
+	})
+}
+
+// WatchPodEvents watches the events of all pods in the namespace that are
+// newer than the moment of the call.
+func (k *KubernetesApiServiceImpl) WatchPodEvents(namespace string) (watch.Interface, error) {
+	selector := fields.OneTermEqualSelector("involvedObject.kind", "Pod").String()
+	events, err := k.clientset.CoreV1().Events(namespace).List(context.TODO(), metav1.ListOptions{FieldSelector: selector, Limit: 1})
+	if err != nil {
+		return nil, err
+	}
+	return k.clientset.CoreV1().Events(namespace).Watch(context.TODO(), metav1.ListOptions{
+		FieldSelector:   selector,
+		ResourceVersion: events.ResourceVersion,
+	})
+}
+
+func (k *KubernetesApiServiceImpl) GenerateDebugContainer(podName string, namespace string, containerName string, debugContainerName string, image string) (*v1.Pod, *v1.EphemeralContainer, error) {
 	pod, err := k.GetPod(podName, namespace)
 	if err != nil {
 		return nil, nil, err
 	}
 	ecc := v1.EphemeralContainerCommon{
 		Name:            debugContainerName,
-		Image:           "nicolaka/netshoot",
+		Image:           image,
 		ImagePullPolicy: v1.PullIfNotPresent,
 		Args:            []string{"sleep", "3600"},
 	}
@@ -205,59 +372,91 @@ func (k *KubernetesApiServiceImpl) GenerateDebugContainer(podName string, namesp
 	return copied, ec, nil
 }
 
+// DeployDaemonSet applies the DaemonSet, taking over fields others changed.
 func (k *KubernetesApiServiceImpl) DeployDaemonSet(d *apps_v1.DaemonSet) error {
-	if _, err := k.clientset.AppsV1().DaemonSets("kube-system").Create(context.TODO(), d, metav1.CreateOptions{}); err != nil {
-		if k_error.IsAlreadyExists(err) {
-			log.Warnf(err.Error())
-		} else {
-			return err
-		}
-	}
-	return nil
+	d = d.DeepCopy()
+	d.SetGroupVersionKind(apps_v1.SchemeGroupVersion.WithKind("DaemonSet"))
+	_, err := k.ApplyKataObject(d, true, false)
+	return err
 }
 
-func (k *KubernetesApiServiceImpl) CreateRuntimeClass(d *node_v1.RuntimeClass) error {
-	if _, err := k.clientset.NodeV1().RuntimeClasses().Create(context.TODO(), d, metav1.CreateOptions{}); err != nil {
-		if k_error.IsAlreadyExists(err) {
-			log.Warnf(err.Error())
-		} else {
-			return err
-		}
+func (k *KubernetesApiServiceImpl) GetDaemonSet(name string) (*apps_v1.DaemonSet, error) {
+	return k.clientset.AppsV1().DaemonSets("kube-system").Get(context.TODO(), name, metav1.GetOptions{})
+}
+
+// AnnotateDaemonSet merges the annotations into the DaemonSet's.
+func (k *KubernetesApiServiceImpl) AnnotateDaemonSet(name string, annotations map[string]string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": annotations},
+	})
+	if err != nil {
+		return err
 	}
-	return nil
+	_, err = k.clientset.AppsV1().DaemonSets("kube-system").Patch(context.TODO(), name, types.MergePatchType, patch, metav1.PatchOptions{DryRun: k.dryRun})
+	return err
 }
 
-func (k *KubernetesApiServiceImpl) CreateRbac(sva *api_v1.ServiceAccount, cr *rbac.ClusterRole, crb *rbac.ClusterRoleBinding) error {
-	_, err := k.clientset.CoreV1().ServiceAccounts("kube-system").Create(context.TODO(), sva, metav1.CreateOptions{})
+// ListDeployPods lists the kube-system pods matching the label selector.
+func (k *KubernetesApiServiceImpl) ListDeployPods(ls string) ([]v1.Pod, error) {
+	pods, err := k.clientset.CoreV1().Pods("kube-system").List(context.TODO(), metav1.ListOptions{LabelSelector: ls})
 	if err != nil {
-		if k_error.IsAlreadyExists(err) {
-			log.Warnf(err.Error())
-		} else {
-			return err
-		}
+		return nil, err
 	}
-	_, err = k.clientset.RbacV1().ClusterRoles().Create(context.TODO(), cr, metav1.CreateOptions{})
+	return pods.Items, nil
+}
+
+// UpdateDaemonSet replaces the kube-system DaemonSet.
+func (k *KubernetesApiServiceImpl) UpdateDaemonSet(d *apps_v1.DaemonSet) (*apps_v1.DaemonSet, error) {
+	return k.clientset.AppsV1().DaemonSets("kube-system").Update(context.TODO(), d, metav1.UpdateOptions{DryRun: k.dryRun})
+}
+
+// DeleteDeployPod deletes a kube-system pod, its DaemonSet replaces it.
+func (k *KubernetesApiServiceImpl) DeleteDeployPod(name string) error {
+	return k.clientset.CoreV1().Pods("kube-system").Delete(context.TODO(), name, metav1.DeleteOptions{DryRun: k.dryRun})
+}
+
+// ListPodsOnNode lists the pods of all namespaces scheduled to the node.
+func (k *KubernetesApiServiceImpl) ListPodsOnNode(nodeName string) ([]v1.Pod, error) {
+	pods, err := k.clientset.CoreV1().Pods("").List(context.TODO(), metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", nodeName).String(),
+	})
 	if err != nil {
-		if k_error.IsAlreadyExists(err) {
-			log.Warnf(err.Error())
-		} else {
-			return err
-		}
+		return nil, err
 	}
-	_, err = k.clientset.RbacV1().ClusterRoleBindings().Create(context.TODO(), crb, metav1.CreateOptions{})
+	return pods.Items, nil
+}
+
+// CordonNode marks the node unschedulable, or schedulable again.
+func (k *KubernetesApiServiceImpl) CordonNode(nodeName string, unschedulable bool) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{"unschedulable": unschedulable},
+	})
 	if err != nil {
-		if k_error.IsAlreadyExists(err) {
-			log.Warnf(err.Error())
-			return nil
-		} else {
-			return err
-		}
+		return err
 	}
-	return nil
+	_, err = k.clientset.CoreV1().Nodes().Patch(context.TODO(), nodeName, types.MergePatchType, patch, metav1.PatchOptions{DryRun: k.dryRun})
+	return err
+}
+
+// EvictPod evicts the pod, honouring its PodDisruptionBudgets.
+func (k *KubernetesApiServiceImpl) EvictPod(pod *v1.Pod) error {
+	return k.clientset.PolicyV1().Evictions(pod.Namespace).Evict(context.TODO(), &policy_v1.Eviction{
+		ObjectMeta:    metav1.ObjectMeta{Name: pod.Name, Namespace: pod.Namespace},
+		DeleteOptions: &metav1.DeleteOptions{DryRun: k.dryRun},
+	})
+}
+
+// Waiter watches the kube-system pods for up to timeout.
+func (k *KubernetesApiServiceImpl) Waiter(timeout time.Duration) *wait.Waiter {
+	return wait.New(k.clientset, timeout)
+}
+
+func (k *KubernetesApiServiceImpl) GetSecret(namespace string, name string) (*v1.Secret, error) {
+	return k.clientset.CoreV1().Secrets(namespace).Get(context.TODO(), name, metav1.GetOptions{})
 }
 
 func (k *KubernetesApiServiceImpl) DeleteDaemonSet(d string) error {
-	err := k.clientset.AppsV1().DaemonSets("kube-system").Delete(context.TODO(), d, metav1.DeleteOptions{})
+	err := k.clientset.AppsV1().DaemonSets("kube-system").Delete(context.TODO(), d, metav1.DeleteOptions{DryRun: k.dryRun})
 	if err != nil {
 		if k_error.IsNotFound(err) {
 			log.Warnf(err.Error())
@@ -268,8 +467,105 @@ func (k *KubernetesApiServiceImpl) DeleteDaemonSet(d string) error {
 	return nil
 }
 
+// ApplyKataObject server-side applies one of the objects deploy installs, it
+// needs its apiVersion and kind. It returns the object as stored by the API
+// server, with preview the object is only computed, not stored. force takes
+// over fields other managers own.
+func (k *KubernetesApiServiceImpl) ApplyKataObject(obj runtime.Object, force bool, preview bool) (runtime.Object, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	opt := metav1.PatchOptions{FieldManager: FieldManager, Force: &force, DryRun: k.dryRun}
+	if preview {
+		opt.DryRun = []string{metav1.DryRunAll}
+	}
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return nil, err
+	}
+	name := accessor.GetName()
+	switch obj.(type) {
+	case *api_v1.ServiceAccount:
+		return k.clientset.CoreV1().ServiceAccounts("kube-system").Patch(context.TODO(), name, types.ApplyPatchType, data, opt)
+	case *rbac.ClusterRole:
+		return k.clientset.RbacV1().ClusterRoles().Patch(context.TODO(), name, types.ApplyPatchType, data, opt)
+	case *rbac.ClusterRoleBinding:
+		return k.clientset.RbacV1().ClusterRoleBindings().Patch(context.TODO(), name, types.ApplyPatchType, data, opt)
+	case *apps_v1.DaemonSet:
+		return k.clientset.AppsV1().DaemonSets("kube-system").Patch(context.TODO(), name, types.ApplyPatchType, data, opt)
+	case *node_v1.RuntimeClass:
+		return k.clientset.NodeV1().RuntimeClasses().Patch(context.TODO(), name, types.ApplyPatchType, data, opt)
+	}
+	return nil, errors.Errorf("cannot apply %T", obj)
+}
+
+// GetKataObject gets one of the objects deploy installs by kind and name.
+func (k *KubernetesApiServiceImpl) GetKataObject(kind string, name string) (runtime.Object, error) {
+	opt := metav1.GetOptions{}
+	switch kind {
+	case "serviceaccount":
+		return k.clientset.CoreV1().ServiceAccounts("kube-system").Get(context.TODO(), name, opt)
+	case "clusterrole":
+		return k.clientset.RbacV1().ClusterRoles().Get(context.TODO(), name, opt)
+	case "clusterrolebinding":
+		return k.clientset.RbacV1().ClusterRoleBindings().Get(context.TODO(), name, opt)
+	case "daemonset":
+		return k.clientset.AppsV1().DaemonSets("kube-system").Get(context.TODO(), name, opt)
+	case "runtimeclass":
+		return k.clientset.NodeV1().RuntimeClasses().Get(context.TODO(), name, opt)
+	}
+	return nil, errors.Errorf("cannot get %s/%s", kind, name)
+}
+
+// DeleteKataObject deletes one of the objects deploy installs by kind and
+// name, missing objects are only warned about.
+func (k *KubernetesApiServiceImpl) DeleteKataObject(kind string, name string) error {
+	opt := metav1.DeleteOptions{DryRun: k.dryRun}
+	var err error
+	switch kind {
+	case "serviceaccount":
+		err = k.clientset.CoreV1().ServiceAccounts("kube-system").Delete(context.TODO(), name, opt)
+	case "clusterrole":
+		err = k.clientset.RbacV1().ClusterRoles().Delete(context.TODO(), name, opt)
+	case "clusterrolebinding":
+		err = k.clientset.RbacV1().ClusterRoleBindings().Delete(context.TODO(), name, opt)
+	case "daemonset":
+		err = k.clientset.AppsV1().DaemonSets("kube-system").Delete(context.TODO(), name, opt)
+	case "runtimeclass":
+		err = k.clientset.NodeV1().RuntimeClasses().Delete(context.TODO(), name, opt)
+	default:
+		return errors.Errorf("cannot delete %s/%s", kind, name)
+	}
+	if k_error.IsNotFound(err) {
+		log.Warnf(err.Error())
+		return nil
+	}
+	return err
+}
+
+func (k *KubernetesApiServiceImpl) GetConfigMap(name string) (*v1.ConfigMap, error) {
+	return k.clientset.CoreV1().ConfigMaps("kube-system").Get(context.TODO(), name, metav1.GetOptions{})
+}
+
+func (k *KubernetesApiServiceImpl) CreateConfigMap(c *v1.ConfigMap) (*v1.ConfigMap, error) {
+	return k.clientset.CoreV1().ConfigMaps("kube-system").Create(context.TODO(), c, metav1.CreateOptions{})
+}
+
+func (k *KubernetesApiServiceImpl) UpdateConfigMap(c *v1.ConfigMap) (*v1.ConfigMap, error) {
+	return k.clientset.CoreV1().ConfigMaps("kube-system").Update(context.TODO(), c, metav1.UpdateOptions{})
+}
+
+func (k *KubernetesApiServiceImpl) DeleteConfigMap(name string) error {
+	err := k.clientset.CoreV1().ConfigMaps("kube-system").Delete(context.TODO(), name, metav1.DeleteOptions{})
+	if k_error.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
 func (k *KubernetesApiServiceImpl) DeleteRuntimeClass(s string) error {
-	err := k.clientset.NodeV1().RuntimeClasses().Delete(context.TODO(), s, metav1.DeleteOptions{})
+	err := k.clientset.NodeV1().RuntimeClasses().Delete(context.TODO(), s, metav1.DeleteOptions{DryRun: k.dryRun})
 	if err != nil {
 		if k_error.IsNotFound(err) {
 			log.Warnf(err.Error())
@@ -281,7 +577,7 @@ func (k *KubernetesApiServiceImpl) DeleteRuntimeClass(s string) error {
 }
 
 func (k *KubernetesApiServiceImpl) DeleteRbac() error {
-	err := k.clientset.CoreV1().ServiceAccounts("kube-system").Delete(context.TODO(), "kata-label-node", metav1.DeleteOptions{})
+	err := k.clientset.CoreV1().ServiceAccounts("kube-system").Delete(context.TODO(), "kata-label-node", metav1.DeleteOptions{DryRun: k.dryRun})
 	if err != nil {
 		if k_error.IsNotFound(err) {
 			log.Warnf(err.Error())
@@ -289,7 +585,7 @@ func (k *KubernetesApiServiceImpl) DeleteRbac() error {
 			return err
 		}
 	}
-	err = k.clientset.RbacV1().ClusterRoles().Delete(context.TODO(), "node-labeler", metav1.DeleteOptions{})
+	err = k.clientset.RbacV1().ClusterRoles().Delete(context.TODO(), "node-labeler", metav1.DeleteOptions{DryRun: k.dryRun})
 	if err != nil {
 		if k_error.IsNotFound(err) {
 			log.Warnf(err.Error())
@@ -297,7 +593,7 @@ func (k *KubernetesApiServiceImpl) DeleteRbac() error {
 			return err
 		}
 	}
-	err = k.clientset.RbacV1().ClusterRoleBindings().Delete(context.TODO(), "kata-label-node-rb", metav1.DeleteOptions{})
+	err = k.clientset.RbacV1().ClusterRoleBindings().Delete(context.TODO(), "kata-label-node-rb", metav1.DeleteOptions{DryRun: k.dryRun})
 	if err != nil {
 		if k_error.IsNotFound(err) {
 			log.Warnf(err.Error())
@@ -348,52 +644,119 @@ func (k *KubernetesApiServiceImpl) ExecuteDeployPodCommand(ls string, cmd []stri
 	return nil
 }
 
+// DeployPodOutput is what a command printed in a deploy pod, or why it
+// could not run there.
+type DeployPodOutput struct {
+	Pod    v1.Pod
+	Stdout []byte
+	Err    error
+}
+
+// CollectDeployPodCommand runs the command like ExecuteDeployPodCommand but
+// keeps the output of every pod apart. A pod that is not running or where
+// the command fails gets an error, the other pods are still asked.
+func (k *KubernetesApiServiceImpl) CollectDeployPodCommand(ls string, cmd []string) ([]DeployPodOutput, error) {
+	listOptions := metav1.ListOptions{
+		LabelSelector: ls,
+	}
+	pods, err := k.clientset.CoreV1().Pods("kube-system").List(context.TODO(), listOptions)
+	if err != nil {
+		return nil, err
+	}
+	var outputs []DeployPodOutput
+	for _, pod := range pods.Items {
+		output := DeployPodOutput{Pod: pod}
+		if pod.Status.Phase != v1.PodRunning || pod.DeletionTimestamp != nil {
+			output.Err = errors.Errorf("pod %s is %s", pod.Name, pod.Status.Phase)
+			outputs = append(outputs, output)
+			continue
+		}
+		var stdout, stderr bytes.Buffer
+		executeRequest := ExecCommandRequest{
+			PodName:   pod.Name,
+			Namespace: pod.Namespace,
+			Container: "kube-kata",
+			Command:   cmd,
+			StdOut:    &stdout,
+			StdErr:    &stderr,
+		}
+		if _, err := k.ExecuteCommand(executeRequest); err != nil {
+			if message := strings.TrimSpace(stderr.String()); message != "" {
+				err = errors.Wrap(err, message)
+			}
+			output.Err = err
+		}
+		output.Stdout = stdout.Bytes()
+		outputs = append(outputs, output)
+	}
+	return outputs, nil
+}
+
 func (k *KubernetesApiServiceImpl) ExecuteVMCommand(req ExecCommandRequest) (int, error) {
+	t := term.TTY{In: os.Stdin, Out: os.Stdout, Raw: true}
+	if !t.IsTerminalIn() || !t.IsTerminalOut() {
+		return 1, errors.New("the guest console needs a terminal, pass a command after -- to run it without one")
+	}
 	execRequest := k.clientset.CoreV1().RESTClient().Post().Resource("pods").Name(req.PodName).Namespace(req.Namespace).SubResource("exec")
+	// with a terminal stderr is merged into stdout by the remote side
 	execRequest.VersionedParams(&v1.PodExecOptions{
 		Container: req.Container,
 		Command:   req.Command,
 		Stdin:     true,
 		Stdout:    true,
-		Stderr:    true,
 		TTY:       true,
 	}, scheme.ParameterCodec)
 	exec, err := remotecommand.NewSPDYExecutor(k.restConfig, "POST", execRequest.URL())
-	if err != nil {
-		return 0, nil
-	}
-	if !terminal.IsTerminal(0) || !terminal.IsTerminal(1) {
-		return 0, err
-	}
-	oldState, err := terminal.MakeRaw(0)
 	if err != nil {
 		return 1, err
 	}
-	defer func(fd int, oldState *terminal.State) error {
-		err := terminal.Restore(fd, oldState)
-		if err != nil {
-			return err
-		}
-		return nil
-	}(0, oldState)
 
-	// 用IO读写替换 os stdout
-	screen := struct {
-		io.Reader
-		io.Writer
-	}{os.Stdin, os.Stdout}
-	err = exec.StreamWithContext(context.TODO(), remotecommand.StreamOptions{
-		Stdin:  screen,
-		Stdout: screen,
-		Stderr: screen,
-		Tty:    false,
+	ctx, detach := context.WithCancel(context.Background())
+	defer detach()
+	// a termination signal ends the session like ~. does, so that callers
+	// get to clean up instead of the process exiting
+	// set from the signal handler goroutine
+	var interrupted int32
+	t.Parent = interrupt.New(nil, func() {
+		atomic.StoreInt32(&interrupted, 1)
+		detach()
+	})
+	fmt.Fprintf(os.Stderr, "Escape sequence is ~. at the beginning of a line.\r\n")
+	size := t.GetSize()
+	sizeQueue := t.MonitorSize(size)
+	out := io.Writer(t.Out)
+	if req.Recorder != nil {
+		if size == nil {
+			size = &remotecommand.TerminalSize{Width: 80, Height: 24}
+		}
+		req.Recorder.Resize(size.Width, size.Height)
+		sizeQueue = &recordedSizeQueue{TerminalSizeQueue: sizeQueue, recorder: req.Recorder}
+		out = io.MultiWriter(t.Out, req.Recorder)
+	}
+	// Safe restores the terminal when the session ends, panics or a
+	// termination signal arrives
+	err = t.Safe(func() error {
+		err := exec.StreamWithContext(ctx, remotecommand.StreamOptions{
+			Stdin:             newEscapeReader(t.In, detach),
+			Stdout:            out,
+			Tty:               true,
+			TerminalSizeQueue: sizeQueue,
+		})
+		// the handler is also closed when Safe returns, check before
+		if atomic.LoadInt32(&interrupted) == 1 {
+			return errors.New("guest console session interrupted")
+		}
+		return err
 	})
-	var exitCode = 0
 	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			fmt.Fprintln(os.Stderr, "detached from the guest console")
+			return 0, nil
+		}
 		if exitErr, ok := err.(utilexec.ExitError); ok && exitErr.Exited() {
-			exitCode = exitErr.ExitStatus()
-			return 1, nil
+			return exitErr.ExitStatus(), err
 		}
+		return 1, err
 	}
-	return exitCode, nil
+	return 0, nil
 }
@@ -0,0 +1,137 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"io"
+	"time"
+)
+
+const (
+	magicMicroseconds = 0xa1b2c3d4
+	magicNanoseconds  = 0xa1b23c4d
+
+	headerLen       = 24
+	packetHeaderLen = 16
+
+	// LinkTypeEthernet is the link type tcpdump reports for pod interfaces.
+	LinkTypeEthernet = 1
+	// DefaultSnapLen matches tcpdump's default snapshot length.
+	DefaultSnapLen = 262144
+)
+
+// Header is the global header of a pcap stream.
+type Header struct {
+	SnapLen  uint32
+	LinkType uint32
+}
+
+// Packet is a single captured packet.
+type Packet struct {
+	Timestamp      time.Time
+	OriginalLength uint32
+	Data           []byte
+}
+
+// Reader decodes a pcap stream regardless of byte order and timestamp
+// resolution of the writer.
+type Reader struct {
+	r      io.Reader
+	order  binary.ByteOrder
+	nano   bool
+	Header Header
+}
+
+func NewReader(r io.Reader) (*Reader, error) {
+	buf := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	reader := &Reader{r: r}
+	switch {
+	case binary.LittleEndian.Uint32(buf) == magicMicroseconds:
+		reader.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(buf) == magicMicroseconds:
+		reader.order = binary.BigEndian
+	case binary.LittleEndian.Uint32(buf) == magicNanoseconds:
+		reader.order, reader.nano = binary.LittleEndian, true
+	case binary.BigEndian.Uint32(buf) == magicNanoseconds:
+		reader.order, reader.nano = binary.BigEndian, true
+	default:
+		return nil, errors.Errorf("not a pcap stream, magic %x", buf[:4])
+	}
+	reader.Header = Header{
+		SnapLen:  reader.order.Uint32(buf[16:20]),
+		LinkType: reader.order.Uint32(buf[20:24]),
+	}
+	return reader, nil
+}
+
+// Next returns the next packet, or io.EOF at the end of the stream.
+func (r *Reader) Next() (*Packet, error) {
+	buf := make([]byte, packetHeaderLen)
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		return nil, err
+	}
+	sec := int64(r.order.Uint32(buf[0:4]))
+	frac := int64(r.order.Uint32(buf[4:8]))
+	if !r.nano {
+		frac *= int64(time.Microsecond)
+	}
+	capLen := r.order.Uint32(buf[8:12])
+	if capLen > DefaultSnapLen && capLen > r.Header.SnapLen {
+		return nil, errors.Errorf("packet length %d exceeds snaplen %d", capLen, r.Header.SnapLen)
+	}
+	p := &Packet{
+		Timestamp:      time.Unix(sec, frac),
+		OriginalLength: r.order.Uint32(buf[12:16]),
+		Data:           make([]byte, capLen),
+	}
+	if _, err := io.ReadFull(r.r, p.Data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return p, nil
+}
+
+// EncodeHeader returns the little endian, microsecond resolution global
+// header knet writes.
+func EncodeHeader(h Header) []byte {
+	buf := make([]byte, headerLen)
+	binary.LittleEndian.PutUint32(buf[0:4], magicMicroseconds)
+	binary.LittleEndian.PutUint16(buf[4:6], 2)
+	binary.LittleEndian.PutUint16(buf[6:8], 4)
+	binary.LittleEndian.PutUint32(buf[16:20], h.SnapLen)
+	binary.LittleEndian.PutUint32(buf[20:24], h.LinkType)
+	return buf
+}
+
+// EncodePacket returns the record of p matching EncodeHeader.
+func EncodePacket(p *Packet) []byte {
+	buf := make([]byte, packetHeaderLen+len(p.Data))
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(p.Timestamp.Unix()))
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(p.Timestamp.Nanosecond()/int(time.Microsecond)))
+	binary.LittleEndian.PutUint32(buf[8:12], uint32(len(p.Data)))
+	binary.LittleEndian.PutUint32(buf[12:16], p.OriginalLength)
+	copy(buf[packetHeaderLen:], p.Data)
+	return buf
+}
+
+// Writer writes a pcap stream.
+type Writer struct {
+	w io.Writer
+}
+
+func NewWriter(w io.Writer, h Header) (*Writer, error) {
+	if _, err := w.Write(EncodeHeader(h)); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w}, nil
+}
+
+func (w *Writer) WritePacket(p *Packet) error {
+	_, err := w.w.Write(EncodePacket(p))
+	return err
+}
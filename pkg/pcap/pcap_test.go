@@ -0,0 +1,104 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, Header{SnapLen: DefaultSnapLen, LinkType: LinkTypeEthernet})
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets := []*Packet{
+		{Timestamp: time.Unix(1700000000, 123456000), OriginalLength: 3, Data: []byte{1, 2, 3}},
+		{Timestamp: time.Unix(1700000001, 0), OriginalLength: 1500, Data: []byte{4}},
+	}
+	for _, p := range packets {
+		if err := w.WritePacket(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, err := NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Header != (Header{SnapLen: DefaultSnapLen, LinkType: LinkTypeEthernet}) {
+		t.Errorf("header %+v", r.Header)
+	}
+	for _, want := range packets {
+		got, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Timestamp.Equal(want.Timestamp) || got.OriginalLength != want.OriginalLength || !bytes.Equal(got.Data, want.Data) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("got %v at the end, want io.EOF", err)
+	}
+}
+
+// stream builds a pcap stream in the given byte order and resolution.
+func stream(order binary.ByteOrder, magic uint32, frac uint32, data []byte, capLen uint32) []byte {
+	buf := make([]byte, headerLen+packetHeaderLen)
+	order.PutUint32(buf[0:4], magic)
+	order.PutUint32(buf[16:20], 65535)
+	order.PutUint32(buf[20:24], LinkTypeEthernet)
+	order.PutUint32(buf[24:28], 10)
+	order.PutUint32(buf[28:32], frac)
+	order.PutUint32(buf[32:36], capLen)
+	order.PutUint32(buf[36:40], uint32(len(data)))
+	return append(buf, data...)
+}
+
+func TestReader(t *testing.T) {
+	tests := []struct {
+		name      string
+		stream    []byte
+		timestamp time.Time
+		err       bool
+	}{
+		{"little endian microseconds", stream(binary.LittleEndian, magicMicroseconds, 5, []byte{1, 2}, 2), time.Unix(10, 5000), false},
+		{"big endian microseconds", stream(binary.BigEndian, magicMicroseconds, 5, []byte{1, 2}, 2), time.Unix(10, 5000), false},
+		{"little endian nanoseconds", stream(binary.LittleEndian, magicNanoseconds, 5, []byte{1, 2}, 2), time.Unix(10, 5), false},
+		{"big endian nanoseconds", stream(binary.BigEndian, magicNanoseconds, 5, []byte{1, 2}, 2), time.Unix(10, 5), false},
+		{"truncated packet", stream(binary.LittleEndian, magicMicroseconds, 0, []byte{1}, 2), time.Time{}, true},
+		{"packet beyond snaplen", stream(binary.LittleEndian, magicMicroseconds, 0, nil, DefaultSnapLen+1), time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewReader(bytes.NewReader(tt.stream))
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, err := r.Next()
+			if tt.err {
+				if err == nil {
+					t.Fatalf("got %+v, want an error", p)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !p.Timestamp.Equal(tt.timestamp) || !bytes.Equal(p.Data, []byte{1, 2}) {
+				t.Errorf("got %v %v", p.Timestamp, p.Data)
+			}
+		})
+	}
+}
+
+func TestReaderRejectsOtherFormats(t *testing.T) {
+	if _, err := NewReader(bytes.NewReader(make([]byte, headerLen))); err == nil {
+		t.Error("want an error for a zero magic")
+	}
+	if _, err := NewReader(bytes.NewReader([]byte{0xd4, 0xc3})); err == nil {
+		t.Error("want an error for a short header")
+	}
+}
@@ -0,0 +1,49 @@
+package pcap
+
+import (
+	"sync"
+	"time"
+)
+
+// Ring keeps the most recent packets in memory, bounded both by the age of
+// the packets and by their total size.
+type Ring struct {
+	mu       sync.Mutex
+	window   time.Duration
+	maxBytes int
+	size     int
+	packets  []*Packet
+}
+
+func NewRing(window time.Duration, maxBytes int) *Ring {
+	return &Ring{window: window, maxBytes: maxBytes}
+}
+
+// Add stores p and evicts the packets that fell out of the ring.
+func (r *Ring) Add(p *Packet) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.packets = append(r.packets, p)
+	r.size += len(p.Data)
+	oldest := p.Timestamp.Add(-r.window)
+	evict := 0
+	for evict < len(r.packets)-1 && (r.packets[evict].Timestamp.Before(oldest) || r.size > r.maxBytes) {
+		r.size -= len(r.packets[evict].Data)
+		r.packets[evict] = nil
+		evict++
+	}
+	r.packets = r.packets[evict:]
+}
+
+// Since returns the buffered packets captured at or after t.
+func (r *Ring) Since(t time.Time) []*Packet {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var packets []*Packet
+	for _, p := range r.packets {
+		if !p.Timestamp.Before(t) {
+			packets = append(packets, p)
+		}
+	}
+	return packets
+}
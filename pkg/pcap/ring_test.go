@@ -0,0 +1,37 @@
+package pcap
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRing(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	packet := func(offset time.Duration, size int) *Packet {
+		return &Packet{Timestamp: start.Add(offset), Data: make([]byte, size)}
+	}
+	tests := []struct {
+		name     string
+		window   time.Duration
+		maxBytes int
+		packets  []*Packet
+		since    time.Duration
+		want     int
+	}{
+		{"keeps the window", 10 * time.Second, 1000, []*Packet{packet(0, 10), packet(5*time.Second, 10), packet(12*time.Second, 10)}, 0, 2},
+		{"bounded by size", time.Minute, 25, []*Packet{packet(0, 10), packet(time.Second, 10), packet(2*time.Second, 10)}, 0, 2},
+		{"keeps the newest packet beyond the size", time.Minute, 5, []*Packet{packet(0, 10), packet(time.Second, 10)}, 0, 1},
+		{"since", time.Minute, 1000, []*Packet{packet(0, 10), packet(time.Second, 10), packet(2*time.Second, 10)}, time.Second, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRing(tt.window, tt.maxBytes)
+			for _, p := range tt.packets {
+				r.Add(p)
+			}
+			if got := r.Since(start.Add(tt.since)); len(got) != tt.want {
+				t.Errorf("got %d packets, want %d", len(got), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package pcap
+
+import (
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sync"
+)
+
+// clientBuffer is the number of packets queued per client before packets
+// are dropped for that client.
+const clientBuffer = 4096
+
+// Server streams packets as pcap over TCP to any number of clients. Every
+// client gets its own queue so a slow reader only loses its own packets and
+// never blocks the capture or the other clients.
+type Server struct {
+	header   []byte
+	listener net.Listener
+	mu       sync.Mutex
+	clients  map[*client]struct{}
+	closed   bool
+}
+
+type client struct {
+	conn    net.Conn
+	packets chan []byte
+	dropped uint64
+}
+
+func NewServer(addr string, h Header) (*Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		header:   EncodeHeader(h),
+		listener: l,
+		clients:  make(map[*client]struct{}),
+	}, nil
+}
+
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Serve accepts clients until the server is closed.
+func (s *Server) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		c := &client{conn: conn, packets: make(chan []byte, clientBuffer)}
+		s.mu.Lock()
+		s.clients[c] = struct{}{}
+		s.mu.Unlock()
+		log.Infof("client %s connected", conn.RemoteAddr())
+		go s.stream(c)
+	}
+}
+
+func (s *Server) stream(c *client) {
+	defer s.remove(c)
+	if _, err := c.conn.Write(s.header); err != nil {
+		return
+	}
+	for p := range c.packets {
+		if _, err := c.conn.Write(p); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) remove(c *client) {
+	s.mu.Lock()
+	if _, ok := s.clients[c]; ok {
+		delete(s.clients, c)
+		close(c.packets)
+	}
+	dropped := c.dropped
+	s.mu.Unlock()
+	_ = c.conn.Close()
+	log.Infof("client %s disconnected, %d packets dropped", c.conn.RemoteAddr(), dropped)
+}
+
+// WritePacket queues p for every connected client.
+func (s *Server) WritePacket(p *Packet) {
+	record := EncodePacket(p)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.clients {
+		select {
+		case c.packets <- record:
+		default:
+			c.dropped++
+		}
+	}
+}
+
+// Close stops accepting clients and disconnects the connected ones.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for c := range s.clients {
+		delete(s.clients, c)
+		close(c.packets)
+	}
+	s.mu.Unlock()
+	return s.listener.Close()
+}
@@ -0,0 +1,337 @@
+package plugin
+
+import (
+	"fmt"
+	"github.com/Tim-0731-Hzt/knet/pkg/kube"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// configFileHeader starts every file in the output of configDiffScript.
+const configFileHeader = "==> knet: "
+
+// configDiffScript prints every kata configuration of the node.
+const configDiffScript = `for f in ` + kataConfigDir + `/configuration-*.toml; do
+[ -f "$f" ] || continue
+echo "` + configFileHeader + `${f##*/}"
+cat "$f"
+echo
+done`
+
+// ConfigDiffService reports the nodes whose kata configurations differ from
+// those of most nodes, or from reference files, key by key.
+type ConfigDiffService struct {
+	kubeService *kube.KubernetesApiServiceImpl
+	Targets     KataConfigTargets
+	Reference   string
+	reference   map[string]map[string]string
+	out         io.Writer
+}
+
+func NewConfigDiffService() *ConfigDiffService {
+	return &ConfigDiffService{out: os.Stdout}
+}
+
+func (c *ConfigDiffService) Complete(cmd *cobra.Command, args []string) error {
+	var err error
+	c.kubeService, err = kube.NewKubernetesApiServiceImpl()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Validate loads the reference, a configuration-<hypervisor>.toml, a
+// directory of them, or a file of any name with a single --hypervisor.
+func (c *ConfigDiffService) Validate() error {
+	if c.Reference == "" {
+		return nil
+	}
+	info, err := os.Stat(c.Reference)
+	if err != nil {
+		return err
+	}
+	paths := []string{c.Reference}
+	if info.IsDir() {
+		if paths, err = filepath.Glob(filepath.Join(c.Reference, "configuration-*.toml")); err != nil {
+			return err
+		}
+		if len(paths) == 0 {
+			return errors.Errorf("no configuration-*.toml in %s", c.Reference)
+		}
+	}
+	c.reference = make(map[string]map[string]string)
+	for _, p := range paths {
+		name := filepath.Base(p)
+		if !info.IsDir() && !isKataConfigName(name) {
+			if len(c.Targets.Hypervisors) != 1 {
+				return errors.Errorf("name the reference configuration-<hypervisor>.toml or pass a single --hypervisor")
+			}
+			name = filepath.Base(kataConfigPath(c.Targets.Hypervisors[0]))
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		c.reference[name] = parseKataConfig(data).values()
+	}
+	return nil
+}
+
+func (c *ConfigDiffService) Run() error {
+	configs, unreadable, err := c.collect()
+	if err != nil {
+		return err
+	}
+	differ := c.compare(configs)
+	var problems []string
+	if len(differ) > 0 {
+		problems = append(problems, fmt.Sprintf("%d of %d nodes differ: %s", len(differ), len(configs), strings.Join(differ, ", ")))
+	}
+	if len(unreadable) > 0 {
+		problems = append(problems, "failed to read "+strings.Join(unreadable, ", "))
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	log.Infof("the kata configurations of %d nodes match", len(configs))
+	return nil
+}
+
+// compare prints per node and file the keys that differ from the reference
+// or the majority, and returns the nodes that differ.
+func (c *ConfigDiffService) compare(configs map[string]map[string]map[string]string) []string {
+	var nodes []string
+	files := make(map[string]bool)
+	for n, nodeFiles := range configs {
+		nodes = append(nodes, n)
+		for f := range nodeFiles {
+			files[f] = true
+		}
+	}
+	sort.Strings(nodes)
+	if len(nodes) == 1 && c.reference == nil {
+		log.Warnf("only node %s to compare, use --reference to compare it to known good files", nodes[0])
+	}
+	for f := range c.reference {
+		if c.selected(f) {
+			files[f] = true
+		}
+	}
+	var names []string
+	for f := range files {
+		names = append(names, f)
+	}
+	sort.Strings(names)
+	if c.reference != nil {
+		var referenced []string
+		for _, f := range names {
+			if c.reference[f] == nil {
+				log.Infof("no reference for %s, skipping it", f)
+				continue
+			}
+			referenced = append(referenced, f)
+		}
+		names = referenced
+	}
+
+	differ := make(map[string]bool)
+	for _, f := range names {
+		baseline, against := c.reference[f], "the reference"
+		present := 0
+		for _, n := range nodes {
+			if configs[n][f] != nil {
+				present++
+			}
+		}
+		if c.reference == nil {
+			if present*2 < len(nodes) {
+				for _, n := range nodes {
+					if configs[n][f] != nil {
+						fmt.Fprintf(c.out, "%s: %s is only on %d of %d nodes\n", n, f, present, len(nodes))
+						differ[n] = true
+					}
+				}
+				continue
+			}
+			baseline, against = majority(f, nodes, configs), fmt.Sprintf("the majority of %d nodes", len(nodes))
+		}
+		for _, n := range nodes {
+			values := configs[n][f]
+			if values == nil {
+				fmt.Fprintf(c.out, "%s: %s is missing\n", n, f)
+				differ[n] = true
+				continue
+			}
+			if lines := diffValues(baseline, values); len(lines) > 0 {
+				fmt.Fprintf(c.out, "--- %s (%s)\n+++ %s on node %s\n%s", f, against, f, n, strings.Join(lines, ""))
+				differ[n] = true
+			}
+		}
+	}
+	var differing []string
+	for n := range differ {
+		differing = append(differing, n)
+	}
+	sort.Strings(differing)
+	return differing
+}
+
+// collect reads the configurations of every node through its kata-deploy
+// pod, as file name to TABLE.NAME to value per node, and returns the nodes
+// they could not be read from.
+func (c *ConfigDiffService) collect() (map[string]map[string]map[string]string, []string, error) {
+	outputs, err := c.kubeService.CollectDeployPodCommand("name=kata-deploy", []string{"sh", "-c", configDiffScript})
+	if err != nil {
+		return nil, nil, err
+	}
+	configs := make(map[string]map[string]map[string]string)
+	var unreadable []string
+	seen := make(map[string]bool)
+	for _, output := range outputs {
+		node := output.Pod.Spec.NodeName
+		if len(c.Targets.Nodes) > 0 && !containsString(c.Targets.Nodes, node) {
+			continue
+		}
+		seen[node] = true
+		if output.Err != nil {
+			log.WithError(output.Err).Errorf("failed to read the kata configurations of node %s", node)
+			unreadable = append(unreadable, node)
+			continue
+		}
+		configs[node] = make(map[string]map[string]string)
+		for name, data := range splitConfigFiles(output.Stdout) {
+			if !c.selected(name) {
+				continue
+			}
+			configs[node][name] = parseKataConfig(data).values()
+		}
+	}
+	for _, n := range c.Targets.Nodes {
+		if !seen[n] {
+			return nil, nil, errors.Errorf("no kata-deploy pod on node %s", n)
+		}
+	}
+	if len(configs) == 0 {
+		return nil, nil, errors.New("no kata configuration could be read")
+	}
+	sort.Strings(unreadable)
+	return configs, unreadable, nil
+}
+
+// splitConfigFiles splits the output of configDiffScript per file.
+func splitConfigFiles(output []byte) map[string][]byte {
+	files := make(map[string][]byte)
+	name := ""
+	for _, line := range strings.SplitAfter(string(output), "\n") {
+		if strings.HasPrefix(line, configFileHeader) {
+			name = strings.TrimSpace(strings.TrimPrefix(line, configFileHeader))
+			files[name] = []byte{}
+			continue
+		}
+		if name != "" {
+			files[name] = append(files[name], line...)
+		}
+	}
+	return files
+}
+
+// selected tells whether a configuration belongs to the --hypervisor
+// selection.
+func (c *ConfigDiffService) selected(name string) bool {
+	if len(c.Targets.Hypervisors) == 0 {
+		return true
+	}
+	for _, h := range c.Targets.Hypervisors {
+		if name == filepath.Base(kataConfigPath(h)) {
+			return true
+		}
+	}
+	return false
+}
+
+func isKataConfigName(name string) bool {
+	return strings.HasPrefix(name, "configuration-") && strings.HasSuffix(name, ".toml")
+}
+
+// majority returns the value most nodes have for every key of a file, a
+// missing value counts as a value of its own. A tie goes to the value that
+// got there first in node name order.
+func majority(file string, nodes []string, configs map[string]map[string]map[string]string) map[string]string {
+	keys := make(map[string]bool)
+	for _, n := range nodes {
+		for k := range configs[n][file] {
+			keys[k] = true
+		}
+	}
+	baseline := make(map[string]string)
+	for k := range keys {
+		counts := make(map[string]int)
+		best, bestCount, tie := "", 0, false
+		for _, n := range nodes {
+			values := configs[n][file]
+			if values == nil {
+				continue
+			}
+			v, ok := values[k]
+			if !ok {
+				v = "\x00"
+			}
+			counts[v]++
+			switch {
+			case counts[v] > bestCount:
+				best, bestCount, tie = v, counts[v], false
+			case counts[v] == bestCount && v != best:
+				tie = true
+			}
+		}
+		if tie {
+			log.Warnf("no majority for %s in %s", k, file)
+		}
+		if best != "\x00" {
+			baseline[k] = best
+		}
+	}
+	return baseline
+}
+
+// diffValues returns the keys whose values differ as -/+ lines.
+func diffValues(baseline map[string]string, values map[string]string) []string {
+	keys := make(map[string]bool)
+	for k := range baseline {
+		keys[k] = true
+	}
+	for k := range values {
+		keys[k] = true
+	}
+	var sorted []string
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	var lines []string
+	for _, k := range sorted {
+		b, inBaseline := baseline[k]
+		v, inValues := values[k]
+		if inBaseline == inValues && b == v {
+			continue
+		}
+		if inBaseline {
+			lines = append(lines, fmt.Sprintf("-%s = %s\n", k, b))
+		}
+		if inValues {
+			lines = append(lines, fmt.Sprintf("+%s = %s\n", k, v))
+		}
+	}
+	return lines
+}
+
+func (c *ConfigDiffService) cleanup() error {
+	return nil
+}
@@ -0,0 +1,102 @@
+package plugin
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestSplitConfigFiles(t *testing.T) {
+	output := "==> knet: configuration-qemu.toml\n[runtime]\nenable_debug = true\n\n" +
+		"==> knet: configuration-clh.toml\n" +
+		"==> knet: configuration-fc.toml\n[agent.kata]\n"
+	want := map[string][]byte{
+		"configuration-qemu.toml": []byte("[runtime]\nenable_debug = true\n\n"),
+		"configuration-clh.toml":  {},
+		"configuration-fc.toml":   []byte("[agent.kata]\n"),
+	}
+	if got := splitConfigFiles([]byte("ignored\n" + output)); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := splitConfigFiles(nil); len(got) != 0 {
+		t.Errorf("got %q for no output", got)
+	}
+}
+
+func TestMajority(t *testing.T) {
+	const f = "configuration-qemu.toml"
+	configs := map[string]map[string]map[string]string{
+		"a": {f: {"debug": "true", "vcpus": "1", "extra": "x"}},
+		"b": {f: {"debug": "false", "vcpus": "1"}},
+		"c": {f: {"debug": "false", "vcpus": "2"}},
+		"d": {},
+	}
+	want := map[string]string{"debug": "false", "vcpus": "1"}
+	if got := majority(f, []string{"a", "b", "c", "d"}, configs); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// a tie goes to the first node by name
+	tie := map[string]map[string]map[string]string{
+		"a": {f: {"debug": "true"}},
+		"b": {f: {"debug": "false"}},
+	}
+	if got := majority(f, []string{"a", "b"}, tie); got["debug"] != "true" {
+		t.Errorf("tie went to %q", got["debug"])
+	}
+}
+
+func TestDiffValues(t *testing.T) {
+	baseline := map[string]string{"a": "1", "b": "2", "c": "3"}
+	values := map[string]string{"a": "1", "b": "20", "d": "4"}
+	want := []string{"-b = 2\n", "+b = 20\n", "-c = 3\n", "+d = 4\n"}
+	if got := diffValues(baseline, values); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := diffValues(baseline, baseline); len(got) != 0 {
+		t.Errorf("got %q for equal values", got)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	const qemu, clh = "configuration-qemu.toml", "configuration-clh.toml"
+	configs := map[string]map[string]map[string]string{
+		"n1": {qemu: {"runtime.enable_debug": "false"}},
+		"n2": {qemu: {"runtime.enable_debug": "false"}},
+		"n3": {qemu: {"runtime.enable_debug": "true"}, clh: {"runtime.enable_debug": "false"}},
+	}
+	tests := []struct {
+		name      string
+		service   ConfigDiffService
+		differing []string
+		out       string
+	}{
+		{"majority", ConfigDiffService{}, []string{"n3"},
+			"n3: configuration-clh.toml is only on 1 of 3 nodes\n" +
+				"--- configuration-qemu.toml (the majority of 3 nodes)\n+++ configuration-qemu.toml on node n3\n" +
+				"-runtime.enable_debug = false\n+runtime.enable_debug = true\n"},
+		{"hypervisor", ConfigDiffService{Targets: KataConfigTargets{Hypervisors: []string{"clh"}}, reference: map[string]map[string]string{
+			clh: {"runtime.enable_debug": "false"},
+		}}, []string{"n1", "n2"},
+			"n1: configuration-clh.toml is missing\nn2: configuration-clh.toml is missing\n"},
+		{"reference", ConfigDiffService{reference: map[string]map[string]string{
+			qemu: {"runtime.enable_debug": "true"},
+		}}, []string{"n1", "n2"},
+			"--- configuration-qemu.toml (the reference)\n+++ configuration-qemu.toml on node n1\n" +
+				"-runtime.enable_debug = true\n+runtime.enable_debug = false\n" +
+				"--- configuration-qemu.toml (the reference)\n+++ configuration-qemu.toml on node n2\n" +
+				"-runtime.enable_debug = true\n+runtime.enable_debug = false\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			c := tt.service
+			c.out = &out
+			if got := c.compare(configs); !reflect.DeepEqual(got, tt.differing) {
+				t.Errorf("differing %v, want %v", got, tt.differing)
+			}
+			if out.String() != tt.out {
+				t.Errorf("got\n%s\nwant\n%s", out.String(), tt.out)
+			}
+		})
+	}
+}
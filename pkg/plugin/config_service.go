@@ -1,16 +1,26 @@
 package plugin
 
 import (
+	"context"
 	"fmt"
 	"github.com/Tim-0731-Hzt/knet/pkg/kube"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
-	"os/exec"
+	"io"
+	v1 "k8s.io/api/core/v1"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
 )
 
 type ConfigService struct {
 	kubeService  *kube.KubernetesApiServiceImpl
 	DebugConsole bool
+	Image        KataDeployImage
+	Timeout      time.Duration
 }
 
 func NewConfigService() *ConfigService {
@@ -19,6 +29,7 @@ func NewConfigService() *ConfigService {
 
 func (c *ConfigService) Complete(cmd *cobra.Command, args []string) error {
 	var err error
+	c.Image.Complete(cmd)
 	c.kubeService, err = kube.NewKubernetesApiServiceImpl()
 	if err != nil {
 		return err
@@ -26,35 +37,302 @@ func (c *ConfigService) Complete(cmd *cobra.Command, args []string) error {
 	return nil
 }
 func (c *ConfigService) Validate() error {
-	cmd := exec.Command("kubectl", "-n", "kube-system", "wait", "--timeout=10m", "--for=condition=Ready", "-l", "name=kata-deploy", "pod")
-	if err := cmd.Run(); err != nil {
+	if err := c.Image.Validate(); err != nil {
+		return err
+	}
+	checkImage(c.kubeService, &c.Image)
+	if err := c.kubeService.Waiter(c.Timeout).DaemonSetReady(context.Background(), "kata-deploy", "name=kata-deploy"); err != nil {
 		log.WithError(err).Errorf("kata deploy not ready")
 		return err
 	}
 	return nil
 }
 func (c *ConfigService) Run() error {
-	var shellScript string
-	if c.DebugConsole {
-		shellScript = fmt.Sprintf(`
-		for var in qemu clh fc dragonball
-		do
-			sed -i 's/.*debug_console_enabled.*/debug_console_enabled = true./' /opt/kata/share/defaults/kata-containers/configuration-$var.toml
-		done
-		`,
-		)
-	} else {
-		shellScript = fmt.Sprintf(`
-		for var in qemu clh fc dragonball
-		do
-		   sed -i 's/.*debug_console_enabled.*/#debug_console_enabled = true./' /opt/kata/share/defaults/kata-containers/configuration-$var.toml
-		done
-		`,
-		)
-	}
-	if err := c.kubeService.ExecuteDeployPodCommand("name=kata-deploy", []string{"/bin/sh", "-c", shellScript}); err != nil {
+	files, err := (&KataConfigTargets{}).files(c.kubeService)
+	if err != nil {
+		return err
+	}
+	setting := kataSetting{key: "agent.debug_console_enabled", value: fmt.Sprint(c.DebugConsole)}
+	if err := setting.validate(); err != nil {
+		return err
+	}
+	if err := setKataConfig(c.kubeService, files, []kataSetting{setting}); err != nil {
 		log.WithError(err).Errorf("failed to config debug console")
 		return err
 	}
 	return nil
 }
+
+// ConfigGetService prints a setting of the kata configurations per node and
+// hypervisor.
+type ConfigGetService struct {
+	kubeService *kube.KubernetesApiServiceImpl
+	Targets     KataConfigTargets
+	key         string
+	out         io.Writer
+}
+
+func NewConfigGetService() *ConfigGetService {
+	return &ConfigGetService{out: os.Stdout}
+}
+
+func (c *ConfigGetService) Complete(cmd *cobra.Command, args []string) error {
+	var err error
+	if len(args) != 1 {
+		return errors.New("config get needs exactly one KEY")
+	}
+	c.key = args[0]
+	c.kubeService, err = kube.NewKubernetesApiServiceImpl()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *ConfigGetService) Validate() error {
+	_, err := lookupKataConfigKey(c.key)
+	return err
+}
+
+func (c *ConfigGetService) Run() error {
+	files, err := c.Targets.files(c.kubeService)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tHYPERVISOR\tVALUE")
+	failed := 0
+	for _, f := range files {
+		value, err := f.get(c.kubeService, c.key)
+		if err != nil {
+			log.WithError(err).Errorf("failed to get %s", c.key)
+			failed++
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", f.deployPod.Spec.NodeName, f.hypervisor, orDash(value))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return errors.Errorf("failed to get %s from %d of %d configurations", c.key, failed, len(files))
+	}
+	return nil
+}
+
+func (c *ConfigGetService) cleanup() error {
+	return nil
+}
+
+// ConfigSetService sets KEY=VALUE settings in the kata configurations.
+type ConfigSetService struct {
+	kubeService *kube.KubernetesApiServiceImpl
+	Targets     KataConfigTargets
+	Image       KataDeployImage
+	Timeout     time.Duration
+	settings    []kataSetting
+}
+
+func NewConfigSetService() *ConfigSetService {
+	return &ConfigSetService{}
+}
+
+func (c *ConfigSetService) Complete(cmd *cobra.Command, args []string) error {
+	var err error
+	if len(args) == 0 {
+		return errors.New("config set needs at least one KEY=VALUE")
+	}
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return errors.Errorf("invalid setting %q, use KEY=VALUE", arg)
+		}
+		c.settings = append(c.settings, kataSetting{key: parts[0], value: parts[1]})
+	}
+	c.Image.Complete(cmd)
+	c.kubeService, err = kube.NewKubernetesApiServiceImpl()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *ConfigSetService) Validate() error {
+	for i := range c.settings {
+		if err := c.settings[i].validate(); err != nil {
+			return err
+		}
+	}
+	if err := c.Image.Validate(); err != nil {
+		return err
+	}
+	checkImage(c.kubeService, &c.Image)
+	return c.kubeService.Waiter(c.Timeout).DaemonSetReady(context.Background(), "kata-deploy", "name=kata-deploy")
+}
+
+func (c *ConfigSetService) Run() error {
+	files, err := c.Targets.files(c.kubeService)
+	if err != nil {
+		return err
+	}
+	return setKataConfig(c.kubeService, files, c.settings)
+}
+
+func (c *ConfigSetService) cleanup() error {
+	return nil
+}
+
+// KataConfigTargets selects the kata configurations to work on, those of the
+// installed hypervisors on every node running kata-deploy by default.
+type KataConfigTargets struct {
+	Nodes       []string
+	Hypervisors []string
+}
+
+// kataConfigFile is the kata configuration of a hypervisor on a node.
+type kataConfigFile struct {
+	deployPod  *v1.Pod
+	hypervisor string
+	path       string
+}
+
+func (t *KataConfigTargets) files(kubeService *kube.KubernetesApiServiceImpl) ([]kataConfigFile, error) {
+	installed := installedHypervisors(kubeService)
+	hypervisors := t.Hypervisors
+	if len(hypervisors) == 0 {
+		hypervisors = installed
+	}
+	for _, h := range hypervisors {
+		if !containsString(installed, h) {
+			return nil, errors.Errorf("hypervisor %s is not installed, installed are %s", h, strings.Join(installed, ", "))
+		}
+	}
+	pods, err := kubeService.ListDeployPods("name=kata-deploy")
+	if err != nil {
+		return nil, err
+	}
+	running := make(map[string]*v1.Pod)
+	for i := range pods {
+		pod := &pods[i]
+		if pod.Status.Phase != v1.PodRunning || pod.DeletionTimestamp != nil {
+			if len(t.Nodes) == 0 {
+				log.Warnf("skipping node %s, kata-deploy pod %s is %s", pod.Spec.NodeName, pod.Name, pod.Status.Phase)
+			}
+			continue
+		}
+		running[pod.Spec.NodeName] = pod
+	}
+	nodes := t.Nodes
+	if len(nodes) == 0 {
+		for n := range running {
+			nodes = append(nodes, n)
+		}
+		sort.Strings(nodes)
+	}
+	var files []kataConfigFile
+	for _, n := range nodes {
+		pod, ok := running[n]
+		if !ok {
+			return nil, errors.Errorf("no running kata-deploy pod on node %s", n)
+		}
+		for _, h := range hypervisors {
+			files = append(files, kataConfigFile{deployPod: pod, hypervisor: h, path: kataConfigPath(h)})
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no running kata-deploy pod found")
+	}
+	return files, nil
+}
+
+// get returns the value of a key in its TOML form, "" when it is not set.
+func (f *kataConfigFile) get(kubeService *kube.KubernetesApiServiceImpl, key string) (string, error) {
+	data, err := readNodeFile(kubeService, f.deployPod, f.path)
+	if err != nil {
+		return "", err
+	}
+	value, _, err := parseKataConfig(data).get(key)
+	if err != nil {
+		return "", errors.Wrapf(err, "%s on node %s", f.path, f.deployPod.Spec.NodeName)
+	}
+	return value, nil
+}
+
+// kataSetting is a KEY=VALUE of config set, validate turns the value into
+// its TOML form.
+type kataSetting struct {
+	key   string
+	value string
+}
+
+func (s *kataSetting) validate() error {
+	key, err := lookupKataConfigKey(s.key)
+	if err != nil {
+		return err
+	}
+	s.value, err = key.parse(s.key, s.value)
+	return err
+}
+
+// setKataConfig applies validated settings to every file, files that
+// already have them are left alone.
+func setKataConfig(kubeService *kube.KubernetesApiServiceImpl, files []kataConfigFile, settings []kataSetting) error {
+	failed := 0
+	for _, f := range files {
+		node := f.deployPod.Spec.NodeName
+		changed, err := f.set(kubeService, settings)
+		if err != nil {
+			log.WithError(err).Errorf("failed to update %s on node %s", f.path, node)
+			failed++
+			continue
+		}
+		if len(changed) == 0 {
+			log.Infof("%s on node %s is up to date", f.path, node)
+			continue
+		}
+		log.Infof("set %s in %s on node %s", strings.Join(changed, ", "), f.path, node)
+	}
+	if failed > 0 {
+		return errors.Errorf("failed to update %d of %d configurations", failed, len(files))
+	}
+	log.Infof("only sandboxes started from now on pick up the configuration")
+	return nil
+}
+
+// set applies the settings and returns the ones that changed the file.
+func (f *kataConfigFile) set(kubeService *kube.KubernetesApiServiceImpl, settings []kataSetting) ([]string, error) {
+	data, err := readNodeFile(kubeService, f.deployPod, f.path)
+	if err != nil {
+		return nil, err
+	}
+	config := parseKataConfig(data)
+	var changed []string
+	for _, s := range settings {
+		ok, err := config.set(s.key, s.value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to set %s", s.key)
+		}
+		if ok {
+			changed = append(changed, s.key+" = "+s.value)
+		}
+	}
+	if len(changed) == 0 {
+		return nil, nil
+	}
+	return changed, writeNodeFile(kubeService, f.deployPod, f.path, config.bytes())
+}
+
+// checkImage warns when kata-deploy runs another image than configured, the
+// configuration files differ between kata releases.
+func checkImage(kubeService *kube.KubernetesApiServiceImpl, image *KataDeployImage) {
+	daemonSet, err := kubeService.GetDaemonSet("kata-deploy")
+	if err != nil {
+		log.WithError(err).Warnf("failed to get kata-deploy")
+		return
+	}
+	for _, container := range daemonSet.Spec.Template.Spec.Containers {
+		if container.Image != image.Reference() {
+			log.Warnf("kata-deploy runs %s (%s) but %s is configured", container.Image, daemonSet.Annotations[imageDigestAnnotation], image.Reference())
+		}
+	}
+}
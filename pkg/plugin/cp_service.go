@@ -0,0 +1,388 @@
+package plugin
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/Tim-0731-Hzt/knet/pkg/kube"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CpService copies files between the local machine and a kata guest by
+// streaming tar through the guest console.
+type CpService struct {
+	UserSpecifiedNamespace string
+	UserSpecifiedContainer string
+	Progress               io.Writer
+	src                    cpPath
+	dst                    cpPath
+	exec                   *ExecService
+}
+
+// cpPath is either a local path or a path in the guest of a pod.
+type cpPath struct {
+	namespace string
+	pod       string
+	path      string
+}
+
+func (p cpPath) remote() bool {
+	return p.pod != ""
+}
+
+func NewCpService() *CpService {
+	return &CpService{}
+}
+
+func (c *CpService) Complete(cmd *cobra.Command, args []string) error {
+	var err error
+	if len(args) != 2 {
+		return errors.New("source and destination are required")
+	}
+	c.src, c.dst = parseCpPath(args[0]), parseCpPath(args[1])
+	if c.src.remote() == c.dst.remote() {
+		return errors.New("exactly one of source and destination must be POD:PATH")
+	}
+	remote := c.src
+	if c.dst.remote() {
+		remote = c.dst
+	}
+	if !path.IsAbs(remote.path) || path.Clean(remote.path) == "/" {
+		return errors.Errorf("guest path %q must be absolute and below /", remote.path)
+	}
+	if remote.namespace == "" {
+		remote.namespace = c.UserSpecifiedNamespace
+	}
+	if remote.namespace == "" {
+		remote.namespace = "default"
+	}
+	if c.Progress == nil {
+		c.Progress = os.Stderr
+	}
+	c.exec = &ExecService{
+		UserSpecifiedNamespace: remote.namespace,
+		UserSpecifiedPodName:   remote.pod,
+		UserSpecifiedContainer: c.UserSpecifiedContainer,
+	}
+	c.exec.kubeService, err = kube.NewKubernetesApiServiceImpl()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *CpService) Validate() error {
+	return c.exec.Validate()
+}
+
+func (c *CpService) Run() error {
+	sandbox, err := c.exec.sandbox()
+	if err != nil {
+		return err
+	}
+	session, err := openGuestSession(c.exec.kubeService, c.exec.deployPod, sandbox.ID)
+	if err != nil {
+		return err
+	}
+	if c.src.remote() {
+		err = c.download(session)
+	} else {
+		err = c.upload(session)
+	}
+	if err != nil {
+		_ = session.Close()
+		return err
+	}
+	return session.Close()
+}
+
+// parseCpPath splits [NAMESPACE/]POD:PATH, anything else is a local path.
+func parseCpPath(arg string) cpPath {
+	i := strings.Index(arg, ":")
+	if i <= 0 || strings.HasPrefix(arg, "/") || strings.HasPrefix(arg, ".") {
+		return cpPath{path: arg}
+	}
+	p := cpPath{pod: arg[:i], path: arg[i+1:]}
+	if j := strings.Index(p.pod, "/"); j >= 0 {
+		p.namespace, p.pod = p.pod[:j], p.pod[j+1:]
+	}
+	return p
+}
+
+// download extracts `tar c` of the guest path into the local destination.
+// Like cp, an existing destination directory receives the source by its
+// name, otherwise the source is renamed to the destination.
+func (c *CpService) download(session *guestSession) error {
+	guestDir, guestName := path.Split(path.Clean(c.src.path))
+	localDir, localName := c.dst.path, guestName
+	if info, err := os.Stat(c.dst.path); err != nil || !info.IsDir() {
+		localDir, localName = filepath.Split(filepath.Clean(c.dst.path))
+	}
+
+	r, w := io.Pipe()
+	progress := newCpProgress(c.Progress, guestName, 0)
+	extracted := make(chan error, 1)
+	sums := make(map[string]string)
+	go func() {
+		err := extractTar(io.TeeReader(r, progress), localDir, guestName, localName, sums)
+		if err == nil {
+			// tar pads the archive after its end marker
+			_, err = io.Copy(io.Discard, r)
+		}
+		_ = r.CloseWithError(err)
+		extracted <- err
+	}()
+	var stderr bytes.Buffer
+	log.Infof("copying %s:%s to %s", c.src.pod, c.src.path, c.dst.path)
+	code, err := session.Run(fmt.Sprintf("tar cf - -C %s %s", shellQuote([]string{guestDir}), shellQuote([]string{guestName})), nil, w, &stderr)
+	_ = w.Close()
+	if err == nil {
+		err = <-extracted
+	}
+	progress.finish()
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return errors.Errorf("tar in the guest exited with code %d: %s", code, strings.TrimSpace(stderr.String()))
+	}
+	return c.verify(session, guestDir, guestName, sums)
+}
+
+// upload streams a tar of the local path into `tar x` in the guest.
+func (c *CpService) upload(session *guestSession) error {
+	guestDir, guestName := path.Split(path.Clean(c.dst.path))
+	var stderr bytes.Buffer
+	code, err := session.Run("test -d "+shellQuote([]string{c.dst.path}), nil, io.Discard, &stderr)
+	if err != nil {
+		return err
+	}
+	if code == 0 {
+		guestDir, guestName = c.dst.path, filepath.Base(filepath.Clean(c.src.path))
+	}
+
+	size, err := localSize(c.src.path)
+	if err != nil {
+		return err
+	}
+	r, w := io.Pipe()
+	progress := newCpProgress(c.Progress, guestName, size)
+	sums := make(map[string]string)
+	go func() {
+		_ = w.CloseWithError(writeTar(w, c.src.path, guestName, progress, sums))
+	}()
+	log.Infof("copying %s to %s:%s", c.src.path, c.dst.pod, c.dst.path)
+	stderr.Reset()
+	code, err = session.Run(fmt.Sprintf("mkdir -p %s && tar xf - -C %s", shellQuote([]string{guestDir}), shellQuote([]string{guestDir})), r, io.Discard, &stderr)
+	_ = r.Close()
+	progress.finish()
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return errors.Errorf("tar in the guest exited with code %d: %s", code, strings.TrimSpace(stderr.String()))
+	}
+	return c.verify(session, guestDir, guestName, sums)
+}
+
+// verify compares the checksums of the copied regular files with what
+// sha256sum reports for them in the guest.
+func (c *CpService) verify(session *guestSession, guestDir string, guestName string, sums map[string]string) error {
+	var stdout, stderr bytes.Buffer
+	code, err := session.Run(fmt.Sprintf("cd %s && find %s -type f -exec sha256sum {} +", shellQuote([]string{guestDir}), shellQuote([]string{guestName})), nil, &stdout, &stderr)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return errors.Errorf("failed to checksum %s in the guest: %s", path.Join(guestDir, guestName), strings.TrimSpace(stderr.String()))
+	}
+	guestSums := make(map[string]string)
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "  ", 2)
+		if len(fields) == 2 {
+			guestSums[path.Clean(fields[1])] = fields[0]
+		}
+	}
+	var mismatched []string
+	for name, sum := range sums {
+		if guestSums[name] != sum {
+			mismatched = append(mismatched, name)
+		}
+	}
+	if len(mismatched) > 0 {
+		sort.Strings(mismatched)
+		return errors.Errorf("checksum mismatch after copy: %s", strings.Join(mismatched, ", "))
+	}
+	log.Infof("verified sha256 of %d files", len(sums))
+	return nil
+}
+
+// extractTar extracts the archive below dir, renaming its top level entry
+// from name to rename, and records the checksum of every regular file under
+// its name in the archive. Entries escaping dir and links are refused.
+func extractTar(r io.Reader, dir string, name string, rename string, sums map[string]string) error {
+	if dir == "" {
+		dir = "."
+	}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to read tar stream from the guest")
+		}
+		entry := path.Clean(header.Name)
+		if entry != name && !strings.HasPrefix(entry, name+"/") {
+			return errors.Errorf("unexpected entry %q in tar stream", header.Name)
+		}
+		target := filepath.Join(dir, filepath.FromSlash(rename+strings.TrimPrefix(entry, name)))
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, os.FileMode(header.Mode).Perm()|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(header.Mode).Perm())
+			if err != nil {
+				return err
+			}
+			h := sha256.New()
+			_, err = io.Copy(io.MultiWriter(f, h), tr)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+			sums[entry] = hex.EncodeToString(h.Sum(nil))
+		default:
+			log.Warnf("skipping %s, only directories and regular files are copied", header.Name)
+		}
+	}
+}
+
+// writeTar archives the local path as name and records the checksum of
+// every regular file under its name in the archive.
+func writeTar(w io.Writer, src string, name string, progress io.Writer, sums map[string]string) error {
+	tw := tar.NewWriter(w)
+	src = filepath.Clean(src)
+	err := filepath.Walk(src, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, file)
+		if err != nil {
+			return err
+		}
+		entry := path.Join(name, filepath.ToSlash(rel))
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			log.Warnf("skipping %s, only directories and regular files are copied", file)
+			return nil
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = entry
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		h := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(tw, h, progress), f); err != nil {
+			return err
+		}
+		sums[entry] = hex.EncodeToString(h.Sum(nil))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func localSize(src string) (int64, error) {
+	var size int64
+	err := filepath.Walk(src, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// cpProgress prints the transferred bytes at most twice a second.
+type cpProgress struct {
+	out   io.Writer
+	name  string
+	total int64
+	done  int64
+	start time.Time
+	last  time.Time
+}
+
+func newCpProgress(out io.Writer, name string, total int64) *cpProgress {
+	return &cpProgress{out: out, name: name, total: total, start: time.Now()}
+}
+
+func (p *cpProgress) Write(b []byte) (int, error) {
+	p.done += int64(len(b))
+	if time.Since(p.last) >= 500*time.Millisecond {
+		p.last = time.Now()
+		p.print("\r")
+	}
+	return len(b), nil
+}
+
+func (p *cpProgress) finish() {
+	p.print("\r")
+	fmt.Fprintln(p.out)
+}
+
+func (p *cpProgress) print(prefix string) {
+	rate := float64(p.done) / time.Since(p.start).Seconds()
+	if p.total > 0 {
+		fmt.Fprintf(p.out, "%s%s %s / %s (%s/s)", prefix, p.name, humanBytes(float64(p.done)), humanBytes(float64(p.total)), humanBytes(rate))
+		return
+	}
+	fmt.Fprintf(p.out, "%s%s %s (%s/s)", prefix, p.name, humanBytes(float64(p.done)), humanBytes(rate))
+}
+
+func humanBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
@@ -0,0 +1,62 @@
+package plugin
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"sync"
+)
+
+// enableDebugConsole turns on debug_console_enabled in the kata
+// configuration of the sandbox's hypervisor on the pod's node only. The
+// returned function puts the previous configuration back, it is safe to
+// call more than once.
+func (e *ExecService) enableDebugConsole(sandbox *sandbox) (func(), error) {
+	path := sandbox.configPath()
+	original, err := readNodeFile(e.kubeService, e.deployPod, path)
+	if err != nil {
+		return nil, err
+	}
+	updated, enabled, err := setDebugConsole(original)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to enable the debug console in %s on node %s", path, e.pod.Spec.NodeName)
+	}
+	if enabled {
+		return func() {}, nil
+	}
+	if err := writeNodeFile(e.kubeService, e.deployPod, path, updated); err != nil {
+		return nil, err
+	}
+	log.Warnf("enabled the debug console in %s on node %s until the session ends, only sandboxes started from now on pick it up", path, e.pod.Spec.NodeName)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			current, err := readNodeFile(e.kubeService, e.deployPod, path)
+			if err != nil {
+				log.WithError(err).Errorf("failed to restore the debug console setting in %s", path)
+				return
+			}
+			if !bytes.Equal(current, updated) {
+				log.Warnf("%s on node %s changed during the session, leaving it as it is", path, e.pod.Spec.NodeName)
+				return
+			}
+			if err := writeNodeFile(e.kubeService, e.deployPod, path, original); err != nil {
+				log.WithError(err).Errorf("failed to restore the debug console setting in %s", path)
+				return
+			}
+			log.Infof("restored the debug console setting in %s on node %s", path, e.pod.Spec.NodeName)
+		})
+	}, nil
+}
+
+// setDebugConsole sets debug_console_enabled = true in a kata configuration
+// and reports whether it already was.
+func setDebugConsole(config []byte) ([]byte, bool, error) {
+	c := parseKataConfig(config)
+	changed, err := c.set("agent.debug_console_enabled", "true")
+	if err != nil {
+		return nil, false, err
+	}
+	return c.bytes(), !changed, nil
+}
@@ -1,14 +1,19 @@
 package plugin
 
 import (
+	"context"
 	"github.com/Tim-0731-Hzt/knet/pkg/kube"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
-	"os/exec"
+	apps_v1 "k8s.io/api/apps/v1"
+	"time"
 )
 
 type DeleteService struct {
 	kubeService *kube.KubernetesApiServiceImpl
+	Image       KataDeployImage
+	Timeout     time.Duration
+	DryRun      string
 }
 
 func NewDeleteService() *DeleteService {
@@ -16,6 +21,7 @@ func NewDeleteService() *DeleteService {
 }
 func (d *DeleteService) Complete(cmd *cobra.Command, args []string) error {
 	var err error
+	d.Image.Complete(cmd)
 	d.kubeService, err = kube.NewKubernetesApiServiceImpl()
 	if err != nil {
 		return err
@@ -23,26 +29,49 @@ func (d *DeleteService) Complete(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+func (d *DeleteService) Validate() error {
+	if err := validateDryRun(d.DryRun); err != nil {
+		return err
+	}
+	if d.DryRun == dryRunServer {
+		d.kubeService.ServerDryRun()
+	}
+	if err := d.Image.Validate(); err != nil {
+		return err
+	}
+	return d.Image.validatePullSecrets(d.kubeService)
+}
+
 func (d *DeleteService) Run() error {
+	// installs from before targeted rollouts ran on every node
+	cleanDeployment := d.Image.apply(daemonSetCleanDeployment)
+	hypervisors := allHypervisors()
+	if daemonSet, err := d.kubeService.GetDaemonSet("kata-deploy"); err == nil {
+		if daemonSet.Spec.Template.Spec.NodeSelector[deployNodeLabel] == "true" {
+			cleanDeployment.Spec.Template.Spec.NodeSelector = map[string]string{deployNodeLabel: "true"}
+		}
+		hypervisors = hypervisorsOf(daemonSet)
+	}
+	if d.DryRun != dryRunNone {
+		return d.dryRun(cleanDeployment, hypervisors)
+	}
 
 	log.Infof("delete kata-deploy")
 	if err := d.kubeService.DeleteDaemonSet("kata-deploy"); err != nil {
 		return err
 	}
-	cmd := exec.Command("kubectl", "-n", "kube-system", "wait", "--timeout=10m", "--for=delete", "-l", "name=kata-deploy", "pod")
-	if err := cmd.Run(); err != nil {
-		log.WithError(err).Errorf("failed to execute kubectl wait")
+	waiter := d.kubeService.Waiter(d.Timeout)
+	if err := waiter.PodsDeleted(context.Background(), "name=kata-deploy"); err != nil {
 		return err
 	}
 
 	log.Infof("create kubelet-kata-cleanup")
-	if err := d.kubeService.DeployDaemonSet(daemonSetCleanDeployment); err != nil {
+	if err := d.kubeService.DeployDaemonSet(cleanDeployment); err != nil {
 		return err
 	}
 
-	cmd = exec.Command("kubectl", "-n", "kube-system", "wait", "--timeout=10m", "--for=condition=Ready", "-l", "name=kubelet-kata-cleanup", "pod")
-	if err := cmd.Run(); err != nil {
-		log.WithError(err).Errorf("failed to execute kubectl wait")
+	if err := waiter.DaemonSetReady(context.Background(), "kubelet-kata-cleanup", "name=kubelet-kata-cleanup"); err != nil {
+		log.WithError(err).Errorf("kubelet-kata-cleanup not ready")
 		log.Errorf("delete kubelet-kata-cleanup")
 		_ = d.kubeService.DeleteDaemonSet("kubelet-kata-cleanup")
 		return err
@@ -57,21 +86,74 @@ func (d *DeleteService) Run() error {
 	if err := d.kubeService.DeleteDaemonSet("kubelet-kata-cleanup"); err != nil {
 		return err
 	}
-	cmd = exec.Command("kubectl", "-n", "kube-system", "wait", "--timeout=10m", "--for=delete", "-l", "name=kubelet-kata-cleanup", "pod")
-	if err := cmd.Run(); err != nil {
-		log.WithError(err).Errorf("failed to execute kubectl wait")
+	if err := waiter.PodsDeleted(context.Background(), "name=kubelet-kata-cleanup"); err != nil {
+		return err
+	}
+	log.Infof("unlabel nodes")
+	nodes, err := d.kubeService.ListNodes(deployNodeLabel)
+	if err != nil {
 		return err
 	}
+	for _, n := range nodes {
+		if err := d.kubeService.LabelNode(n.Name, deployNodeLabel, nil); err != nil {
+			return err
+		}
+	}
 	log.Infof("delete kata-rbac")
 	if err := d.kubeService.DeleteRbac(); err != nil {
 		return err
 	}
 
 	log.Infof("delete kata-runtimeclass")
-	for _, s := range []string{"kata-qemu", "kata-clh", "kata-fc", "kata-dragonball"} {
-		if err := d.kubeService.DeleteRuntimeClass(s); err != nil {
+	for _, h := range hypervisors {
+		if err := d.kubeService.DeleteRuntimeClass("kata-" + h); err != nil {
 			return err
 		}
 	}
+	// the journal of a deploy that did not finish
+	return d.kubeService.DeleteConfigMap(journalName)
+}
+
+// dryRun reports what delete would change. The reset kubelet-kata-cleanup
+// runs on the nodes cannot be dry run, a server dry run only validates
+// creating it.
+func (d *DeleteService) dryRun(cleanDeployment *apps_v1.DaemonSet, hypervisors []string) error {
+	server := d.DryRun == dryRunServer
+	if server {
+		if err := d.kubeService.DeleteDaemonSet("kata-deploy"); err != nil {
+			return err
+		}
+		if err := d.kubeService.DeployDaemonSet(cleanDeployment); err != nil {
+			return err
+		}
+	}
+	log.Infof("daemonset/kata-deploy deleted (%s dry run)", d.DryRun)
+	log.Infof("daemonset/kubelet-kata-cleanup created to reset kata on the nodes and deleted (%s dry run)", d.DryRun)
+	nodes, err := d.kubeService.ListNodes(deployNodeLabel)
+	if err != nil {
+		return err
+	}
+	for _, n := range nodes {
+		if server {
+			if err := d.kubeService.LabelNode(n.Name, deployNodeLabel, nil); err != nil {
+				return err
+			}
+		}
+		log.Infof("node/%s unlabeled %s (%s dry run)", n.Name, deployNodeLabel, d.DryRun)
+	}
+	if server {
+		if err := d.kubeService.DeleteRbac(); err != nil {
+			return err
+		}
+	}
+	log.Infof("serviceaccount/kata-label-node, clusterrole/node-labeler and clusterrolebinding/kata-label-node-rb deleted (%s dry run)", d.DryRun)
+	for _, h := range hypervisors {
+		if server {
+			if err := d.kubeService.DeleteRuntimeClass("kata-" + h); err != nil {
+				return err
+			}
+		}
+		log.Infof("runtimeclass/kata-%s deleted (%s dry run)", h, d.DryRun)
+	}
 	return nil
 }
@@ -1,14 +1,36 @@
 package plugin
 
 import (
+	"context"
+	"fmt"
 	"github.com/Tim-0731-Hzt/knet/pkg/kube"
+	"github.com/Tim-0731-Hzt/knet/pkg/wait"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
-	"os/exec"
+	v1 "k8s.io/api/core/v1"
+	k_error "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 type DeployService struct {
 	kubeService *kube.KubernetesApiServiceImpl
+	Image       KataDeployImage
+	Rollout     Rollout
+	Hypervisors Hypervisors
+	Timeout     time.Duration
+	DryRun      string
+	Resume      bool
+	// ForceConflicts takes over fields another field manager owns.
+	ForceConflicts bool
+	nodes          []string
+	// running are the nodes that run kata-deploy without being labeled.
+	running []string
 }
 
 func NewDeployService() *DeployService {
@@ -16,6 +38,7 @@ func NewDeployService() *DeployService {
 }
 func (d *DeployService) Complete(cmd *cobra.Command, args []string) error {
 	var err error
+	d.Image.Complete(cmd)
 	d.kubeService, err = kube.NewKubernetesApiServiceImpl()
 	if err != nil {
 		return err
@@ -23,39 +46,288 @@ func (d *DeployService) Complete(cmd *cobra.Command, args []string) error {
 	return nil
 }
 func (d *DeployService) Validate() error {
+	if err := validateDryRun(d.DryRun); err != nil {
+		return err
+	}
+	if d.DryRun == dryRunServer {
+		d.kubeService.ServerDryRun()
+	}
+	if err := d.Image.Validate(); err != nil {
+		return err
+	}
+	if err := d.Rollout.Validate(); err != nil {
+		return err
+	}
+	if err := d.Hypervisors.Validate(); err != nil {
+		return err
+	}
+	if err := d.Image.validatePullSecrets(d.kubeService); err != nil {
+		return err
+	}
+	var err error
+	d.running, err = unlabeledDeployNodes(d.kubeService)
+	if err != nil {
+		return err
+	}
+	targets, err := d.Rollout.targets(d.kubeService)
+	if err != nil {
+		return err
+	}
+	for _, n := range targets {
+		if !containsString(d.running, n) {
+			d.nodes = append(d.nodes, n)
+		}
+	}
+	if len(d.nodes) == 0 {
+		log.Infof("kata-deploy already runs on all selected nodes")
+	}
 	return nil
 }
 func (d *DeployService) Run() error {
-	log.Infof("create kata-rbac")
-	if err := d.kubeService.CreateRbac(serviceAccount, clusterRole, clusterRoleBinding); err != nil {
+	if d.DryRun != dryRunNone {
+		return d.dryRun()
+	}
+	j, found, err := openJournal(d.kubeService)
+	if err != nil {
 		return err
 	}
-	log.Infof("create kata-deploy")
-	if err := d.kubeService.DeployDaemonSet(daemonSetDeployment); err != nil {
+	if found && !d.Resume {
+		return errors.Errorf("an earlier deploy did not finish, run deploy --resume to continue it or delete to remove it (kube-system/%s)", journalName)
+	}
+	// the first Ctrl-C stops the deploy and undoes it, the second one kills knet
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err = d.install(ctx, j)
+	stop()
+	if err == nil {
+		return j.remove()
+	}
+	if d.Resume {
+		log.WithError(err).Errorf("deploy stopped, run deploy --resume to continue it")
 		return err
 	}
-	cmd := exec.Command("kubectl", "-n", "kube-system", "wait", "--timeout=10m", "--for=condition=Ready", "-l", "name=kata-deploy", "pod")
-	if err := cmd.Run(); err != nil {
-		log.WithError(err).Errorf("failed to execute kubectl wait")
+	log.WithError(err).Errorf("deploy failed, undoing its %d steps", len(j.entries))
+	if undoErr := d.undo(j); undoErr != nil {
+		return errors.Wrapf(err, "deploy failed and undoing it failed, run delete to clean up: %s", undoErr)
+	}
+	return err
+}
+
+// install runs the steps of deploy, skipping those the journal of an
+// earlier run records.
+func (d *DeployService) install(ctx context.Context, j *journal) error {
+	objects, err := kataObjects(&d.Image, &d.Hypervisors)
+	if err != nil {
 		return err
 	}
-	log.Infof("create kata-runtimeclass")
-	QemuRuntimeClass := runtimeClass("kata-qemu", "250m", "160Mi")
-	if err := d.kubeService.CreateRuntimeClass(QemuRuntimeClass); err != nil {
+	deploy, classes := splitRuntimeClasses(objects)
+	var resumed []string
+	for _, e := range j.entries {
+		if strings.HasPrefix(e, "node/") {
+			resumed = append(resumed, strings.TrimPrefix(e, "node/"))
+		}
+	}
+	// label them before the node selector of the DaemonSet takes their pods
+	// away, they are not journaled as undo must not remove kata from them
+	if err := labelDeployNodes(d.kubeService, d.running); err != nil {
 		return err
 	}
-	ClhRuntimeClass := runtimeClass("kata-clh", "250m", "130Mi")
-	if err := d.kubeService.CreateRuntimeClass(ClhRuntimeClass); err != nil {
+	log.Infof("apply kata-deploy with image %s for %s", d.Image.Reference(), strings.Join(d.Hypervisors.Names, ", "))
+	// RBAC and the DaemonSet, the RuntimeClasses follow the rollout
+	for _, obj := range deploy {
+		if err := d.apply(ctx, j, obj); err != nil {
+			return err
+		}
+	}
+	if len(resumed) > 0 {
+		log.Infof("resume waiting for %s", strings.Join(resumed, ", "))
+		if err := d.kubeService.Waiter(d.Timeout).Nodes(ctx, "name=kata-deploy", resumed, kataInstalled); err != nil {
+			return err
+		}
+	}
+	err = d.Rollout.rollout(ctx, d.kubeService, d.nodes, d.Timeout, func(n string) error {
+		return j.record("node/" + n)
+	})
+	if err != nil {
 		return err
 	}
-	FcRuntimeClass := runtimeClass("kata-fc", "250m", "130Mi")
-	if err := d.kubeService.CreateRuntimeClass(FcRuntimeClass); err != nil {
+	if err := recordImageDigest(d.kubeService, "kata-deploy"); err != nil {
+		log.WithError(err).Warnf("failed to record the image digest")
+	}
+	for _, obj := range classes {
+		if err := d.apply(ctx, j, obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply server-side applies the object and shows how it changes an
+// existing one. Only objects the deploy created are recorded in the journal,
+// so undo leaves objects that existed before in place.
+func (d *DeployService) apply(ctx context.Context, j *journal, obj runtime.Object) error {
+	if err := ctx.Err(); err != nil {
 		return err
 	}
-	DragonballRuntimeClass := runtimeClass("kata-dragonball", "250m", "130Mi")
-	if err := d.kubeService.CreateRuntimeClass(DragonballRuntimeClass); err != nil {
+	name := objectName(obj)
+	if j.has(name) {
+		log.Infof("%s created by the earlier deploy", name)
+		return nil
+	}
+	kind, objName := splitObjectName(name)
+	live, err := d.kubeService.GetKataObject(kind, objName)
+	if err != nil && !k_error.IsNotFound(err) {
 		return err
 	}
+	if err == nil {
+		changed, err := d.showDiff(name, live, obj)
+		if err != nil {
+			return err
+		}
+		if !changed {
+			log.Infof("%s unchanged", name)
+			return nil
+		}
+		log.Infof("update %s", name)
+		_, err = d.kubeService.ApplyKataObject(obj, d.ForceConflicts, false)
+		return applyError(name, err)
+	}
+	log.Infof("create %s", name)
+	if _, err := d.kubeService.ApplyKataObject(obj, d.ForceConflicts, false); err != nil {
+		return applyError(name, err)
+	}
+	return j.record(name)
+}
+
+// showDiff prints how applying the object would change the live one and
+// tells whether it would.
+func (d *DeployService) showDiff(name string, live runtime.Object, obj runtime.Object) (bool, error) {
+	preview, err := d.kubeService.ApplyKataObject(obj, d.ForceConflicts, true)
+	if err != nil {
+		return false, applyError(name, err)
+	}
+	diff, err := objectDiff(name, live, preview)
+	if err != nil || diff == "" {
+		return false, err
+	}
+	fmt.Print(diff)
+	return true, nil
+}
+
+func applyError(name string, err error) error {
+	if k_error.IsConflict(err) {
+		return errors.Wrapf(err, "fields of %s are managed by another field manager, use --force-conflicts to take them over", name)
+	}
+	return errors.Wrapf(err, "failed to apply %s", name)
+}
+
+// undo reverts the steps of the journal in reverse order. Unlabeled nodes
+// lose their kata-deploy pod, whose preStop hook removes kata again, before
+// the DaemonSet and the RBAC it needs are deleted.
+func (d *DeployService) undo(j *journal) error {
+	waiter := d.kubeService.Waiter(d.Timeout)
+	var unlabeled []string
+	removed := func() error {
+		if len(unlabeled) == 0 {
+			return nil
+		}
+		err := waiter.Nodes(context.Background(), "name=kata-deploy", unlabeled, func(node *v1.Node, pod *v1.Pod) string {
+			if pod != nil {
+				return fmt.Sprintf("pod %s is removing kata: %s", pod.Name, wait.ContainerState(pod))
+			}
+			return ""
+		})
+		unlabeled = nil
+		return err
+	}
+	for i := len(j.entries) - 1; i >= 0; i-- {
+		kind, name := splitObjectName(j.entries[i])
+		if kind != "node" {
+			if err := removed(); err != nil {
+				return err
+			}
+		}
+		log.Infof("undo %s", j.entries[i])
+		switch kind {
+		case "node":
+			if err := d.kubeService.LabelNode(name, deployNodeLabel, nil); err != nil {
+				return errors.Wrapf(err, "failed to unlabel node %s", name)
+			}
+			unlabeled = append(unlabeled, name)
+		case "daemonset":
+			if err := d.kubeService.DeleteKataObject(kind, name); err != nil {
+				return err
+			}
+			if err := waiter.PodsDeleted(context.Background(), "name="+name); err != nil {
+				return err
+			}
+		default:
+			if err := d.kubeService.DeleteKataObject(kind, name); err != nil {
+				return err
+			}
+		}
+	}
+	if err := removed(); err != nil {
+		return err
+	}
+	return j.remove()
+}
+
+// dryRun reports what deploy would change. A server dry run has the API
+// server validate every change without persisting it, nothing is waited for.
+func (d *DeployService) dryRun() error {
+	objects, err := kataObjects(&d.Image, &d.Hypervisors)
+	if err != nil {
+		return err
+	}
+	label := "true"
+	for _, n := range d.running {
+		if d.DryRun == dryRunServer {
+			if err := d.kubeService.LabelNode(n, deployNodeLabel, &label); err != nil {
+				return errors.Wrapf(err, "failed to label node %s", n)
+			}
+		}
+		log.Infof("node/%s already runs kata-deploy, labeled %s=true (%s dry run)", n, deployNodeLabel, d.DryRun)
+	}
+	for _, obj := range objects {
+		name := objectName(obj)
+		if d.DryRun == dryRunClient {
+			log.Infof("%s applied (client dry run)", name)
+			continue
+		}
+		kind, objName := splitObjectName(name)
+		live, err := d.kubeService.GetKataObject(kind, objName)
+		switch {
+		case k_error.IsNotFound(err):
+			if _, err := d.kubeService.ApplyKataObject(obj, d.ForceConflicts, true); err != nil {
+				return applyError(name, err)
+			}
+			log.Infof("%s created (server dry run)", name)
+		case err != nil:
+			return err
+		default:
+			changed, err := d.showDiff(name, live, obj)
+			if err != nil {
+				return err
+			}
+			if changed {
+				log.Infof("%s configured (server dry run)", name)
+			} else {
+				log.Infof("%s unchanged (server dry run)", name)
+			}
+		}
+	}
+	batches := d.Rollout.batches(d.nodes)
+	for i, batch := range batches {
+		if d.DryRun == dryRunServer {
+			for _, n := range batch {
+				if err := d.kubeService.LabelNode(n, deployNodeLabel, &label); err != nil {
+					return errors.Wrapf(err, "failed to label node %s", n)
+				}
+			}
+		}
+		log.Infof("batch %d/%d: %s labeled %s=true (%s dry run)", i+1, len(batches), strings.Join(batch, ", "), deployNodeLabel, d.DryRun)
+	}
 	return nil
 }
 
@@ -0,0 +1,267 @@
+package plugin
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/Tim-0731-Hzt/knet/pkg/kube"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// guestDiagCommands are run in the guest, each into its own file.
+var guestDiagCommands = []struct {
+	file    string
+	command string
+}{
+	{"dmesg.txt", "dmesg"},
+	{"uname.txt", "uname -a"},
+	{"ip-addr.txt", "ip addr"},
+	{"ip-route.txt", "ip route; ip -6 route"},
+	{"ip-neigh.txt", "ip neigh"},
+	{"proc-net-snmp.txt", "cat /proc/net/snmp"},
+	{"mounts.txt", "cat /proc/mounts"},
+	{"agent-version.txt", "kata-agent --version"},
+	{"kernel-config.txt", "zcat /proc/config.gz 2>/dev/null || cat /boot/config-$(uname -r)"},
+}
+
+// DiagService collects guest and host side facts about the kata sandbox of a
+// pod into a tarball for bug reports.
+type DiagService struct {
+	UserSpecifiedNamespace string
+	UserSpecifiedPodName   string
+	UserSpecifiedContainer string
+	Output                 string
+	exec                   *ExecService
+	tw                     *tar.Writer
+	dir                    string
+	summary                diagSummary
+}
+
+// diagSummary is stored as summary.json in the bundle.
+type diagSummary struct {
+	Namespace      string            `json:"namespace"`
+	Pod            string            `json:"pod"`
+	Container      string            `json:"container"`
+	Node           string            `json:"node"`
+	SandboxID      string            `json:"sandboxID"`
+	RuntimeHandler string            `json:"runtimeHandler"`
+	Config         string            `json:"config"`
+	Time           time.Time         `json:"time"`
+	Errors         map[string]string `json:"errors,omitempty"`
+}
+
+// persistState is the part of kata's persist.json knet uses.
+type persistState struct {
+	HypervisorState struct {
+		Type string `json:"Type"`
+		Pid  int    `json:"Pid"`
+	} `json:"HypervisorState"`
+}
+
+func NewDiagService() *DiagService {
+	return &DiagService{}
+}
+
+func (d *DiagService) Complete(cmd *cobra.Command, args []string) error {
+	var err error
+	if d.UserSpecifiedNamespace == "" {
+		d.UserSpecifiedNamespace = "default"
+	}
+	if len(args) > 0 {
+		d.UserSpecifiedPodName = args[0]
+	}
+	if d.UserSpecifiedPodName == "" {
+		return errors.New("pod name is empty")
+	}
+	d.exec = &ExecService{
+		UserSpecifiedNamespace: d.UserSpecifiedNamespace,
+		UserSpecifiedPodName:   d.UserSpecifiedPodName,
+		UserSpecifiedContainer: d.UserSpecifiedContainer,
+	}
+	d.exec.kubeService, err = kube.NewKubernetesApiServiceImpl()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (d *DiagService) Validate() error {
+	return d.exec.Validate()
+}
+
+func (d *DiagService) Run() error {
+	sandbox, err := d.exec.sandbox()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	d.dir = fmt.Sprintf("kata-diag-%s-%s", d.UserSpecifiedPodName, now.Format("20060102T150405Z"))
+	if d.Output == "" {
+		d.Output = d.dir + ".tar.gz"
+	}
+	d.summary = diagSummary{
+		Namespace:      d.UserSpecifiedNamespace,
+		Pod:            d.UserSpecifiedPodName,
+		Container:      d.exec.UserSpecifiedContainer,
+		Node:           d.exec.pod.Spec.NodeName,
+		SandboxID:      sandbox.ID,
+		RuntimeHandler: sandbox.RuntimeHandler,
+		Config:         sandbox.configPath(),
+		Time:           now,
+		Errors:         make(map[string]string),
+	}
+
+	f, err := os.Create(d.Output)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	d.tw = tar.NewWriter(gz)
+
+	d.collectGuest(sandbox)
+	d.collectHost(sandbox)
+
+	summary, err := json.MarshalIndent(d.summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := d.add("summary.json", summary); err != nil {
+		return err
+	}
+	if err := d.tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if len(d.summary.Errors) > 0 {
+		log.Warnf("%d diagnostics could not be collected, see summary.json", len(d.summary.Errors))
+	}
+	log.Infof("wrote %s", d.Output)
+	return nil
+}
+
+// collectGuest runs the guest commands through the debug console.
+func (d *DiagService) collectGuest(sandbox *sandbox) {
+	session, err := openGuestSession(d.exec.kubeService, d.exec.deployPod, sandbox.ID)
+	if err != nil {
+		d.fail("guest", err)
+		return
+	}
+	defer session.Close()
+	for _, c := range guestDiagCommands {
+		name := path.Join("guest", c.file)
+		log.Infof("collecting %s", name)
+		var stdout, stderr bytes.Buffer
+		code, err := session.Run(c.command, nil, &stdout, &stderr)
+		if err != nil {
+			d.fail(name, err)
+			// the console is gone, the remaining commands fail the same way
+			return
+		}
+		d.store(name, stdout.Bytes(), code, stderr.String())
+	}
+}
+
+// collectHost gathers the sandbox state, the hypervisor command line, the
+// network setup of the pod and the kata configuration from the node.
+func (d *DiagService) collectHost(sandbox *sandbox) {
+	persist := path.Join("/run/vc/sbs", sandbox.ID, "persist.json")
+	state, err := d.host("host/persist.json", "cat", persist)
+	if err == nil {
+		var s persistState
+		if err := json.Unmarshal(state, &s); err != nil {
+			d.fail("host/hypervisor-cmdline.txt", errors.Wrap(err, "failed to decode persist.json"))
+		} else if s.HypervisorState.Pid == 0 {
+			d.fail("host/hypervisor-cmdline.txt", errors.New("persist.json has no hypervisor pid"))
+		} else if cmdline, err := d.host("", "cat", "/proc/"+strconv.Itoa(s.HypervisorState.Pid)+"/cmdline"); err != nil {
+			d.fail("host/hypervisor-cmdline.txt", errors.Wrap(err, "the hypervisor process is only visible with the host pid namespace"))
+		} else {
+			_ = d.add("host/hypervisor-cmdline.txt", append(bytes.ReplaceAll(bytes.TrimRight(cmdline, "\x00"), []byte{0}, []byte(" ")), '\n'))
+		}
+	}
+	_, _ = d.host("host/vm-dir.txt", "ls", "-la", path.Join("/run/vc/vm", sandbox.ID))
+	if sandbox.NetworkNamespace == "" {
+		d.fail("host/netns", errors.New("sandbox has no network namespace"))
+	} else {
+		netns := "--net=" + sandbox.NetworkNamespace
+		_, _ = d.host("host/netns-link.txt", "nsenter", netns, "ip", "-d", "link")
+		_, _ = d.host("host/netns-addr.txt", "nsenter", netns, "ip", "addr")
+		_, _ = d.host("host/netns-route.txt", "nsenter", netns, "ip", "route")
+		_, _ = d.host("host/netns-tc.txt", "nsenter", netns, "tc", "-s", "qdisc", "show")
+	}
+	_, _ = d.host(path.Join("host", path.Base(sandbox.configPath())), "cat", sandbox.configPath())
+	_, _ = d.host("host/kata-env.txt", "kata-runtime", "--config", sandbox.configPath(), "kata-env")
+}
+
+// host runs the command in the kata-deploy pod and stores its output under
+// name unless name is empty.
+func (d *DiagService) host(name string, command ...string) ([]byte, error) {
+	if name != "" {
+		log.Infof("collecting %s", name)
+	}
+	var stdout, stderr bytes.Buffer
+	hostRequest := kube.ExecCommandRequest{
+		PodName:   d.exec.deployPod.Name,
+		Namespace: d.exec.deployPod.Namespace,
+		Container: "kube-kata",
+		Command:   command,
+		StdOut:    &stdout,
+		StdErr:    &stderr,
+	}
+	code, err := d.exec.kubeService.ExecuteCommand(hostRequest)
+	if err != nil && code == 0 {
+		code = 1
+	}
+	if name != "" {
+		d.store(name, stdout.Bytes(), code, stderr.String())
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: %s", strings.Join(command, " "), strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// store adds the output of a command and records it as failed when it did
+// not exit cleanly.
+func (d *DiagService) store(name string, data []byte, code int, stderr string) {
+	if code != 0 {
+		d.fail(name, errors.Errorf("exit code %d: %s", code, strings.TrimSpace(stderr)))
+		if len(data) == 0 {
+			return
+		}
+	}
+	if err := d.add(name, data); err != nil {
+		d.fail(name, err)
+	}
+}
+
+func (d *DiagService) fail(name string, err error) {
+	log.WithError(err).Warnf("failed to collect %s", name)
+	d.summary.Errors[name] = err.Error()
+}
+
+func (d *DiagService) add(name string, data []byte) error {
+	header := &tar.Header{
+		Name:    path.Join(d.dir, name),
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: d.summary.Time,
+	}
+	if err := d.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := io.Copy(d.tw, bytes.NewReader(data))
+	return err
+}
@@ -0,0 +1,39 @@
+package plugin
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"os/user"
+	"time"
+)
+
+// auditSession records on the pod who opened a guest console session and
+// returns the function recording when it was closed. The session is
+// refused when the opening cannot be recorded.
+func (e *ExecService) auditSession(sandbox *sandbox) (func(), error) {
+	who := e.kubeService.CurrentUser()
+	local := "unknown"
+	if u, err := user.Current(); err == nil {
+		local = u.Username
+	}
+	if host, err := os.Hostname(); err == nil {
+		local += "@" + host
+	}
+	session := "the guest console"
+	if len(e.Command) > 0 {
+		session = fmt.Sprintf("command %q in the guest", shellQuote(e.Command))
+	}
+	start := time.Now()
+	message := fmt.Sprintf("%s (local user %s) opened %s of sandbox %s", who, local, session, sandbox.ID)
+	if err := e.kubeService.CreatePodEvent(e.pod, "GuestSessionOpened", message); err != nil {
+		return nil, errors.Wrapf(err, "failed to record the session in an event on pod %s", e.pod.Name)
+	}
+	return func() {
+		message := fmt.Sprintf("%s (local user %s) closed %s of sandbox %s opened at %s after %s", who, local, session, sandbox.ID, start.UTC().Format(time.RFC3339), time.Since(start).Round(time.Second))
+		if err := e.kubeService.CreatePodEvent(e.pod, "GuestSessionClosed", message); err != nil {
+			log.WithError(err).Errorf("failed to record the end of the session on pod %s", e.pod.Name)
+		}
+	}, nil
+}
@@ -2,20 +2,31 @@ package plugin
 
 import (
 	"fmt"
+	"github.com/Tim-0731-Hzt/knet/pkg/cast"
 	"github.com/Tim-0731-Hzt/knet/pkg/kube"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	v1 "k8s.io/api/core/v1"
+	utilexec "k8s.io/client-go/util/exec"
+	"k8s.io/kubectl/pkg/util/interrupt"
+	"os"
 	"strings"
+	"sync"
 )
 
 type ExecService struct {
 	kubeService            *kube.KubernetesApiServiceImpl
 	UserSpecifiedNamespace string
 	UserSpecifiedPodName   string
+	UserSpecifiedContainer string
+	DebugConsole           bool
+	Record                 string
+	AuditEvent             bool
+	Command                []string
 	deployPod              *v1.Pod
 	pod                    *v1.Pod
+	runtime                *containerRuntime
 }
 
 func NewExecService() *ExecService {
@@ -27,9 +38,19 @@ func (e *ExecService) Complete(cmd *cobra.Command, args []string) error {
 	if e.UserSpecifiedNamespace == "" {
 		e.UserSpecifiedNamespace = "default"
 	}
+	positional := args
+	if dash := cmd.ArgsLenAtDash(); dash >= 0 {
+		positional, e.Command = args[:dash], args[dash:]
+	}
+	if e.UserSpecifiedPodName == "" && len(positional) > 0 {
+		e.UserSpecifiedPodName = positional[0]
+	}
 	if e.UserSpecifiedPodName == "" {
 		return errors.New("pod name is empty")
 	}
+	if e.Record != "" && len(e.Command) > 0 {
+		return errors.New("--record only records interactive sessions")
+	}
 	e.kubeService, err = kube.NewKubernetesApiServiceImpl()
 	if err != nil {
 		return err
@@ -44,30 +65,204 @@ func (e *ExecService) Validate() error {
 		return err
 	}
 	e.pod = pod
+	// nothing is done on the node before the pod is known to run under kata
+	if err := e.validateRuntimeClass(); err != nil {
+		return err
+	}
+	containerID, err := e.containerID()
+	if err != nil {
+		return err
+	}
 	deployPod, err := e.kubeService.GetKataDeployPod(pod)
 	if err != nil {
 		return err
 	}
 	e.deployPod = deployPod
+	node, err := e.kubeService.GetNode(pod.Spec.NodeName)
+	if err != nil {
+		return err
+	}
+	e.runtime, err = detectContainerRuntime(containerID, node)
+	if err != nil {
+		return err
+	}
 	return nil
 }
 func (e *ExecService) Run() error {
 	log.Infof("Run")
-	fmt.Println(strings.Replace(e.pod.Status.ContainerStatuses[0].ContainerID, "containerd://", "", -1))
-	s := strings.Replace(e.pod.Status.ContainerStatuses[0].ContainerID, "containerd://", "", -1)
-	shellScript := fmt.Sprintf("kata-runtime exec $(echo $(crictl --runtime-endpoint unix:///var/run/containerd/containerd.sock inspect %s | grep sandboxID) | awk '{print $2}' | sed 's/^.//;s/.$//' | sed 's/.$//')", s)
-	executeGetPidRequests := kube.ExecCommandRequest{
+	log.Debugf("container %s is %s://%s", e.UserSpecifiedContainer, e.runtime.Name, e.runtime.ContainerID)
+	sandbox, err := e.sandbox()
+	if err != nil {
+		return err
+	}
+	// undone in reverse order when the session ends
+	var cleanups []func()
+	var once sync.Once
+	finish := func() {
+		once.Do(func() {
+			for i := len(cleanups) - 1; i >= 0; i-- {
+				cleanups[i]()
+			}
+		})
+	}
+	defer finish()
+	if e.DebugConsole {
+		restore, err := e.enableDebugConsole(sandbox)
+		if err != nil {
+			return err
+		}
+		cleanups = append(cleanups, restore)
+	}
+	if e.AuditEvent {
+		closed, err := e.auditSession(sandbox)
+		if err != nil {
+			return err
+		}
+		cleanups = append(cleanups, closed)
+	}
+	if len(e.Command) > 0 {
+		// without a terminal nothing else catches the signals
+		return interrupt.New(nil, finish).Run(func() error {
+			return e.runGuestCommand(sandbox)
+		})
+	}
+	return e.attach(sandbox)
+}
+
+// attach opens the debug console of the sandbox on the local terminal.
+func (e *ExecService) attach(sandbox *sandbox) error {
+	log.Infof("attaching to sandbox %s (%s)", sandbox.ID, sandbox.RuntimeHandler)
+	executeVMRequest := kube.ExecCommandRequest{
 		PodName:   e.deployPod.Name,
 		Namespace: e.deployPod.Namespace,
 		Container: "kube-kata",
-		Command:   []string{"bash", "-c", shellScript},
+		Command:   []string{"kata-runtime", "exec", sandbox.ID},
 	}
-	if _, err := e.kubeService.ExecuteVMCommand(executeGetPidRequests); err != nil {
+	if e.Record != "" {
+		f, err := os.Create(e.Record)
+		if err != nil {
+			return err
+		}
+		recorder := cast.NewWriter(f, fmt.Sprintf("knet exec %s/%s", e.pod.Namespace, e.pod.Name))
+		executeVMRequest.Recorder = recorder
+		defer func() {
+			if err := recorder.Close(); err != nil {
+				log.WithError(err).Errorf("failed to record the session to %s", e.Record)
+			}
+			f.Close()
+		}()
+	}
+	if _, err := e.kubeService.ExecuteVMCommand(executeVMRequest); err != nil {
 		return err
 	}
 	return nil
 }
 
+// sandbox finds the kata sandbox of the validated container.
+func (e *ExecService) sandbox() (*sandbox, error) {
+	endpoint, err := e.criEndpoint()
+	if err != nil {
+		return nil, err
+	}
+	return e.lookupSandbox(endpoint, e.runtime.ContainerID)
+}
+
+// runGuestCommand runs the command in the guest without a terminal and
+// passes its exit code on.
+func (e *ExecService) runGuestCommand(sandbox *sandbox) error {
+	session, err := openGuestSession(e.kubeService, e.deployPod, sandbox.ID)
+	if err != nil {
+		return err
+	}
+	code, err := session.Run(shellQuote(e.Command), nil, os.Stdout, os.Stderr)
+	if err != nil {
+		return err
+	}
+	if err := session.Close(); err != nil {
+		return err
+	}
+	if code != 0 {
+		return utilexec.CodeExitError{Err: errors.Errorf("command terminated with exit code %d", code), Code: code}
+	}
+	return nil
+}
+
+// criEndpoint returns the first candidate CRI socket of the pod's runtime
+// that exists on the node.
+func (e *ExecService) criEndpoint() (string, error) {
+	for _, endpoint := range e.runtime.Endpoints {
+		probeSocketRequest := kube.ExecCommandRequest{
+			PodName:   e.deployPod.Name,
+			Namespace: e.deployPod.Namespace,
+			Container: "kube-kata",
+			Command:   []string{"test", "-S", strings.TrimPrefix(endpoint, "unix://")},
+		}
+		if _, err := e.kubeService.ExecuteCommand(probeSocketRequest); err == nil {
+			log.Infof("using %s runtime endpoint %s", e.runtime.Name, endpoint)
+			return endpoint, nil
+		}
+	}
+	return "", errors.Errorf("no %s socket found on node %s, tried %s", e.runtime.Name, e.pod.Spec.NodeName, strings.Join(e.runtime.Endpoints, ", "))
+}
+
+// validateRuntimeClass checks that the pod asks for a kata runtime class.
+func (e *ExecService) validateRuntimeClass() error {
+	names := strings.Join(e.containerNames(), ", ")
+	name := e.pod.Spec.RuntimeClassName
+	if name == nil || *name == "" {
+		return errors.Wrapf(ErrNotKata, "pod %s has no runtime class, available containers: %s", e.pod.Name, names)
+	}
+	if strings.Contains(*name, "kata") {
+		return nil
+	}
+	runtimeClass, err := e.kubeService.GetRuntimeClass(*name)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get runtime class %s of pod %s", *name, e.pod.Name)
+	}
+	if !strings.Contains(runtimeClass.Handler, "kata") {
+		return errors.Wrapf(ErrNotKata, "pod %s uses runtime class %s with handler %s, available containers: %s", e.pod.Name, *name, runtimeClass.Handler, names)
+	}
+	return nil
+}
+
+// containerID picks the container to exec into, like kubectl exec the
+// default container annotation or the first container is used when none is
+// specified, and returns its ID once it is running.
+func (e *ExecService) containerID() (string, error) {
+	names := e.containerNames()
+	if e.UserSpecifiedContainer == "" {
+		e.UserSpecifiedContainer = e.pod.Annotations["kubectl.kubernetes.io/default-container"]
+		if e.UserSpecifiedContainer == "" {
+			e.UserSpecifiedContainer = names[0]
+		}
+		if len(names) > 1 {
+			log.Infof("defaulting container to %s, choose another one with -c (%s)", e.UserSpecifiedContainer, strings.Join(names, ", "))
+		}
+	}
+	runtimeClass := "<none>"
+	if e.pod.Spec.RuntimeClassName != nil {
+		runtimeClass = *e.pod.Spec.RuntimeClassName
+	}
+	for _, s := range e.pod.Status.ContainerStatuses {
+		if s.Name != e.UserSpecifiedContainer {
+			continue
+		}
+		if s.State.Running == nil || s.ContainerID == "" {
+			return "", errors.Errorf("container %s of pod %s is not running, available containers: %s, runtime class %s", s.Name, e.pod.Name, strings.Join(names, ", "), runtimeClass)
+		}
+		return s.ContainerID, nil
+	}
+	return "", errors.Errorf("container %s not found in pod %s, available containers: %s, runtime class %s", e.UserSpecifiedContainer, e.pod.Name, strings.Join(names, ", "), runtimeClass)
+}
+
+func (e *ExecService) containerNames() []string {
+	var names []string
+	for _, c := range e.pod.Spec.Containers {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
 func (e *ExecService) cleanup() error {
 	return nil
 }
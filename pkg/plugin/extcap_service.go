@@ -0,0 +1,154 @@
+package plugin
+
+import (
+	"fmt"
+	"github.com/Tim-0731-Hzt/knet/pkg/kube"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	v1 "k8s.io/api/core/v1"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// extcapInterfacePrefix prefixes every interface knet reports to Wireshark.
+// Interfaces are named knet_<namespace>_<pod>, which is unambiguous because
+// neither namespaces nor pod names may contain an underscore.
+const extcapInterfacePrefix = "knet"
+
+// ExtcapService implements the Wireshark extcap protocol so that knet can be
+// dropped into Wireshark's extcap directory and list pods as interfaces.
+type ExtcapService struct {
+	kubeService   *kube.KubernetesApiServiceImpl
+	Interfaces    bool
+	Dlts          bool
+	Config        bool
+	Capture       bool
+	Version       string
+	Interface     string
+	Fifo          string
+	CaptureFilter string
+}
+
+func NewExtcapService() *ExtcapService {
+	return &ExtcapService{}
+}
+
+// Requested reports whether knet was invoked by Wireshark as an extcap binary.
+func (e *ExtcapService) Requested() bool {
+	return e.Interfaces || e.Dlts || e.Config || e.Capture
+}
+
+func (e *ExtcapService) Complete(cmd *cobra.Command, args []string) error {
+	if e.Interfaces {
+		return nil
+	}
+	if e.Interface == "" {
+		return errors.New("--extcap-interface is required")
+	}
+	if e.Capture && e.Fifo == "" {
+		return errors.New("--fifo is required for --capture")
+	}
+	return nil
+}
+
+func (e *ExtcapService) Validate() error {
+	if e.Interfaces {
+		return nil
+	}
+	if _, _, err := parseExtcapInterface(e.Interface); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (e *ExtcapService) Run() error {
+	switch {
+	case e.Interfaces:
+		return e.listInterfaces()
+	case e.Dlts:
+		fmt.Println("dlt {number=1}{name=EN10MB}{display=Ethernet}")
+		return nil
+	case e.Config:
+		fmt.Println("arg {number=0}{call=--context}{display=Kube context}{type=string}{tooltip=Name of the kubeconfig context to use}")
+		return nil
+	case e.Capture:
+		return e.capture()
+	}
+	return nil
+}
+
+func (e *ExtcapService) listInterfaces() error {
+	version := e.Version
+	if version == "" {
+		version = "1.0"
+	}
+	fmt.Printf("extcap {version=%s}{help=https://github.com/Tim-0731-Hzt/knet}\n", version)
+	var err error
+	e.kubeService, err = kube.NewKubernetesApiServiceImpl()
+	if err != nil {
+		// Wireshark calls every extcap binary on startup, an unreachable
+		// cluster must not break its interface list.
+		log.WithError(err).Errorf("failed to create kubernetes client")
+		return nil
+	}
+	pods, err := e.kubeService.ListPods(v1.NamespaceAll)
+	if err != nil {
+		log.WithError(err).Errorf("failed to list pods")
+		return nil
+	}
+	for _, pod := range pods {
+		if pod.Status.Phase != v1.PodRunning {
+			continue
+		}
+		fmt.Printf("interface {value=%s_%s_%s}{display=knet: %s/%s}\n", extcapInterfacePrefix, pod.Namespace, pod.Name, pod.Namespace, pod.Name)
+	}
+	return nil
+}
+
+func (e *ExtcapService) capture() error {
+	namespace, podName, _ := parseExtcapInterface(e.Interface)
+	fifo, err := os.OpenFile(e.Fifo, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer fifo.Close()
+
+	// Wireshark stops a capture by terminating the extcap process.
+	go func() {
+		sigchan := make(chan os.Signal, 1)
+		signal.Notify(sigchan, os.Interrupt, syscall.SIGTERM)
+		<-sigchan
+		log.Infof("stop capture")
+		_ = fifo.Close()
+		os.Exit(0)
+	}()
+
+	c := NewTcpdumpConfig()
+	c.UserSpecifiedNamespace = namespace
+	c.UserSpecifiedPodsName = []string{podName}
+	c.Filter = e.CaptureFilter
+	c.Output = fifo
+	t := NewTcpdumpService(c)
+	if err := t.Complete(nil, nil); err != nil {
+		return err
+	}
+	if err := t.Validate(); err != nil {
+		return err
+	}
+	return t.Run()
+}
+
+func parseExtcapInterface(name string) (string, string, error) {
+	parts := strings.Split(name, "_")
+	if len(parts) != 3 || parts[0] != extcapInterfacePrefix || parts[1] == "" || parts[2] == "" {
+		return "", "", errors.Errorf("unknown extcap interface %q", name)
+	}
+	return parts[1], parts[2], nil
+}
+
+func (e *ExtcapService) cleanup() error {
+	return nil
+}
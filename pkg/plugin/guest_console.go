@@ -0,0 +1,211 @@
+package plugin
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/Tim-0731-Hzt/knet/pkg/kube"
+	"github.com/pkg/errors"
+	"io"
+	v1 "k8s.io/api/core/v1"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// guestSession runs commands in a kata guest through the debug console that
+// `kata-runtime exec` attaches to. The console is a single shell stream, so
+// every command is wrapped in a script that base64 encodes its stdout and
+// stderr line by line, tags each line with a random token and finally
+// reports the exit code. Output of the console itself, prompts and echo,
+// never carries the token and is ignored.
+type guestSession struct {
+	stdin  *io.PipeWriter
+	lines  *bufio.Reader
+	stderr lockedBuffer
+	done   chan error
+}
+
+// lockedBuffer collects the console's stderr while it is streaming.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// openGuestSession attaches to the debug console of the sandbox through the
+// node's kata-deploy pod.
+func openGuestSession(kubeService *kube.KubernetesApiServiceImpl, deployPod *v1.Pod, sandboxID string) (*guestSession, error) {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	g := &guestSession{stdin: inW, lines: bufio.NewReader(outR), done: make(chan error, 1)}
+	executeVMRequest := kube.ExecCommandRequest{
+		PodName:   deployPod.Name,
+		Namespace: deployPod.Namespace,
+		Container: "kube-kata",
+		Command:   []string{"kata-runtime", "exec", sandboxID},
+		StdIn:     inR,
+		StdOut:    outW,
+		StdErr:    &g.stderr,
+	}
+	go func() {
+		_, err := kubeService.ExecuteCommand(executeVMRequest)
+		if err == nil {
+			err = io.EOF
+		}
+		_ = outW.CloseWithError(err)
+		g.done <- err
+	}()
+	if _, err := io.WriteString(g.stdin, "stty -echo 2>/dev/null; PS1=''; PS2=''\n"); err != nil {
+		return nil, g.error(err)
+	}
+	return g, nil
+}
+
+// Run runs the shell command in the guest, feeding it stdin if not nil, and
+// returns its exit code.
+func (g *guestSession) Run(command string, stdin io.Reader, stdout io.Writer, stderr io.Writer) (int, error) {
+	token, err := newToken()
+	if err != nil {
+		return 1, err
+	}
+	// the console only reads input while its output is consumed
+	written := make(chan error, 1)
+	go func() {
+		written <- g.writeScript(token, command, stdin)
+	}()
+	for {
+		line, err := g.lines.ReadString('\n')
+		if err != nil {
+			select {
+			case werr := <-written:
+				if werr != nil {
+					err = werr
+				}
+			default:
+			}
+			return 1, g.error(err)
+		}
+		i := strings.Index(line, token+":")
+		if i < 0 {
+			continue
+		}
+		fields := strings.SplitN(strings.TrimRight(line[i+len(token)+1:], "\r\n"), ":", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		switch fields[0] {
+		case "o", "e":
+			data, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return 1, errors.Wrap(err, "corrupted guest output")
+			}
+			w := stdout
+			if fields[0] == "e" {
+				w = stderr
+			}
+			if _, err := w.Write(data); err != nil {
+				return 1, err
+			}
+		case "rc":
+			code, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return 1, errors.Errorf("guest did not report an exit code: %q", fields[1])
+			}
+			return code, nil
+		}
+	}
+}
+
+// writeScript sends the wrapped command to the guest shell. The exit code
+// of the command is lost in the pipeline and passed through a file instead,
+// the tag is assembled by the shell so that echoed input never matches.
+func (g *guestSession) writeScript(token string, command string, stdin io.Reader) error {
+	if _, err := io.WriteString(g.stdin, "d=$(mktemp -d)\n"); err != nil {
+		return err
+	}
+	input := "/dev/null"
+	if stdin != nil {
+		input = "$d/i"
+		if _, err := fmt.Fprintf(g.stdin, "base64 -d >$d/i <<'%s'\n", token); err != nil {
+			return err
+		}
+		if err := encodeLines(g.stdin, stdin); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(g.stdin, token+"\n"); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(g.stdin, "t=%s; mkfifo $d/e; (base64 <$d/e | sed \"s/^/$t:e:/\") & { { %s\n} <%s; echo $? >$d/rc; } 2>$d/e | base64 | sed \"s/^/$t:o:/\"; wait; echo \"$t:rc:$(cat $d/rc)\"; rm -rf $d\n", token, command, input)
+	return err
+}
+
+// Close ends the guest shell and waits for the console to detach.
+func (g *guestSession) Close() error {
+	_, _ = io.WriteString(g.stdin, "exit\n")
+	_ = g.stdin.Close()
+	if err := <-g.done; err != io.EOF {
+		return g.error(err)
+	}
+	return nil
+}
+
+// error adds what kata-runtime reported to err, e.g. that the debug console
+// is not enabled.
+func (g *guestSession) error(err error) error {
+	if message := strings.TrimSpace(g.stderr.String()); message != "" {
+		return errors.Wrapf(err, "guest console failed: %s", message)
+	}
+	return errors.Wrap(err, "guest console failed")
+}
+
+// encodeLines writes r base64 encoded in lines short enough for a terminal.
+func encodeLines(w io.Writer, r io.Reader) error {
+	buf := make([]byte, 57)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if _, werr := io.WriteString(w, base64.StdEncoding.EncodeToString(buf[:n])+"\n"); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "knet" + hex.EncodeToString(b), nil
+}
+
+// shellQuote quotes args for a POSIX shell.
+func shellQuote(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = "'" + strings.ReplaceAll(a, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,196 @@
+package plugin
+
+import (
+	"github.com/Tim-0731-Hzt/knet/pkg/kube"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	apps_v1 "k8s.io/api/apps/v1"
+	api_v1 "k8s.io/api/core/v1"
+	node_v1 "k8s.io/api/node/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"strings"
+)
+
+// hypervisorsAnnotation records on the kata-deploy DaemonSet which
+// hypervisors were installed.
+const hypervisorsAnnotation = "knet.io/hypervisors"
+
+// defaultOverheads are the pod overheads of the RuntimeClass of each
+// hypervisor kata-deploy can install.
+var defaultOverheads = []struct {
+	name   string
+	cpu    string
+	memory string
+}{
+	{"qemu", "250m", "160Mi"},
+	{"clh", "250m", "130Mi"},
+	{"fc", "250m", "130Mi"},
+	{"dragonball", "250m", "130Mi"},
+}
+
+// Hypervisors selects the hypervisors to install and overrides their
+// RuntimeClasses. Overrides are HYPERVISOR=VALUE, all applies to every
+// hypervisor.
+type Hypervisors struct {
+	Names         []string
+	Overheads     []string
+	Tolerations   []string
+	NodeSelectors []string
+	classes       []*node_v1.RuntimeClass
+}
+
+func allHypervisors() []string {
+	var names []string
+	for _, o := range defaultOverheads {
+		names = append(names, o.name)
+	}
+	return names
+}
+
+// Validate checks the selection and builds the RuntimeClasses.
+func (h *Hypervisors) Validate() error {
+	if len(h.Names) == 0 {
+		h.Names = allHypervisors()
+	}
+	h.classes = nil
+	classes := make(map[string]*node_v1.RuntimeClass)
+	for _, name := range h.Names {
+		if _, ok := classes[name]; ok {
+			return errors.Errorf("hypervisor %s is listed twice", name)
+		}
+		found := false
+		for _, o := range defaultOverheads {
+			if o.name == name {
+				class := runtimeClass("kata-"+name, o.cpu, o.memory)
+				classes[name] = class
+				h.classes = append(h.classes, class)
+				found = true
+			}
+		}
+		if !found {
+			return errors.Errorf("unknown hypervisor %q, choose from %s", name, strings.Join(allHypervisors(), ", "))
+		}
+	}
+	for _, o := range h.Overheads {
+		err := h.override(classes, o, func(class *node_v1.RuntimeClass, v string) error {
+			parts := strings.Split(v, "/")
+			if len(parts) != 2 {
+				return errors.Errorf("invalid overhead %q, expected CPU/MEMORY", v)
+			}
+			cpu, err := resource.ParseQuantity(parts[0])
+			if err != nil {
+				return errors.Wrapf(err, "invalid overhead cpu %q", parts[0])
+			}
+			memory, err := resource.ParseQuantity(parts[1])
+			if err != nil {
+				return errors.Wrapf(err, "invalid overhead memory %q", parts[1])
+			}
+			class.Overhead.PodFixed[api_v1.ResourceCPU] = cpu
+			class.Overhead.PodFixed[api_v1.ResourceMemory] = memory
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, t := range h.Tolerations {
+		err := h.override(classes, t, func(class *node_v1.RuntimeClass, v string) error {
+			toleration, err := parseToleration(v)
+			if err != nil {
+				return err
+			}
+			class.Scheduling.Tolerations = append(class.Scheduling.Tolerations, toleration)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, s := range h.NodeSelectors {
+		err := h.override(classes, s, func(class *node_v1.RuntimeClass, v string) error {
+			kv := strings.SplitN(v, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return errors.Errorf("invalid node selector %q, expected KEY=VALUE", v)
+			}
+			class.Scheduling.NodeSelector[kv[0]] = kv[1]
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// override applies HYPERVISOR=VALUE to the RuntimeClass of the hypervisor.
+func (h *Hypervisors) override(classes map[string]*node_v1.RuntimeClass, arg string, set func(*node_v1.RuntimeClass, string) error) error {
+	kv := strings.SplitN(arg, "=", 2)
+	if len(kv) != 2 {
+		return errors.Errorf("invalid override %q, expected HYPERVISOR=VALUE", arg)
+	}
+	if kv[0] == "all" {
+		for _, name := range h.Names {
+			if err := set(classes[name], kv[1]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	class, ok := classes[kv[0]]
+	if !ok {
+		return errors.Errorf("override %q for a hypervisor that is not installed", arg)
+	}
+	return set(class, kv[1])
+}
+
+// parseToleration parses KEY[=VALUE]:EFFECT like kubectl taint.
+func parseToleration(v string) (api_v1.Toleration, error) {
+	i := strings.LastIndex(v, ":")
+	if i < 0 {
+		return api_v1.Toleration{}, errors.Errorf("invalid toleration %q, expected KEY[=VALUE]:EFFECT", v)
+	}
+	toleration := api_v1.Toleration{Operator: api_v1.TolerationOpExists, Effect: api_v1.TaintEffect(v[i+1:])}
+	switch toleration.Effect {
+	case api_v1.TaintEffectNoSchedule, api_v1.TaintEffectPreferNoSchedule, api_v1.TaintEffectNoExecute:
+	default:
+		return api_v1.Toleration{}, errors.Errorf("invalid toleration effect %q", toleration.Effect)
+	}
+	toleration.Key = v[:i]
+	if kv := strings.SplitN(v[:i], "=", 2); len(kv) == 2 {
+		toleration.Key, toleration.Value, toleration.Operator = kv[0], kv[1], api_v1.TolerationOpEqual
+	}
+	return toleration, nil
+}
+
+// apply returns a copy of the DaemonSet installing only the selected
+// hypervisors, kata-deploy reads them from SHIMS.
+func (h *Hypervisors) apply(d *apps_v1.DaemonSet) *apps_v1.DaemonSet {
+	d = d.DeepCopy()
+	if d.Annotations == nil {
+		d.Annotations = make(map[string]string)
+	}
+	d.Annotations[hypervisorsAnnotation] = strings.Join(h.Names, ",")
+	spec := &d.Spec.Template.Spec
+	for c := range spec.Containers {
+		spec.Containers[c].Env = append(spec.Containers[c].Env, api_v1.EnvVar{Name: "SHIMS", Value: strings.Join(h.Names, " ")})
+	}
+	return d
+}
+
+// installedHypervisors reads the hypervisors kata-deploy installed, all of
+// them for installs that did not record them.
+func installedHypervisors(kubeService *kube.KubernetesApiServiceImpl) []string {
+	daemonSet, err := kubeService.GetDaemonSet("kata-deploy")
+	if err != nil {
+		log.WithError(err).Warnf("failed to get kata-deploy, assuming all hypervisors are installed")
+		return allHypervisors()
+	}
+	return hypervisorsOf(daemonSet)
+}
+
+func hypervisorsOf(daemonSet *apps_v1.DaemonSet) []string {
+	if names := daemonSet.Annotations[hypervisorsAnnotation]; names != "" {
+		return strings.Split(names, ",")
+	}
+	return allHypervisors()
+}
@@ -0,0 +1,77 @@
+package plugin
+
+import (
+	"github.com/Tim-0731-Hzt/knet/pkg/kube"
+	"github.com/pkg/errors"
+	api_v1 "k8s.io/api/core/v1"
+	k_error "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strings"
+)
+
+// journalName is the kube-system ConfigMap deploy records its progress in
+// while it runs.
+const journalName = "knet-deploy-journal"
+
+// journal records the steps of a deploy on the cluster, kind/name of every
+// object it created and node/name of every node it labeled, in order. It
+// survives a crash of knet, so a failed deploy can be undone or resumed.
+type journal struct {
+	kubeService *kube.KubernetesApiServiceImpl
+	configMap   *api_v1.ConfigMap
+	entries     []string
+}
+
+// openJournal loads the journal of an unfinished deploy, or starts a new one.
+// found tells whether there was an unfinished deploy.
+func openJournal(kubeService *kube.KubernetesApiServiceImpl) (j *journal, found bool, err error) {
+	j = &journal{kubeService: kubeService}
+	j.configMap, err = kubeService.GetConfigMap(journalName)
+	if err == nil {
+		if steps := j.configMap.Data["steps"]; steps != "" {
+			j.entries = strings.Split(steps, "\n")
+		}
+		return j, true, nil
+	}
+	if !k_error.IsNotFound(err) {
+		return nil, false, err
+	}
+	j.configMap, err = kubeService.CreateConfigMap(&api_v1.ConfigMap{
+		ObjectMeta: meta_v1.ObjectMeta{Name: journalName, Namespace: "kube-system"},
+		Data:       map[string]string{"steps": ""},
+	})
+	if err != nil {
+		return nil, false, errors.Wrap(err, "failed to create the deploy journal")
+	}
+	return j, false, nil
+}
+
+func (j *journal) has(entry string) bool {
+	for _, e := range j.entries {
+		if e == entry {
+			return true
+		}
+	}
+	return false
+}
+
+// record appends a step, it has to be recorded before the next step starts.
+func (j *journal) record(entry string) error {
+	entries := append(j.entries, entry)
+	configMap := j.configMap.DeepCopy()
+	if configMap.Data == nil {
+		configMap.Data = make(map[string]string)
+	}
+	configMap.Data["steps"] = strings.Join(entries, "\n")
+	updated, err := j.kubeService.UpdateConfigMap(configMap)
+	if err != nil {
+		return errors.Wrapf(err, "failed to record %s in the deploy journal", entry)
+	}
+	j.configMap, j.entries = updated, entries
+	return nil
+}
+
+// remove drops the journal once the deploy is complete or undone.
+func (j *journal) remove() error {
+	return j.kubeService.DeleteConfigMap(journalName)
+}
@@ -0,0 +1,504 @@
+package plugin
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	tableLine = regexp.MustCompile(`^\s*\[([^\[\]]+)\]\s*(#.*)?$`)
+	keyLine   = regexp.MustCompile(`^(\s*)(#?)\s*([A-Za-z0-9_-]+)\s*=(.*)$`)
+)
+
+// kataConfigPath returns the kata configuration of a hypervisor.
+func kataConfigPath(hypervisor string) string {
+	return path.Join(kataConfigDir, "configuration-"+hypervisor+".toml")
+}
+
+type valueKind int
+
+const (
+	kindBool valueKind = iota
+	kindInt
+	kindString
+	kindStrings
+)
+
+func (k valueKind) String() string {
+	return [...]string{"bool", "integer", "string", "comma separated list"}[k]
+}
+
+type kataConfigKey struct {
+	kind   valueKind
+	values []string
+}
+
+// kataConfigKeys are the settings config get and set know, as SECTION.NAME.
+// The hypervisor section is the [hypervisor.*] table of the configuration,
+// agent is [agent.kata].
+var kataConfigKeys = map[string]kataConfigKey{
+	"hypervisor.path":                      {kind: kindString},
+	"hypervisor.kernel":                    {kind: kindString},
+	"hypervisor.image":                     {kind: kindString},
+	"hypervisor.initrd":                    {kind: kindString},
+	"hypervisor.firmware":                  {kind: kindString},
+	"hypervisor.machine_type":              {kind: kindString},
+	"hypervisor.machine_accelerators":      {kind: kindString},
+	"hypervisor.cpu_features":              {kind: kindString},
+	"hypervisor.kernel_params":             {kind: kindString},
+	"hypervisor.default_vcpus":             {kind: kindInt},
+	"hypervisor.default_maxvcpus":          {kind: kindInt},
+	"hypervisor.default_memory":            {kind: kindInt},
+	"hypervisor.memory_slots":              {kind: kindInt},
+	"hypervisor.memory_offset":             {kind: kindInt},
+	"hypervisor.default_bridges":           {kind: kindInt},
+	"hypervisor.pcie_root_port":            {kind: kindInt},
+	"hypervisor.msize_9p":                  {kind: kindInt},
+	"hypervisor.rx_rate_limiter_max_rate":  {kind: kindInt},
+	"hypervisor.tx_rate_limiter_max_rate":  {kind: kindInt},
+	"hypervisor.block_device_driver":       {kind: kindString, values: []string{"virtio-scsi", "virtio-blk", "virtio-blk-ccw", "virtio-mmio", "nvdimm"}},
+	"hypervisor.shared_fs":                 {kind: kindString, values: []string{"virtio-fs", "virtio-fs-nydus", "virtio-9p", "none"}},
+	"hypervisor.virtio_fs_cache":           {kind: kindString, values: []string{"auto", "always", "never", "none"}},
+	"hypervisor.virtio_fs_daemon":          {kind: kindString},
+	"hypervisor.virtio_fs_extra_args":      {kind: kindStrings},
+	"hypervisor.file_mem_backend":          {kind: kindString},
+	"hypervisor.guest_hook_path":           {kind: kindString},
+	"hypervisor.enable_annotations":        {kind: kindStrings},
+	"hypervisor.valid_hypervisor_paths":    {kind: kindStrings},
+	"hypervisor.enable_debug":              {kind: kindBool},
+	"hypervisor.enable_iothreads":          {kind: kindBool},
+	"hypervisor.enable_hugepages":          {kind: kindBool},
+	"hypervisor.enable_virtio_mem":         {kind: kindBool},
+	"hypervisor.disable_block_device_use":  {kind: kindBool},
+	"hypervisor.disable_image_nvdimm":      {kind: kindBool},
+	"hypervisor.disable_vhost_net":         {kind: kindBool},
+	"hypervisor.disable_selinux":           {kind: kindBool},
+	"hypervisor.hotplug_vfio_on_root_bus":  {kind: kindBool},
+	"agent.enable_debug":                   {kind: kindBool},
+	"agent.enable_tracing":                 {kind: kindBool},
+	"agent.debug_console_enabled":          {kind: kindBool},
+	"agent.dial_timeout":                   {kind: kindInt},
+	"agent.container_pipe_size":            {kind: kindInt},
+	"agent.kernel_modules":                 {kind: kindStrings},
+	"runtime.enable_debug":                 {kind: kindBool},
+	"runtime.enable_tracing":               {kind: kindBool},
+	"runtime.enable_pprof":                 {kind: kindBool},
+	"runtime.disable_guest_seccomp":        {kind: kindBool},
+	"runtime.disable_new_netns":            {kind: kindBool},
+	"runtime.disable_guest_empty_dir":      {kind: kindBool},
+	"runtime.sandbox_cgroup_only":          {kind: kindBool},
+	"runtime.static_sandbox_resource_mgmt": {kind: kindBool},
+	"runtime.internetworking_model":        {kind: kindString, values: []string{"macvtap", "tcfilter", "none"}},
+	"runtime.vfio_mode":                    {kind: kindString, values: []string{"guest-kernel", "vfio"}},
+	"runtime.jaeger_endpoint":              {kind: kindString},
+	"runtime.dan_conf":                     {kind: kindString},
+	"runtime.experimental":                 {kind: kindStrings},
+	"runtime.sandbox_bind_mounts":          {kind: kindStrings},
+	"factory.enable_template":              {kind: kindBool},
+	"factory.template_path":                {kind: kindString},
+	"factory.vm_cache_number":              {kind: kindInt},
+	"factory.vm_cache_endpoint":            {kind: kindString},
+}
+
+// lookupKataConfigKey checks a SECTION.NAME key against kataConfigKeys.
+func lookupKataConfigKey(key string) (kataConfigKey, error) {
+	if k, ok := kataConfigKeys[key]; ok {
+		return k, nil
+	}
+	section := strings.SplitN(key, ".", 2)[0]
+	var known []string
+	for name := range kataConfigKeys {
+		if strings.HasPrefix(name, section+".") {
+			known = append(known, name)
+		}
+	}
+	if len(known) == 0 {
+		return kataConfigKey{}, errors.Errorf("unknown key %q, the sections are hypervisor, agent, runtime and factory", key)
+	}
+	sort.Strings(known)
+	return kataConfigKey{}, errors.Errorf("unknown key %q, known %s keys: %s", key, section, strings.Join(known, ", "))
+}
+
+// parse converts a value given on the command line to its TOML form.
+func (k kataConfigKey) parse(key string, value string) (string, error) {
+	var v interface{}
+	var err error
+	switch k.kind {
+	case kindBool:
+		v, err = strconv.ParseBool(value)
+	case kindInt:
+		v, err = strconv.ParseInt(value, 10, 64)
+	case kindString:
+		if strings.ContainsAny(value, "\n\r") {
+			return "", errors.Errorf("%s can not span lines", key)
+		}
+		if len(k.values) > 0 && !containsString(k.values, value) {
+			return "", errors.Errorf("invalid %s %q, use one of %s", key, value, strings.Join(k.values, ", "))
+		}
+		v = value
+	case kindStrings:
+		list := []interface{}{}
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				list = append(list, s)
+			}
+		}
+		v = list
+	}
+	if err != nil {
+		return "", errors.Errorf("%s is a %s, not %q", key, k.kind, value)
+	}
+	return formatTOMLValue(v), nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// kataConfig edits a kata configuration line by line, so everything it does
+// not touch, comments included, stays as it is.
+type kataConfig struct {
+	lines []string
+}
+
+// kataConfigEntry is a key = value line of a kata configuration, or a
+// commented out one. A multi-line array spans the lines start to end.
+type kataConfigEntry struct {
+	table     string
+	key       string
+	commented bool
+	start     int
+	end       int
+	indent    string
+	value     string
+	comment   string
+}
+
+func parseKataConfig(data []byte) *kataConfig {
+	return &kataConfig{lines: strings.SplitAfter(string(data), "\n")}
+}
+
+func (c *kataConfig) bytes() []byte {
+	return []byte(strings.Join(c.lines, ""))
+}
+
+// scan returns the entries and the line of every table header.
+func (c *kataConfig) scan() ([]kataConfigEntry, map[string]int) {
+	var entries []kataConfigEntry
+	tables := make(map[string]int)
+	table := ""
+	for i := 0; i < len(c.lines); i++ {
+		line := strings.TrimRight(c.lines[i], "\r\n")
+		if m := tableLine.FindStringSubmatch(line); m != nil {
+			table = strings.TrimSpace(m[1])
+			if _, ok := tables[table]; !ok {
+				tables[table] = i
+			}
+			continue
+		}
+		m := keyLine.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		e := kataConfigEntry{table: table, key: m[3], commented: m[2] != "", start: i, end: i, indent: m[1]}
+		var s valueScanner
+		value, comment := s.scan(m[4])
+		e.value, e.comment = value, comment
+		for s.depth > 0 && e.end+1 < len(c.lines) {
+			next := strings.TrimRight(c.lines[e.end+1], "\r\n")
+			if e.commented {
+				next = strings.TrimPrefix(strings.TrimSpace(next), "#")
+			}
+			value, _ = s.scan(next)
+			e.value += " " + value
+			e.end++
+		}
+		entries = append(entries, e)
+		i = e.end
+	}
+	return entries, tables
+}
+
+// table returns the table a section's keys live in, hypervisor is the only
+// [hypervisor.*] table of the file.
+func (c *kataConfig) table(section string) (string, error) {
+	_, tables := c.scan()
+	want := section
+	switch section {
+	case "agent":
+		want = "agent.kata"
+	case "hypervisor":
+		for name := range tables {
+			if strings.HasPrefix(name, "hypervisor.") {
+				return name, nil
+			}
+		}
+		return "", errors.New("no [hypervisor.*] table")
+	}
+	if _, ok := tables[want]; !ok {
+		return "", errors.Errorf("no [%s] table", want)
+	}
+	return want, nil
+}
+
+// get returns the value of a SECTION.NAME key in its TOML form, set is false
+// when the key is missing or commented out.
+func (c *kataConfig) get(key string) (value string, set bool, err error) {
+	section, name := splitKey(key)
+	table, err := c.table(section)
+	if err != nil {
+		return "", false, err
+	}
+	entries, _ := c.scan()
+	for _, e := range entries {
+		if e.table != table || e.key != name || e.commented {
+			continue
+		}
+		v, err := parseTOMLValue(e.value)
+		if err != nil {
+			return "", false, errors.Wrapf(err, "invalid %s", key)
+		}
+		return formatTOMLValue(v), true, nil
+	}
+	return "", false, nil
+}
+
+// set sets a SECTION.NAME key to a value in its TOML form and reports whether
+// the configuration changed. A commented out key is uncommented in place, a
+// missing one is added at the top of its table.
+func (c *kataConfig) set(key string, value string) (bool, error) {
+	section, name := splitKey(key)
+	table, err := c.table(section)
+	if err != nil {
+		return false, err
+	}
+	entries, tables := c.scan()
+	target := -1
+	for i, e := range entries {
+		if e.table != table || e.key != name {
+			continue
+		}
+		if !e.commented {
+			if current, err := parseTOMLValue(e.value); err == nil && formatTOMLValue(current) == value {
+				return false, nil
+			}
+			target = i
+			break
+		}
+		if target < 0 {
+			target = i
+		}
+	}
+	line := name + " = " + value
+	if target < 0 {
+		at := tables[table] + 1
+		header := c.lines[at-1]
+		if !strings.HasSuffix(header, "\n") {
+			c.lines[at-1] = header + "\n"
+		}
+		c.lines = append(c.lines[:at], append([]string{line + "\n"}, c.lines[at:]...)...)
+		return true, nil
+	}
+	e := entries[target]
+	if e.comment != "" && e.start == e.end {
+		line += " " + e.comment
+	}
+	lines := append([]string{}, c.lines[:e.start]...)
+	lines = append(lines, e.indent+line+"\n")
+	c.lines = append(lines, c.lines[e.end+1:]...)
+	return true, nil
+}
+
+func splitKey(key string) (string, string) {
+	parts := strings.SplitN(key, ".", 2)
+	return parts[0], parts[1]
+}
+
+// valueScanner separates TOML values from trailing comments, across the
+// lines of a multi-line array.
+type valueScanner struct {
+	depth int
+}
+
+func (s *valueScanner) scan(text string) (value string, comment string) {
+	var quote byte
+	escaped := false
+	for i := 0; i < len(text); i++ {
+		ch := text[i]
+		switch {
+		case quote != 0:
+			if escaped {
+				escaped = false
+			} else if ch == '\\' && quote == '"' {
+				escaped = true
+			} else if ch == quote {
+				quote = 0
+			}
+		case ch == '"' || ch == '\'':
+			quote = ch
+		case ch == '[':
+			s.depth++
+		case ch == ']':
+			s.depth--
+		case ch == '#':
+			return strings.TrimSpace(text[:i]), text[i:]
+		}
+	}
+	return strings.TrimSpace(text), ""
+}
+
+// parseTOMLValue parses the TOML values kata configurations use: booleans,
+// numbers, single-line strings and arrays of them.
+func parseTOMLValue(text string) (interface{}, error) {
+	p := &valueParser{text: text}
+	v, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	p.space()
+	if p.i < len(p.text) {
+		return nil, errors.Errorf("unexpected %q", p.text[p.i:])
+	}
+	return v, nil
+}
+
+type valueParser struct {
+	text string
+	i    int
+}
+
+func (p *valueParser) space() {
+	for p.i < len(p.text) && strings.IndexByte(" \t", p.text[p.i]) >= 0 {
+		p.i++
+	}
+}
+
+func (p *valueParser) value() (interface{}, error) {
+	p.space()
+	if p.i >= len(p.text) {
+		return nil, errors.New("missing value")
+	}
+	start := p.i
+	switch p.text[p.i] {
+	case '"':
+		for p.i++; p.i < len(p.text) && p.text[p.i] != '"'; p.i++ {
+			if p.text[p.i] == '\\' {
+				p.i++
+			}
+		}
+		if p.i >= len(p.text) {
+			return nil, errors.New("unterminated string")
+		}
+		p.i++
+		return strconv.Unquote(p.text[start:p.i])
+	case '\'':
+		end := strings.IndexByte(p.text[start+1:], '\'')
+		if end < 0 {
+			return nil, errors.New("unterminated string")
+		}
+		p.i = start + end + 2
+		return p.text[start+1 : p.i-1], nil
+	case '[':
+		list := []interface{}{}
+		p.i++
+		for {
+			p.space()
+			if p.i < len(p.text) && p.text[p.i] == ']' {
+				p.i++
+				return list, nil
+			}
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+			p.space()
+			if p.i >= len(p.text) {
+				return nil, errors.New("unterminated array")
+			}
+			switch p.text[p.i] {
+			case ',':
+				p.i++
+			case ']':
+			default:
+				return nil, errors.Errorf("unexpected %q in array", p.text[p.i:])
+			}
+		}
+	}
+	for p.i < len(p.text) && strings.IndexByte(" \t,]", p.text[p.i]) < 0 {
+		p.i++
+	}
+	token := p.text[start:p.i]
+	switch token {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	number := strings.Replace(token, "_", "", -1)
+	if n, err := strconv.ParseInt(number, 0, 64); err == nil {
+		return n, nil
+	}
+	if f, err := strconv.ParseFloat(number, 64); err == nil {
+		return f, nil
+	}
+	return nil, errors.Errorf("invalid value %q", token)
+}
+
+// formatTOMLValue writes a value the way knet writes it into kata
+// configurations.
+func formatTOMLValue(v interface{}) string {
+	switch v := v.(type) {
+	case bool:
+		return strconv.FormatBool(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		s := strconv.FormatFloat(v, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".eEn") {
+			s += ".0"
+		}
+		return s
+	case string:
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\t", `\t`).Replace(v) + `"`
+	case []interface{}:
+		var items []string
+		for _, item := range v {
+			items = append(items, formatTOMLValue(item))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	}
+	return fmt.Sprint(v)
+}
+
+// values returns every key that is set as TABLE.NAME with its value in TOML
+// form, so configurations compare regardless of comments and layout.
+func (c *kataConfig) values() map[string]string {
+	entries, _ := c.scan()
+	values := make(map[string]string)
+	for _, e := range entries {
+		if e.commented {
+			continue
+		}
+		value := e.value
+		if v, err := parseTOMLValue(e.value); err == nil {
+			value = formatTOMLValue(v)
+		}
+		name := e.key
+		if e.table != "" {
+			name = e.table + "." + e.key
+		}
+		values[name] = value
+	}
+	return values
+}
@@ -0,0 +1,215 @@
+package plugin
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testKataConfig = `# Kata configuration
+[hypervisor.qemu]
+path = "/opt/kata/bin/qemu-system-x86_64"
+kernel_params = "" # extra params
+#default_vcpus = 1
+default_memory = 2048
+enable_annotations = ["enable_iommu",
+  "virtio_fs_extra_args"]
+# valid_hypervisor_paths = ["/opt/kata/bin/qemu-system-x86_64",
+#   "/usr/bin/qemu"]
+
+[agent.kata]
+#debug_console_enabled = true
+kernel_modules=[]
+
+[runtime]
+enable_debug = false
+`
+
+func TestKataConfigGet(t *testing.T) {
+	tests := []struct {
+		key   string
+		value string
+		set   bool
+	}{
+		{"hypervisor.path", `"/opt/kata/bin/qemu-system-x86_64"`, true},
+		{"hypervisor.kernel_params", `""`, true},
+		{"hypervisor.default_vcpus", "", false},
+		{"hypervisor.default_memory", "2048", true},
+		{"hypervisor.enable_annotations", `["enable_iommu", "virtio_fs_extra_args"]`, true},
+		{"hypervisor.valid_hypervisor_paths", "", false},
+		{"agent.debug_console_enabled", "", false},
+		{"agent.kernel_modules", "[]", true},
+		{"runtime.enable_debug", "false", true},
+	}
+	config := parseKataConfig([]byte(testKataConfig))
+	for _, tt := range tests {
+		value, set, err := config.get(tt.key)
+		if err != nil {
+			t.Errorf("%s: %v", tt.key, err)
+			continue
+		}
+		if value != tt.value || set != tt.set {
+			t.Errorf("%s = %q (%v), want %q (%v)", tt.key, value, set, tt.value, tt.set)
+		}
+	}
+	if _, _, err := config.get("factory.enable_template"); err == nil {
+		t.Errorf("want an error for a missing table")
+	}
+}
+
+func TestKataConfigSet(t *testing.T) {
+	replace := func(old string, new string) string {
+		if !strings.Contains(testKataConfig, old) {
+			t.Fatalf("%q not in the configuration", old)
+		}
+		return strings.Replace(testKataConfig, old, new, 1)
+	}
+	tests := []struct {
+		name    string
+		key     string
+		value   string
+		changed bool
+		want    string
+	}{
+		{"unchanged", "hypervisor.default_memory", "2048", false, testKataConfig},
+		{"replace", "hypervisor.default_memory", "4096", true,
+			replace("default_memory = 2048\n", "default_memory = 4096\n")},
+		{"keep comment", "hypervisor.kernel_params", `"quiet"`, true,
+			replace(`kernel_params = "" # extra params`, `kernel_params = "quiet" # extra params`)},
+		{"uncomment", "hypervisor.default_vcpus", "2", true,
+			replace("#default_vcpus = 1\n", "default_vcpus = 2\n")},
+		{"multi-line array", "hypervisor.enable_annotations", `["default_vcpus"]`, true,
+			replace("enable_annotations = [\"enable_iommu\",\n  \"virtio_fs_extra_args\"]\n", "enable_annotations = [\"default_vcpus\"]\n")},
+		{"commented multi-line array", "hypervisor.valid_hypervisor_paths", `["/usr/bin/qemu"]`, true,
+			replace("# valid_hypervisor_paths = [\"/opt/kata/bin/qemu-system-x86_64\",\n#   \"/usr/bin/qemu\"]\n", "valid_hypervisor_paths = [\"/usr/bin/qemu\"]\n")},
+		{"agent", "agent.debug_console_enabled", "true", true,
+			replace("#debug_console_enabled = true\n", "debug_console_enabled = true\n")},
+		{"insert", "agent.enable_debug", "true", true,
+			replace("[agent.kata]\n", "[agent.kata]\nenable_debug = true\n")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := parseKataConfig([]byte(testKataConfig))
+			changed, err := config.set(tt.key, tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if changed != tt.changed {
+				t.Errorf("changed %v, want %v", changed, tt.changed)
+			}
+			if got := string(config.bytes()); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+			if value, set, err := config.get(tt.key); err != nil || !set || value != tt.value {
+				t.Errorf("get after set = %q (%v, %v)", value, set, err)
+			}
+		})
+	}
+}
+
+func TestKataConfigSetWithoutTrailingNewline(t *testing.T) {
+	config := parseKataConfig([]byte("[runtime]"))
+	if _, err := config.set("runtime.enable_debug", "true"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(config.bytes()), "[runtime]\nenable_debug = true\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if _, err := config.set("factory.enable_template", "true"); err == nil {
+		t.Errorf("want an error for a missing table")
+	}
+}
+
+func TestKataConfigValues(t *testing.T) {
+	want := map[string]string{
+		"hypervisor.qemu.path":               `"/opt/kata/bin/qemu-system-x86_64"`,
+		"hypervisor.qemu.kernel_params":      `""`,
+		"hypervisor.qemu.default_memory":     "2048",
+		"hypervisor.qemu.enable_annotations": `["enable_iommu", "virtio_fs_extra_args"]`,
+		"agent.kata.kernel_modules":          "[]",
+		"runtime.enable_debug":               "false",
+	}
+	if got := parseKataConfig([]byte(testKataConfig)).values(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestParseTOMLValue(t *testing.T) {
+	for text, want := range map[string]string{
+		"true":                   "true",
+		" false ":                "false",
+		"1_000":                  "1000",
+		"0x10":                   "16",
+		"-3":                     "-3",
+		"1.5":                    "1.5",
+		"1e3":                    "1000.0",
+		`"a\"b\\c"`:              `"a\"b\\c"`,
+		`'C:\path'`:              `"C:\\path"`,
+		`"tab\t"`:                `"tab\t"`,
+		`[]`:                     "[]",
+		`[1, "x", [true], ]`:     `[1, "x", [true]]`,
+		`["a","b"]`:              `["a", "b"]`,
+		`[ "a" , 'b' ]`:          `["a", "b"]`,
+		`"with # hash"`:          `"with # hash"`,
+		`["nested", ["a", 'b']]`: `["nested", ["a", "b"]]`,
+	} {
+		v, err := parseTOMLValue(text)
+		if err != nil {
+			t.Errorf("%s: %v", text, err)
+			continue
+		}
+		if got := formatTOMLValue(v); got != want {
+			t.Errorf("%s: got %s, want %s", text, got, want)
+		}
+	}
+	for _, text := range []string{"", `"open`, `'open`, "[1, 2", "[1 2]", "nope", "1 2"} {
+		if _, err := parseTOMLValue(text); err == nil {
+			t.Errorf("%q: want an error", text)
+		}
+	}
+}
+
+func TestKataConfigKeyParse(t *testing.T) {
+	tests := []struct {
+		key   string
+		value string
+		want  string
+	}{
+		{"agent.debug_console_enabled", "true", "true"},
+		{"agent.debug_console_enabled", "0", "false"},
+		{"agent.debug_console_enabled", "yes", ""},
+		{"hypervisor.default_vcpus", "4", "4"},
+		{"hypervisor.default_vcpus", "four", ""},
+		{"hypervisor.kernel_params", `quiet console="hvc0"`, `"quiet console=\"hvc0\""`},
+		{"hypervisor.kernel_params", "a\nb", ""},
+		{"hypervisor.shared_fs", "virtio-fs", `"virtio-fs"`},
+		{"hypervisor.shared_fs", "nfs", ""},
+		{"agent.kernel_modules", "e1000, ,  nvme", `["e1000", "nvme"]`},
+		{"agent.kernel_modules", "", "[]"},
+	}
+	for _, tt := range tests {
+		key, err := lookupKataConfigKey(tt.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := key.parse(tt.key, tt.value)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s=%q: want an error, got %s", tt.key, tt.value, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s=%q: got %s (%v), want %s", tt.key, tt.value, got, err, tt.want)
+		}
+	}
+}
+
+func TestLookupKataConfigKey(t *testing.T) {
+	if _, err := lookupKataConfigKey("agent.debug_console"); err == nil || !strings.Contains(err.Error(), "agent.debug_console_enabled") {
+		t.Errorf("want the known agent keys, got %v", err)
+	}
+	if _, err := lookupKataConfigKey("qemu.path"); err == nil || !strings.Contains(err.Error(), "the sections are") {
+		t.Errorf("want the sections, got %v", err)
+	}
+}
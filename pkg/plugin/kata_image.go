@@ -0,0 +1,151 @@
+package plugin
+
+import (
+	"github.com/Tim-0731-Hzt/knet/pkg/kube"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	apps_v1 "k8s.io/api/apps/v1"
+	api_v1 "k8s.io/api/core/v1"
+	"strings"
+)
+
+const (
+	// DefaultKataDeployImage is the kata-deploy image without a tag.
+	DefaultKataDeployImage = "docker.io/tim12312/kata-deploy"
+	DefaultKataDeployTag   = "latest"
+
+	// imageDigestAnnotation records on the kata-deploy DaemonSet the image
+	// digests its pods actually run.
+	imageDigestAnnotation = "knet.io/image-digest"
+)
+
+// KataDeployImage is the kata-deploy image used by deploy, delete and
+// config. Flags that are not given are taken from the image section of the
+// config file.
+type KataDeployImage struct {
+	Repository  string
+	Tag         string
+	Digest      string
+	PullPolicy  string
+	PullSecrets []string
+}
+
+// Complete fills in the settings of the config file for flags that were not
+// given.
+func (i *KataDeployImage) Complete(cmd *cobra.Command) {
+	fill := func(flag string, key string, v *string) {
+		if !cmd.Flags().Changed(flag) && viper.IsSet(key) {
+			*v = viper.GetString(key)
+		}
+	}
+	fill("image", "image.repository", &i.Repository)
+	fill("tag", "image.tag", &i.Tag)
+	fill("digest", "image.digest", &i.Digest)
+	fill("image-pull-policy", "image.pullPolicy", &i.PullPolicy)
+	if !cmd.Flags().Changed("image-pull-secret") && viper.IsSet("image.pullSecrets") {
+		i.PullSecrets = viper.GetStringSlice("image.pullSecrets")
+	}
+}
+
+func (i *KataDeployImage) Validate() error {
+	switch api_v1.PullPolicy(i.PullPolicy) {
+	case api_v1.PullAlways, api_v1.PullIfNotPresent, api_v1.PullNever:
+	default:
+		return errors.Errorf("invalid image pull policy %q, use Always, IfNotPresent or Never", i.PullPolicy)
+	}
+	if i.Digest != "" && !strings.HasPrefix(i.Digest, "sha256:") {
+		return errors.Errorf("invalid image digest %q, expected sha256:...", i.Digest)
+	}
+	if i.Digest != "" && strings.Contains(i.Repository, "@") {
+		return errors.New("the image already has a digest, drop --digest")
+	}
+	return nil
+}
+
+// validatePullSecrets checks that the pull secrets exist next to the
+// DaemonSets.
+func (i *KataDeployImage) validatePullSecrets(kubeService *kube.KubernetesApiServiceImpl) error {
+	for _, s := range i.PullSecrets {
+		if _, err := kubeService.GetSecret("kube-system", s); err != nil {
+			return errors.Wrapf(err, "image pull secret %s", s)
+		}
+	}
+	return nil
+}
+
+// Reference returns the image reference, a digest wins over the tag and a
+// tag or digest in the repository wins over both.
+func (i *KataDeployImage) Reference() string {
+	if strings.Contains(i.Repository, "@") {
+		return i.Repository
+	}
+	repository := i.Repository
+	tagged := strings.LastIndex(repository, ":") > strings.LastIndex(repository, "/")
+	if i.Digest != "" {
+		if tagged {
+			repository = repository[:strings.LastIndex(repository, ":")]
+		}
+		return repository + "@" + i.Digest
+	}
+	if tagged {
+		return repository
+	}
+	return repository + ":" + i.Tag
+}
+
+// apply returns a copy of the DaemonSet running the image.
+func (i *KataDeployImage) apply(d *apps_v1.DaemonSet) *apps_v1.DaemonSet {
+	d = d.DeepCopy()
+	spec := &d.Spec.Template.Spec
+	for c := range spec.Containers {
+		spec.Containers[c].Image = i.Reference()
+		spec.Containers[c].ImagePullPolicy = api_v1.PullPolicy(i.PullPolicy)
+	}
+	for _, s := range i.PullSecrets {
+		spec.ImagePullSecrets = append(spec.ImagePullSecrets, api_v1.LocalObjectReference{Name: s})
+	}
+	return d
+}
+
+// recordImageDigest annotates the DaemonSet with the digests of the image
+// its pods run, a moving tag can resolve to different digests on different
+// nodes.
+func recordImageDigest(kubeService *kube.KubernetesApiServiceImpl, name string) error {
+	pods, err := kubeService.ListDeployPods("name=" + name)
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	var digests []string
+	for _, pod := range pods {
+		for _, s := range pod.Status.ContainerStatuses {
+			if d := imageDigest(s.ImageID); d != "" && !seen[d] {
+				seen[d] = true
+				digests = append(digests, d)
+			}
+		}
+	}
+	if len(digests) == 0 {
+		log.Warnf("no image digest reported by the %s pods", name)
+		return nil
+	}
+	if len(digests) > 1 {
+		log.Warnf("%s pods run different images: %s", name, strings.Join(digests, ", "))
+	}
+	log.Infof("%s runs %s", name, strings.Join(digests, ", "))
+	return kubeService.AnnotateDaemonSet(name, map[string]string{imageDigestAnnotation: strings.Join(digests, ",")})
+}
+
+// imageDigest extracts the digest from a container status image ID such as
+// docker.io/library/busybox@sha256:... or docker-pullable://...@sha256:...
+func imageDigest(imageID string) string {
+	if i := strings.LastIndex(imageID, "@"); i >= 0 {
+		return imageID[i+1:]
+	}
+	if strings.HasPrefix(imageID, "sha256:") {
+		return imageID
+	}
+	return ""
+}
@@ -0,0 +1,170 @@
+package plugin
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/pmezard/go-difflib/difflib"
+	"io"
+	api_v1 "k8s.io/api/core/v1"
+	node_v1 "k8s.io/api/node/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/cli-runtime/pkg/printers"
+	"k8s.io/client-go/kubernetes/scheme"
+	"os"
+	"path/filepath"
+	"sigs.k8s.io/yaml"
+	"strings"
+)
+
+// Dry run modes of deploy and delete, like kubectl's --dry-run.
+const (
+	dryRunNone   = "none"
+	dryRunClient = "client"
+	dryRunServer = "server"
+)
+
+func validateDryRun(mode string) error {
+	switch mode {
+	case dryRunNone, dryRunClient, dryRunServer:
+		return nil
+	}
+	return errors.Errorf("invalid dry run %q, use none, client or server", mode)
+}
+
+// kataObjects returns the objects deploy creates, with the image and
+// hypervisor selection applied.
+func kataObjects(image *KataDeployImage, hypervisors *Hypervisors) ([]runtime.Object, error) {
+	objects := []runtime.Object{
+		serviceAccount.DeepCopy(),
+		clusterRole.DeepCopy(),
+		clusterRoleBinding.DeepCopy(),
+		hypervisors.apply(image.apply(daemonSetDeployment)),
+	}
+	for _, class := range hypervisors.classes {
+		objects = append(objects, class.DeepCopy())
+	}
+	for _, obj := range objects {
+		kinds, _, err := scheme.Scheme.ObjectKinds(obj)
+		if err != nil {
+			return nil, err
+		}
+		obj.GetObjectKind().SetGroupVersionKind(kinds[0])
+	}
+	return objects, nil
+}
+
+// splitRuntimeClasses separates the objects kata-deploy needs from the
+// RuntimeClasses, which are only applied once kata runs on the nodes.
+func splitRuntimeClasses(objects []runtime.Object) ([]runtime.Object, []runtime.Object) {
+	var deploy, classes []runtime.Object
+	for _, obj := range objects {
+		if _, ok := obj.(*node_v1.RuntimeClass); ok {
+			classes = append(classes, obj)
+			continue
+		}
+		deploy = append(deploy, obj)
+	}
+	return deploy, classes
+}
+
+// objectName returns kind/name, e.g. daemonset/kata-deploy.
+func objectName(obj runtime.Object) string {
+	name := ""
+	if accessor, err := meta.Accessor(obj); err == nil {
+		name = accessor.GetName()
+	}
+	return strings.ToLower(obj.GetObjectKind().GroupVersionKind().Kind) + "/" + name
+}
+
+// splitObjectName splits kind/name.
+func splitObjectName(kindName string) (string, string) {
+	parts := strings.SplitN(kindName, "/", 2)
+	if len(parts) != 2 {
+		return kindName, ""
+	}
+	return parts[0], parts[1]
+}
+
+// objectDiff returns a unified diff of two versions of an object, leaving out
+// the fields maintained by the API server.
+func objectDiff(name string, live runtime.Object, desired runtime.Object) (string, error) {
+	var texts []string
+	for _, obj := range []runtime.Object{live, desired} {
+		u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+		if err != nil {
+			return "", err
+		}
+		// typed clients drop apiVersion and kind
+		for _, f := range []string{"status", "apiVersion", "kind"} {
+			delete(u, f)
+		}
+		if metadata, ok := u["metadata"].(map[string]interface{}); ok {
+			for _, f := range []string{"managedFields", "resourceVersion", "generation", "uid", "creationTimestamp", "selfLink"} {
+				delete(metadata, f)
+			}
+		}
+		data, err := yaml.Marshal(u)
+		if err != nil {
+			return "", err
+		}
+		texts = append(texts, string(data))
+	}
+	if texts[0] == texts[1] {
+		return "", nil
+	}
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(texts[0]),
+		B:        difflib.SplitLines(texts[1]),
+		FromFile: name + " (live)",
+		ToFile:   name + " (applied)",
+		Context:  3,
+	})
+}
+
+// printObjects writes the objects as a YAML stream or a JSON List.
+func printObjects(w io.Writer, objects []runtime.Object, output string) error {
+	switch output {
+	case "yaml":
+		printer := &printers.YAMLPrinter{}
+		for _, obj := range objects {
+			if err := printer.PrintObj(obj, w); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "json":
+		list := &api_v1.List{}
+		list.SetGroupVersionKind(api_v1.SchemeGroupVersion.WithKind("List"))
+		for _, obj := range objects {
+			list.Items = append(list.Items, runtime.RawExtension{Object: obj})
+		}
+		return (&printers.JSONPrinter{}).PrintObj(list, w)
+	}
+	return errors.Errorf("invalid output %q, use yaml, json or kustomize", output)
+}
+
+// writeKustomization writes every object to a file of its own in dir and a
+// kustomization.yaml listing them.
+func writeKustomization(dir string, objects []runtime.Object) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	kustomization := "apiVersion: kustomize.config.k8s.io/v1beta1\nkind: Kustomization\nresources:\n"
+	for _, obj := range objects {
+		name := strings.Replace(objectName(obj), "/", "-", 1) + ".yaml"
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		err = printObjects(f, []runtime.Object{obj}, "yaml")
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to write %s", name)
+		}
+		kustomization += fmt.Sprintf("- %s\n", name)
+	}
+	return os.WriteFile(filepath.Join(dir, "kustomization.yaml"), []byte(kustomization), 0644)
+}
@@ -0,0 +1,46 @@
+package plugin
+
+import (
+	"bytes"
+	"github.com/Tim-0731-Hzt/knet/pkg/kube"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	"strings"
+)
+
+// readNodeFile reads a file of the node through its kata-deploy pod.
+func readNodeFile(kubeService *kube.KubernetesApiServiceImpl, deployPod *v1.Pod, path string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	readRequest := kube.ExecCommandRequest{
+		PodName:   deployPod.Name,
+		Namespace: deployPod.Namespace,
+		Container: "kube-kata",
+		Command:   []string{"cat", path},
+		StdOut:    &stdout,
+		StdErr:    &stderr,
+	}
+	if _, err := kubeService.ExecuteCommand(readRequest); err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s on node %s: %s", path, deployPod.Spec.NodeName, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// writeNodeFile replaces a file of the node through its kata-deploy pod.
+// The content is written next to the file first, so a failed transfer never
+// leaves a truncated configuration behind. Symlinks are resolved first and
+// the file they point to is replaced, the link itself stays in place.
+func writeNodeFile(kubeService *kube.KubernetesApiServiceImpl, deployPod *v1.Pod, path string, data []byte) error {
+	var stderr bytes.Buffer
+	writeRequest := kube.ExecCommandRequest{
+		PodName:   deployPod.Name,
+		Namespace: deployPod.Namespace,
+		Container: "kube-kata",
+		Command:   []string{"sh", "-c", `f=$(readlink -f "$1") && cat >"$f.knet" && mv "$f.knet" "$f"`, "sh", path},
+		StdIn:     bytes.NewReader(data),
+		StdErr:    &stderr,
+	}
+	if _, err := kubeService.ExecuteCommand(writeRequest); err != nil {
+		return errors.Wrapf(err, "failed to write %s on node %s: %s", path, deployPod.Spec.NodeName, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
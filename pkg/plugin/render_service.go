@@ -0,0 +1,64 @@
+package plugin
+
+import (
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+)
+
+// RenderService prints the objects deploy would create instead of creating
+// them, so they can be reviewed or handed to a GitOps pipeline. It does not
+// need access to the cluster.
+type RenderService struct {
+	Image       KataDeployImage
+	Hypervisors Hypervisors
+	Output      string
+	OutputDir   string
+	out         io.Writer
+}
+
+func NewRenderService() *RenderService {
+	return &RenderService{out: os.Stdout}
+}
+
+func (r *RenderService) Complete(cmd *cobra.Command, args []string) error {
+	r.Image.Complete(cmd)
+	return nil
+}
+
+func (r *RenderService) Validate() error {
+	switch r.Output {
+	case "yaml", "json":
+	case "kustomize":
+		if r.OutputDir == "" {
+			return errors.New("-o kustomize needs --output-dir")
+		}
+	default:
+		return errors.Errorf("invalid output %q, use yaml, json or kustomize", r.Output)
+	}
+	if err := r.Image.Validate(); err != nil {
+		return err
+	}
+	return r.Hypervisors.Validate()
+}
+
+func (r *RenderService) Run() error {
+	objects, err := kataObjects(&r.Image, &r.Hypervisors)
+	if err != nil {
+		return err
+	}
+	if r.Output != "kustomize" {
+		return printObjects(r.out, objects, r.Output)
+	}
+	if err := writeKustomization(r.OutputDir, objects); err != nil {
+		return err
+	}
+	log.Infof("wrote %d objects to %s, kata-deploy runs on nodes labeled %s=true", len(objects), r.OutputDir, deployNodeLabel)
+	return nil
+}
+
+func (r *RenderService) cleanup() error {
+	return nil
+}
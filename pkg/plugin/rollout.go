@@ -0,0 +1,185 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"github.com/Tim-0731-Hzt/knet/pkg/kube"
+	"github.com/Tim-0731-Hzt/knet/pkg/wait"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// deployNodeLabel selects the nodes the kata-deploy DaemonSet runs on.
+	deployNodeLabel = "knet.io/kata-deploy"
+	// kataRuntimeLabel is set by kata-deploy once kata is installed.
+	kataRuntimeLabel = "katacontainers.io/kata-runtime"
+)
+
+// Rollout selects the nodes kata is deployed to and how many of them are
+// switched on at a time.
+type Rollout struct {
+	NodeSelector string
+	Nodes        []string
+	Canary       int
+	BatchSize    int
+}
+
+func (r *Rollout) Validate() error {
+	if _, err := labels.Parse(r.NodeSelector); err != nil {
+		return errors.Wrap(err, "invalid node selector")
+	}
+	if r.Canary < 0 || r.BatchSize < 0 {
+		return errors.New("--canary and --batch-size must not be negative")
+	}
+	if r.Canary > 0 && r.BatchSize > 0 {
+		return errors.New("use either --canary or --batch-size")
+	}
+	return nil
+}
+
+// targets returns the selected nodes that are not labeled for kata-deploy
+// yet, ordered by name.
+func (r *Rollout) targets(kubeService *kube.KubernetesApiServiceImpl) ([]string, error) {
+	nodes, err := kubeService.ListNodes(r.NodeSelector)
+	if err != nil {
+		return nil, err
+	}
+	selected := make(map[string]bool)
+	for _, n := range nodes {
+		selected[n.Name] = n.Labels[deployNodeLabel] != "true"
+	}
+	var names []string
+	if len(r.Nodes) > 0 {
+		for _, n := range r.Nodes {
+			pending, ok := selected[n]
+			if !ok {
+				return nil, errors.Errorf("node %s does not exist or does not match the node selector", n)
+			}
+			if pending {
+				names = append(names, n)
+			}
+		}
+	} else {
+		for n, pending := range selected {
+			if pending {
+				names = append(names, n)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// unlabeledDeployNodes returns the nodes running a kata-deploy pod without
+// carrying deployNodeLabel, as left by a kata-deploy applied without the
+// node selector. Applying the DaemonSet with it would remove kata from them.
+func unlabeledDeployNodes(kubeService *kube.KubernetesApiServiceImpl) ([]string, error) {
+	nodes, err := kubeService.ListNodes("")
+	if err != nil {
+		return nil, err
+	}
+	labeled := make(map[string]bool)
+	for _, n := range nodes {
+		labeled[n.Name] = n.Labels[deployNodeLabel] == "true"
+	}
+	pods, err := kubeService.ListDeployPods("name=kata-deploy")
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, pod := range pods {
+		n := pod.Spec.NodeName
+		if isLabeled, ok := labeled[n]; ok && !isLabeled && !containsString(names, n) {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// labelDeployNodes labels nodes that already run kata-deploy, they keep
+// their pod so there is nothing to wait for.
+func labelDeployNodes(kubeService *kube.KubernetesApiServiceImpl, nodes []string) error {
+	label := "true"
+	for _, n := range nodes {
+		if err := kubeService.LabelNode(n, deployNodeLabel, &label); err != nil {
+			return errors.Wrapf(err, "failed to label node %s", n)
+		}
+		log.Infof("node/%s already runs kata-deploy, labeled %s=true", n, deployNodeLabel)
+	}
+	return nil
+}
+
+// batches splits the nodes up, a canary rollout only returns the canary
+// batch.
+func (r *Rollout) batches(nodes []string) [][]string {
+	size := len(nodes)
+	if r.Canary > 0 {
+		if r.Canary < len(nodes) {
+			return [][]string{nodes[:r.Canary]}
+		}
+		return [][]string{nodes}
+	}
+	if r.BatchSize > 0 {
+		size = r.BatchSize
+	}
+	var batches [][]string
+	for len(nodes) > 0 {
+		n := size
+		if n > len(nodes) {
+			n = len(nodes)
+		}
+		batches = append(batches, nodes[:n])
+		nodes = nodes[n:]
+	}
+	return batches
+}
+
+// rollout labels the nodes batch by batch and waits for kata to be installed
+// on every batch before moving on. labeling is called before a node is
+// labeled.
+func (r *Rollout) rollout(ctx context.Context, kubeService *kube.KubernetesApiServiceImpl, nodes []string, timeout time.Duration, labeling func(string) error) error {
+	waiter := kubeService.Waiter(timeout)
+	label := "true"
+	batches := r.batches(nodes)
+	for i, batch := range batches {
+		log.Infof("batch %d/%d: installing kata on %s", i+1, len(batches), strings.Join(batch, ", "))
+		for _, n := range batch {
+			if err := labeling(n); err != nil {
+				return err
+			}
+			if err := kubeService.LabelNode(n, deployNodeLabel, &label); err != nil {
+				return errors.Wrapf(err, "failed to label node %s", n)
+			}
+		}
+		if err := waiter.Nodes(ctx, "name=kata-deploy", batch, kataInstalled); err != nil {
+			return errors.Wrapf(err, "batch %d/%d failed, the remaining nodes were left alone", i+1, len(batches))
+		}
+	}
+	if r.Canary > 0 && len(nodes) > r.Canary {
+		log.Warnf("canary nodes are ready, run deploy again without --canary to install kata on the other %d nodes", len(nodes)-r.Canary)
+	}
+	return nil
+}
+
+// kataInstalled is done once the kata-deploy pod of the node is ready and
+// kata-deploy reported the node healthy by labeling it.
+func kataInstalled(node *v1.Node, pod *v1.Pod) string {
+	switch {
+	case node == nil:
+		return "node not found"
+	case pod == nil:
+		return "no kata-deploy pod scheduled"
+	case !wait.PodReady(pod):
+		return fmt.Sprintf("pod %s is not ready: %s", pod.Name, wait.ContainerState(pod))
+	case node.Labels[kataRuntimeLabel] != "true":
+		return fmt.Sprintf("%s label not set", kataRuntimeLabel)
+	}
+	return ""
+}
@@ -0,0 +1,52 @@
+package plugin
+
+import (
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	"strings"
+)
+
+// CRI sockets as seen from the kata-deploy pod, which mounts the host's /run.
+const (
+	containerdSocket    = "unix:///run/containerd/containerd.sock"
+	k3sContainerdSocket = "unix:///run/k3s/containerd/containerd.sock"
+	crioSocket          = "unix:///run/crio/crio.sock"
+)
+
+// containerRuntime is the CRI implementation running a container.
+type containerRuntime struct {
+	// Name is the scheme of the container ID, e.g. containerd or cri-o.
+	Name string
+	// ContainerID is the container ID without the runtime scheme.
+	ContainerID string
+	// Endpoints are the candidate CRI sockets, most likely first.
+	Endpoints []string
+}
+
+// detectContainerRuntime derives the runtime from the container ID scheme
+// and the node's reported runtime version. k3s and rke2 run an embedded
+// containerd with its own socket.
+func detectContainerRuntime(containerID string, node *v1.Node) (*containerRuntime, error) {
+	parts := strings.SplitN(containerID, "://", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, errors.Errorf("container id %q has no runtime scheme, is the container running?", containerID)
+	}
+	r := &containerRuntime{Name: parts[0], ContainerID: parts[1]}
+	version := node.Status.NodeInfo.ContainerRuntimeVersion
+	if !strings.HasPrefix(version, r.Name+"://") {
+		return nil, errors.Errorf("container %s runs under %s but node %s reports runtime %s", r.ContainerID, r.Name, node.Name, version)
+	}
+	switch r.Name {
+	case "containerd":
+		if strings.Contains(version, "k3s") || strings.Contains(version, "rke2") {
+			r.Endpoints = []string{k3sContainerdSocket, containerdSocket}
+		} else {
+			r.Endpoints = []string{containerdSocket, k3sContainerdSocket}
+		}
+	case "cri-o":
+		r.Endpoints = []string{crioSocket}
+	default:
+		return nil, errors.Errorf("container runtime %s of node %s does not support kata containers", version, node.Name)
+	}
+	return r, nil
+}
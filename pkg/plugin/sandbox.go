@@ -0,0 +1,153 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/Tim-0731-Hzt/knet/pkg/kube"
+	"github.com/pkg/errors"
+	"path"
+	"strings"
+)
+
+// kataConfigDir is where kata-deploy installs the runtime configurations.
+const kataConfigDir = "/opt/kata/share/defaults/kata-containers"
+
+var (
+	// ErrNotKata is returned when the pod's sandbox is not run by kata.
+	ErrNotKata = errors.New("pod is not running under kata")
+	// ErrSandboxNotFound is returned when the runtime does not know the
+	// container or its sandbox.
+	ErrSandboxNotFound = errors.New("sandbox not found")
+	// ErrSandboxNotReady is returned when the sandbox exists but is not
+	// running.
+	ErrSandboxNotReady = errors.New("sandbox is not ready")
+)
+
+// sandbox is the pod sandbox of a container as reported by the CRI.
+type sandbox struct {
+	ID               string
+	RuntimeHandler   string
+	NetworkNamespace string
+}
+
+// hypervisor returns the hypervisor of the runtime handler, qemu for
+// kata-qemu, or an empty string for the default kata handler.
+func (s *sandbox) hypervisor() string {
+	return strings.TrimPrefix(strings.TrimPrefix(s.RuntimeHandler, "kata"), "-")
+}
+
+// configPath returns the kata configuration the sandbox was started with.
+func (s *sandbox) configPath() string {
+	if h := s.hypervisor(); h != "" {
+		return kataConfigPath(h)
+	}
+	return path.Join(kataConfigDir, "configuration.toml")
+}
+
+// crictlContainer is the part of `crictl inspect -o json` knet uses. Both
+// containerd and CRI-O report the sandbox ID in the verbose info.
+type crictlContainer struct {
+	Info struct {
+		SandboxID string `json:"sandboxID"`
+	} `json:"info"`
+}
+
+// crictlSandbox is the part of `crictl inspectp -o json` knet uses.
+type crictlSandbox struct {
+	Status struct {
+		ID             string `json:"id"`
+		State          string `json:"state"`
+		RuntimeHandler string `json:"runtimeHandler"`
+	} `json:"status"`
+	Info struct {
+		RuntimeHandler string `json:"runtimeHandler"`
+		RuntimeType    string `json:"runtimeType"`
+		RuntimeSpec    struct {
+			Linux struct {
+				Namespaces []struct {
+					Type string `json:"type"`
+					Path string `json:"path"`
+				} `json:"namespaces"`
+			} `json:"linux"`
+		} `json:"runtimeSpec"`
+	} `json:"info"`
+}
+
+// crictlRunner runs crictl with the arguments and returns its output.
+type crictlRunner func(args ...string) ([]byte, error)
+
+// lookupSandbox asks the node's CRI through crictl in the kata-deploy pod for
+// the sandbox of the container and checks that kata runs it.
+func (e *ExecService) lookupSandbox(endpoint string, containerID string) (*sandbox, error) {
+	return findSandbox(func(args ...string) ([]byte, error) {
+		return e.crictl(endpoint, args...)
+	}, containerID)
+}
+
+// findSandbox looks the sandbox of the container up through crictl.
+func findSandbox(crictl crictlRunner, containerID string) (*sandbox, error) {
+	var container crictlContainer
+	if err := decodeCrictl(crictl, &container, "inspect", "-o", "json", containerID); err != nil {
+		return nil, err
+	}
+	if container.Info.SandboxID == "" {
+		return nil, errors.Wrapf(ErrSandboxNotFound, "container %s", containerID)
+	}
+
+	var pod crictlSandbox
+	if err := decodeCrictl(crictl, &pod, "inspectp", "-o", "json", container.Info.SandboxID); err != nil {
+		return nil, err
+	}
+	if pod.Status.ID == "" {
+		return nil, errors.Wrapf(ErrSandboxNotFound, "sandbox %s", container.Info.SandboxID)
+	}
+	if pod.Status.State != "SANDBOX_READY" {
+		return nil, errors.Wrapf(ErrSandboxNotReady, "sandbox %s is %s", pod.Status.ID, pod.Status.State)
+	}
+	s := &sandbox{ID: pod.Status.ID, RuntimeHandler: pod.Status.RuntimeHandler}
+	if s.RuntimeHandler == "" {
+		s.RuntimeHandler = pod.Info.RuntimeHandler
+	}
+	if !strings.Contains(s.RuntimeHandler, "kata") && !strings.Contains(pod.Info.RuntimeType, "kata") {
+		return nil, errors.Wrapf(ErrNotKata, "sandbox %s uses runtime handler %q", s.ID, s.RuntimeHandler)
+	}
+	for _, ns := range pod.Info.RuntimeSpec.Linux.Namespaces {
+		if ns.Type == "network" {
+			s.NetworkNamespace = ns.Path
+		}
+	}
+	return s, nil
+}
+
+// decodeCrictl runs crictl and decodes its JSON output.
+func decodeCrictl(crictl crictlRunner, v interface{}, args ...string) error {
+	out, err := crictl(args...)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(out, v); err != nil {
+		return errors.Wrapf(err, "failed to decode output of crictl %s", strings.Join(args, " "))
+	}
+	return nil
+}
+
+// crictl runs crictl in the kata-deploy pod.
+func (e *ExecService) crictl(endpoint string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	crictlRequest := kube.ExecCommandRequest{
+		PodName:   e.deployPod.Name,
+		Namespace: e.deployPod.Namespace,
+		Container: "kube-kata",
+		Command:   append([]string{"crictl", "--runtime-endpoint", endpoint}, args...),
+		StdOut:    &stdout,
+		StdErr:    &stderr,
+	}
+	if _, err := e.kubeService.ExecuteCommand(crictlRequest); err != nil {
+		message := strings.TrimSpace(stderr.String())
+		if strings.Contains(strings.ToLower(message), "not found") {
+			return nil, errors.Wrap(ErrSandboxNotFound, message)
+		}
+		return nil, errors.Wrapf(err, "crictl %s failed: %s", strings.Join(args, " "), message)
+	}
+	return stdout.Bytes(), nil
+}
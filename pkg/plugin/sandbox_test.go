@@ -0,0 +1,205 @@
+package plugin
+
+import (
+	"github.com/pkg/errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// containerdInspect is `crictl inspect -o json` of containerd 1.6.
+const containerdInspect = `{
+  "status": {
+    "id": "4c5e0a6b2f0e",
+    "metadata": {"attempt": 0, "name": "nginx"},
+    "state": "CONTAINER_RUNNING",
+    "createdAt": "2023-03-01T10:00:01.123456789Z",
+    "startedAt": "2023-03-01T10:00:02.123456789Z",
+    "image": {"annotations": {}, "image": "docker.io/library/nginx:latest"},
+    "labels": {"io.kubernetes.container.name": "nginx", "io.kubernetes.pod.name": "nginx", "io.kubernetes.pod.namespace": "default"},
+    "mounts": [],
+    "logPath": "/var/log/pods/default_nginx_0c1d/nginx/0.log"
+  },
+  "info": {
+    "sandboxID": "9f3d8c7b6a5e",
+    "pid": 4242,
+    "removing": false,
+    "snapshotKey": "4c5e0a6b2f0e",
+    "snapshotter": "overlayfs",
+    "runtimeType": "io.containerd.kata-qemu.v2",
+    "runtimeOptions": null,
+    "config": {"metadata": {"name": "nginx"}, "image": {"image": "sha256:ac8efec8"}},
+    "runtimeSpec": {"ociVersion": "1.0.2-dev", "process": {"args": ["nginx", "-g", "daemon off;"]}}
+  }
+}`
+
+// containerdInspectp is `crictl inspectp -o json` of containerd 1.6.
+const containerdInspectp = `{
+  "status": {
+    "id": "9f3d8c7b6a5e",
+    "metadata": {"attempt": 0, "name": "nginx", "namespace": "default", "uid": "0c1d"},
+    "state": "SANDBOX_READY",
+    "createdAt": "2023-03-01T10:00:00.123456789Z",
+    "network": {"additionalIps": [], "ip": "10.244.1.5"},
+    "linux": {"namespaces": {"options": {"ipc": "POD", "network": "POD", "pid": "CONTAINER", "targetId": ""}}},
+    "labels": {"io.kubernetes.pod.name": "nginx"},
+    "annotations": {},
+    "runtimeHandler": "kata-qemu"
+  },
+  "info": {
+    "pid": 4200,
+    "processStatus": "running",
+    "netNamespaceClosed": false,
+    "image": "registry.k8s.io/pause:3.6",
+    "snapshotKey": "9f3d8c7b6a5e",
+    "snapshotter": "overlayfs",
+    "runtimeHandler": "kata-qemu",
+    "runtimeType": "io.containerd.kata-qemu.v2",
+    "runtimeOptions": null,
+    "config": {"metadata": {"name": "nginx"}},
+    "runtimeSpec": {
+      "ociVersion": "1.0.2-dev",
+      "linux": {
+        "namespaces": [
+          {"type": "pid"},
+          {"type": "ipc"},
+          {"type": "uts"},
+          {"type": "mount"},
+          {"type": "network", "path": "/var/run/netns/cni-7d2c5a1e-0b3f-4c6d-9e8f-1a2b3c4d5e6f"}
+        ]
+      }
+    }
+  }
+}`
+
+// crioInspect is `crictl inspect -o json` of CRI-O 1.25.
+const crioInspect = `{
+  "status": {
+    "id": "b1c2d3e4f5a6",
+    "metadata": {"attempt": 0, "name": "nginx"},
+    "state": "CONTAINER_RUNNING",
+    "createdAt": "2023-03-01T10:00:01.123456789Z",
+    "image": {"image": "docker.io/library/nginx:latest"},
+    "imageRef": "docker.io/library/nginx@sha256:aa0afebb",
+    "labels": {"io.kubernetes.container.name": "nginx"},
+    "annotations": {},
+    "mounts": [],
+    "logPath": "/var/log/pods/default_nginx_0c1d/nginx/0.log"
+  },
+  "info": {
+    "sandboxID": "e6f5a4b3c2d1",
+    "pid": 5151,
+    "privileged": false,
+    "runtimeSpec": {"ociVersion": "1.0.2-dev", "process": {"args": ["nginx"]}}
+  }
+}`
+
+// crioInspectp is `crictl inspectp -o json` of CRI-O 1.25.
+const crioInspectp = `{
+  "status": {
+    "id": "e6f5a4b3c2d1",
+    "metadata": {"attempt": 0, "name": "nginx", "namespace": "default", "uid": "0c1d"},
+    "state": "SANDBOX_READY",
+    "createdAt": "2023-03-01T10:00:00.123456789Z",
+    "network": {"additionalIps": [], "ip": "10.85.0.12"},
+    "linux": {"namespaces": {"options": {"ipc": "POD", "network": "POD", "pid": "CONTAINER"}}},
+    "labels": {"io.kubernetes.pod.name": "nginx"},
+    "annotations": {},
+    "runtimeHandler": "kata"
+  },
+  "info": {
+    "image": "registry.k8s.io/pause:3.6",
+    "pid": 5100,
+    "runtimeSpec": {
+      "ociVersion": "1.0.2-dev",
+      "linux": {
+        "namespaces": [
+          {"type": "pid"},
+          {"type": "network", "path": "/var/run/netns/0a1b2c3d-4e5f-6a7b-8c9d-0e1f2a3b4c5d"},
+          {"type": "ipc", "path": "/var/run/ipcns/0a1b2c3d"}
+        ]
+      }
+    }
+  }
+}`
+
+// crictlOutputs answers crictl with the output for its last argument, the
+// container or sandbox ID.
+func crictlOutputs(outputs map[string]string) crictlRunner {
+	return func(args ...string) ([]byte, error) {
+		out, ok := outputs[args[len(args)-1]]
+		if !ok {
+			return nil, errors.Errorf("unexpected crictl %s", strings.Join(args, " "))
+		}
+		return []byte(out), nil
+	}
+}
+
+func TestFindSandbox(t *testing.T) {
+	tests := []struct {
+		name        string
+		containerID string
+		outputs     map[string]string
+		sandbox     *sandbox
+		err         error
+		message     string
+	}{
+		{"containerd", "4c5e0a6b2f0e", map[string]string{"4c5e0a6b2f0e": containerdInspect, "9f3d8c7b6a5e": containerdInspectp},
+			&sandbox{ID: "9f3d8c7b6a5e", RuntimeHandler: "kata-qemu", NetworkNamespace: "/var/run/netns/cni-7d2c5a1e-0b3f-4c6d-9e8f-1a2b3c4d5e6f"}, nil, ""},
+		{"cri-o", "b1c2d3e4f5a6", map[string]string{"b1c2d3e4f5a6": crioInspect, "e6f5a4b3c2d1": crioInspectp},
+			&sandbox{ID: "e6f5a4b3c2d1", RuntimeHandler: "kata", NetworkNamespace: "/var/run/netns/0a1b2c3d-4e5f-6a7b-8c9d-0e1f2a3b4c5d"}, nil, ""},
+		{"handler from info", "4c5e0a6b2f0e", map[string]string{"4c5e0a6b2f0e": containerdInspect,
+			"9f3d8c7b6a5e": strings.Replace(containerdInspectp, `"annotations": {},
+    "runtimeHandler": "kata-qemu"`, `"annotations": {}`, 1)},
+			&sandbox{ID: "9f3d8c7b6a5e", RuntimeHandler: "kata-qemu", NetworkNamespace: "/var/run/netns/cni-7d2c5a1e-0b3f-4c6d-9e8f-1a2b3c4d5e6f"}, nil, ""},
+		{"runc", "4c5e0a6b2f0e", map[string]string{"4c5e0a6b2f0e": containerdInspect,
+			"9f3d8c7b6a5e": strings.NewReplacer(`"kata-qemu"`, `"runc"`, "io.containerd.kata-qemu.v2", "io.containerd.runc.v2").Replace(containerdInspectp)},
+			nil, ErrNotKata, `sandbox 9f3d8c7b6a5e uses runtime handler "runc"`},
+		{"cri-o default handler", "b1c2d3e4f5a6", map[string]string{"b1c2d3e4f5a6": crioInspect,
+			"e6f5a4b3c2d1": strings.Replace(crioInspectp, `"runtimeHandler": "kata"`, `"runtimeHandler": ""`, 1)},
+			nil, ErrNotKata, `uses runtime handler ""`},
+		{"no sandbox ID", "b1c2d3e4f5a6", map[string]string{"b1c2d3e4f5a6": `{"status": {"id": "b1c2d3e4f5a6"}}`},
+			nil, ErrSandboxNotFound, "container b1c2d3e4f5a6"},
+		{"sandbox gone", "b1c2d3e4f5a6", map[string]string{"b1c2d3e4f5a6": crioInspect, "e6f5a4b3c2d1": `{}`},
+			nil, ErrSandboxNotFound, "sandbox e6f5a4b3c2d1"},
+		{"sandbox not ready", "b1c2d3e4f5a6", map[string]string{"b1c2d3e4f5a6": crioInspect,
+			"e6f5a4b3c2d1": strings.Replace(crioInspectp, "SANDBOX_READY", "SANDBOX_NOTREADY", 1)},
+			nil, ErrSandboxNotReady, "sandbox e6f5a4b3c2d1 is SANDBOX_NOTREADY"},
+		{"malformed container", "4c5e0a6b2f0e", map[string]string{"4c5e0a6b2f0e": containerdInspect[:100]},
+			nil, nil, "failed to decode output of crictl inspect -o json 4c5e0a6b2f0e"},
+		{"malformed sandbox", "4c5e0a6b2f0e", map[string]string{"4c5e0a6b2f0e": containerdInspect, "9f3d8c7b6a5e": "FATA[0000] no such sandbox"},
+			nil, nil, "failed to decode output of crictl inspectp -o json 9f3d8c7b6a5e"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := findSandbox(crictlOutputs(tt.outputs), tt.containerID)
+			if tt.message == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(s, tt.sandbox) {
+					t.Errorf("got %+v, want %+v", s, tt.sandbox)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.message) {
+				t.Fatalf("got %v, want %q", err, tt.message)
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Errorf("%v is not %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestSandboxConfigPath(t *testing.T) {
+	for handler, want := range map[string]string{
+		"kata":      kataConfigDir + "/configuration.toml",
+		"kata-qemu": kataConfigDir + "/configuration-qemu.toml",
+		"kata-clh":  kataConfigDir + "/configuration-clh.toml",
+	} {
+		if got := (&sandbox{RuntimeHandler: handler}).configPath(); got != want {
+			t.Errorf("%s: got %s, want %s", handler, got, want)
+		}
+	}
+}
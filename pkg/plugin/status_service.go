@@ -0,0 +1,385 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Tim-0731-Hzt/knet/pkg/kube"
+	"github.com/Tim-0731-Hzt/knet/pkg/wait"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"io"
+	v1 "k8s.io/api/core/v1"
+	node_v1 "k8s.io/api/node/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"os"
+	"regexp"
+	"sigs.k8s.io/yaml"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+// statusConcurrency bounds the kata-deploy pods exec'd into at a time.
+const statusConcurrency = 8
+
+// statusScript prints the kata version and then the configuration of the
+// container runtime, as seen from the kata-deploy pod.
+const statusScript = `/opt/kata/bin/kata-runtime --version 2>/dev/null | head -n 1
+echo ---
+case "$1" in
+containerd) cat /etc/containerd/config.toml /etc/containerd/conf.d/*.toml ;;
+cri-o) cat /etc/crio/crio.conf /etc/crio/crio.conf.d/* ;;
+esac 2>/dev/null
+true`
+
+// runtimeSection matches the runtime handlers of containerd
+// ([plugins."io.containerd.grpc.v1.cri".containerd.runtimes.kata-qemu]) and
+// CRI-O ([crio.runtime.runtimes.kata-qemu]) configurations.
+var runtimeSection = regexp.MustCompile(`(?m)^\s*\[.*\.runtimes\.["']?([\w-]+)["']?\]`)
+
+// Status is the kata installation of the cluster.
+type Status struct {
+	Image          string       `json:"image,omitempty"`
+	ImageDigests   string       `json:"imageDigests,omitempty"`
+	Hypervisors    []string     `json:"hypervisors,omitempty"`
+	RuntimeClasses []string     `json:"runtimeClasses"`
+	Nodes          []NodeStatus `json:"nodes"`
+}
+
+// NodeStatus is the kata installation of a node.
+type NodeStatus struct {
+	Name             string               `json:"name"`
+	KataRuntime      bool                 `json:"kataRuntime"`
+	Selected         bool                 `json:"selected"`
+	DeployPod        *DeployPodStatus     `json:"deployPod,omitempty"`
+	KataVersion      string               `json:"kataVersion,omitempty"`
+	ContainerRuntime string               `json:"containerRuntime"`
+	Handlers         []string             `json:"handlers"`
+	RuntimeClasses   []RuntimeClassStatus `json:"runtimeClasses"`
+	Error            string               `json:"error,omitempty"`
+}
+
+type DeployPodStatus struct {
+	Name     string `json:"name"`
+	Phase    string `json:"phase"`
+	Ready    bool   `json:"ready"`
+	Restarts int32  `json:"restarts"`
+}
+
+// RuntimeClassStatus tells whether pods of a kata RuntimeClass can run on a
+// node, and why not.
+type RuntimeClassStatus struct {
+	Name        string `json:"name"`
+	Handler     string `json:"handler"`
+	Schedulable bool   `json:"schedulable"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+type StatusService struct {
+	kubeService  *kube.KubernetesApiServiceImpl
+	NodeSelector string
+	Output       string
+	out          io.Writer
+}
+
+func NewStatusService() *StatusService {
+	return &StatusService{out: os.Stdout}
+}
+
+func (s *StatusService) Complete(cmd *cobra.Command, args []string) error {
+	var err error
+	s.kubeService, err = kube.NewKubernetesApiServiceImpl()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *StatusService) Validate() error {
+	switch s.Output {
+	case "table", "json", "yaml":
+	default:
+		return errors.Errorf("invalid output %q, use table, json or yaml", s.Output)
+	}
+	if _, err := labels.Parse(s.NodeSelector); err != nil {
+		return errors.Wrap(err, "invalid node selector")
+	}
+	return nil
+}
+
+func (s *StatusService) Run() error {
+	status, err := s.status()
+	if err != nil {
+		return err
+	}
+	switch s.Output {
+	case "json":
+		data, err := json.MarshalIndent(status, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(s.out, string(data))
+		return err
+	case "yaml":
+		data, err := yaml.Marshal(status)
+		if err != nil {
+			return err
+		}
+		_, err = s.out.Write(data)
+		return err
+	}
+	return s.printTable(status)
+}
+
+func (s *StatusService) status() (*Status, error) {
+	status := &Status{RuntimeClasses: []string{}}
+	if daemonSet, err := s.kubeService.GetDaemonSet("kata-deploy"); err == nil {
+		for _, c := range daemonSet.Spec.Template.Spec.Containers {
+			status.Image = c.Image
+		}
+		status.ImageDigests = daemonSet.Annotations[imageDigestAnnotation]
+		status.Hypervisors = hypervisorsOf(daemonSet)
+	} else {
+		log.WithError(err).Warnf("kata-deploy is not deployed")
+	}
+	classes, err := s.kubeService.ListRuntimeClasses()
+	if err != nil {
+		return nil, err
+	}
+	var kataClasses []node_v1.RuntimeClass
+	installed := make(map[string]bool)
+	for _, class := range classes {
+		if isKataRuntimeClass(&class) {
+			kataClasses = append(kataClasses, class)
+			status.RuntimeClasses = append(status.RuntimeClasses, class.Name)
+			installed[class.Name] = true
+		}
+	}
+	for _, h := range status.Hypervisors {
+		if !installed["kata-"+h] {
+			log.Warnf("RuntimeClass kata-%s of an installed hypervisor is missing", h)
+		}
+	}
+	nodes, err := s.kubeService.ListNodes(s.NodeSelector)
+	if err != nil {
+		return nil, err
+	}
+	pods, err := s.kubeService.ListDeployPods("name=kata-deploy")
+	if err != nil {
+		return nil, err
+	}
+	podOnNode := make(map[string]*v1.Pod)
+	for i := range pods {
+		podOnNode[pods[i].Spec.NodeName] = &pods[i]
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+	status.Nodes = make([]NodeStatus, len(nodes))
+	var wg sync.WaitGroup
+	limit := make(chan struct{}, statusConcurrency)
+	for i := range nodes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			limit <- struct{}{}
+			defer func() { <-limit }()
+			status.Nodes[i] = s.nodeStatus(&nodes[i], podOnNode[nodes[i].Name], kataClasses)
+		}(i)
+	}
+	wg.Wait()
+	return status, nil
+}
+
+func (s *StatusService) nodeStatus(node *v1.Node, pod *v1.Pod, classes []node_v1.RuntimeClass) NodeStatus {
+	status := NodeStatus{
+		Name:             node.Name,
+		KataRuntime:      node.Labels[kataRuntimeLabel] == "true",
+		Selected:         node.Labels[deployNodeLabel] == "true",
+		ContainerRuntime: node.Status.NodeInfo.ContainerRuntimeVersion,
+		Handlers:         []string{},
+		RuntimeClasses:   []RuntimeClassStatus{},
+	}
+	var handlers map[string]bool
+	if pod != nil {
+		status.DeployPod = &DeployPodStatus{Name: pod.Name, Phase: string(pod.Status.Phase), Ready: wait.PodReady(pod)}
+		for _, c := range pod.Status.ContainerStatuses {
+			status.DeployPod.Restarts += c.RestartCount
+		}
+		if pod.Status.Phase == v1.PodRunning {
+			version, configured, err := s.inspectNode(pod, node)
+			if err != nil {
+				status.Error = err.Error()
+			} else {
+				status.KataVersion, status.Handlers = version, configured
+				handlers = make(map[string]bool)
+				for _, h := range status.Handlers {
+					handlers[h] = true
+				}
+			}
+		}
+	}
+	for _, class := range classes {
+		reason := unschedulableReason(node, &class, handlers)
+		status.RuntimeClasses = append(status.RuntimeClasses, RuntimeClassStatus{
+			Name:        class.Name,
+			Handler:     class.Handler,
+			Schedulable: reason == "",
+			Reason:      reason,
+		})
+	}
+	return status
+}
+
+// inspectNode reads the kata version and the runtime handlers configured in
+// the container runtime of the node through its kata-deploy pod.
+func (s *StatusService) inspectNode(pod *v1.Pod, node *v1.Node) (string, []string, error) {
+	runtime := strings.SplitN(node.Status.NodeInfo.ContainerRuntimeVersion, "://", 2)[0]
+	var stdout, stderr bytes.Buffer
+	inspectRequest := kube.ExecCommandRequest{
+		PodName:   pod.Name,
+		Namespace: pod.Namespace,
+		Container: "kube-kata",
+		Command:   []string{"sh", "-c", statusScript, "sh", runtime},
+		StdOut:    &stdout,
+		StdErr:    &stderr,
+	}
+	if _, err := s.kubeService.ExecuteCommand(inspectRequest); err != nil {
+		return "", nil, errors.Wrapf(err, "failed to inspect node %s: %s", node.Name, strings.TrimSpace(stderr.String()))
+	}
+	version, handlers := parseStatusOutput(stdout.String())
+	return version, handlers, nil
+}
+
+// parseStatusOutput splits the output of statusScript into the kata version
+// and the sorted runtime handlers.
+func parseStatusOutput(output string) (string, []string) {
+	parts := strings.SplitN(output, "---\n", 2)
+	version := parseKataVersion(parts[0])
+	handlers := []string{}
+	if len(parts) == 2 {
+		seen := make(map[string]bool)
+		for _, m := range runtimeSection.FindAllStringSubmatch(parts[1], -1) {
+			if !seen[m[1]] {
+				seen[m[1]] = true
+				handlers = append(handlers, m[1])
+			}
+		}
+	}
+	sort.Strings(handlers)
+	return version, handlers
+}
+
+func isKataRuntimeClass(class *node_v1.RuntimeClass) bool {
+	return strings.Contains(class.Name, "kata") || strings.Contains(class.Handler, "kata")
+}
+
+// parseKataVersion extracts the version from the first line of
+// kata-runtime --version, "kata-runtime  : 3.1.0".
+func parseKataVersion(output string) string {
+	version := strings.TrimSpace(strings.SplitN(output, "\n", 2)[0])
+	if i := strings.LastIndex(version, ":"); i >= 0 {
+		version = strings.TrimSpace(version[i+1:])
+	}
+	return version
+}
+
+// unschedulableReason returns why pods of the RuntimeClass cannot run on the
+// node, or "" when they can. handlers is nil when the runtime configuration
+// of the node is unknown.
+func unschedulableReason(node *v1.Node, class *node_v1.RuntimeClass, handlers map[string]bool) string {
+	if node.Spec.Unschedulable {
+		return "node is cordoned"
+	}
+	if class.Scheduling != nil {
+		if !labels.SelectorFromSet(class.Scheduling.NodeSelector).Matches(labels.Set(node.Labels)) {
+			return fmt.Sprintf("node selector %s does not match", labels.Set(class.Scheduling.NodeSelector))
+		}
+	}
+	for i := range node.Spec.Taints {
+		taint := &node.Spec.Taints[i]
+		if taint.Effect == v1.TaintEffectPreferNoSchedule {
+			continue
+		}
+		tolerated := false
+		if class.Scheduling != nil {
+			for _, t := range class.Scheduling.Tolerations {
+				if t.ToleratesTaint(taint) {
+					tolerated = true
+				}
+			}
+		}
+		if !tolerated {
+			return fmt.Sprintf("taint %s not tolerated", taint.ToString())
+		}
+	}
+	if handlers == nil {
+		return "runtime configuration unknown"
+	}
+	if !handlers[class.Handler] {
+		return fmt.Sprintf("handler %s not configured", class.Handler)
+	}
+	return ""
+}
+
+func (s *StatusService) printTable(status *Status) error {
+	if status.Image != "" {
+		fmt.Fprintf(s.out, "kata-deploy %s, hypervisors %s\n\n", status.Image, strings.Join(status.Hypervisors, ", "))
+	}
+	w := tabwriter.NewWriter(s.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tKATA-RUNTIME\tDEPLOY-POD\tRESTARTS\tVERSION\tCONTAINER-RUNTIME\tHANDLERS\tRUNTIMECLASSES")
+	for _, n := range status.Nodes {
+		label := "no"
+		if n.KataRuntime {
+			label = "yes"
+		}
+		pod, restarts := "-", "-"
+		if n.DeployPod != nil {
+			pod = n.DeployPod.Phase
+			if n.DeployPod.Phase == string(v1.PodRunning) && !n.DeployPod.Ready {
+				pod += " (not ready)"
+			}
+			restarts = fmt.Sprint(n.DeployPod.Restarts)
+		} else if !n.Selected {
+			pod = "not selected"
+		}
+		var kata []string
+		for _, h := range n.Handlers {
+			if strings.Contains(h, "kata") {
+				kata = append(kata, h)
+			}
+		}
+		var classes []string
+		for _, c := range n.RuntimeClasses {
+			if c.Schedulable {
+				classes = append(classes, c.Name)
+			}
+		}
+		version := n.KataVersion
+		if n.Error != "" {
+			version = "error"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", n.Name, label, pod, restarts, orDash(version), orDash(n.ContainerRuntime), orDash(strings.Join(kata, ",")), orDash(strings.Join(classes, ",")))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	for _, n := range status.Nodes {
+		if n.Error != "" {
+			log.Warnf("%s: %s", n.Name, n.Error)
+		}
+	}
+	return nil
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func (s *StatusService) cleanup() error {
+	return nil
+}
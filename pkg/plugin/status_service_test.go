@@ -0,0 +1,112 @@
+package plugin
+
+import (
+	v1 "k8s.io/api/core/v1"
+	node_v1 "k8s.io/api/node/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"reflect"
+	"testing"
+)
+
+func TestParseStatusOutput(t *testing.T) {
+	tests := []struct {
+		name     string
+		output   string
+		version  string
+		handlers []string
+	}{
+		{"no kata", "---\n", "", []string{}},
+		{"no configuration", "kata-runtime  : 3.1.0\n", "3.1.0", []string{}},
+		{"containerd", `kata-runtime  : 3.1.0
+   commit   : abc
+---
+version = 2
+[plugins."io.containerd.grpc.v1.cri".containerd.runtimes.runc]
+  runtime_type = "io.containerd.runc.v2"
+[plugins."io.containerd.grpc.v1.cri".containerd.runtimes.runc.options]
+  SystemdCgroup = true
+[plugins."io.containerd.grpc.v1.cri".containerd.runtimes.kata-qemu]
+  runtime_type = "io.containerd.kata-qemu.v2"
+# [plugins."io.containerd.grpc.v1.cri".containerd.runtimes.kata-fc]
+`, "3.1.0", []string{"kata-qemu", "runc"}},
+		{"containerd 2 and drop-ins", `kata-runtime  : 3.2.0
+---
+[plugins.'io.containerd.cri.v1.runtime'.containerd.runtimes.'kata-clh']
+[plugins."io.containerd.grpc.v1.cri".containerd.runtimes."kata-qemu"]
+  [plugins."io.containerd.grpc.v1.cri".containerd.runtimes.kata-qemu]
+`, "3.2.0", []string{"kata-clh", "kata-qemu"}},
+		{"cri-o", `kata-runtime  : 2.5.2
+---
+[crio.runtime.runtimes.runc]
+[crio.runtime.runtimes.kata-qemu]
+runtime_path = "/opt/kata/bin/containerd-shim-kata-v2"
+`, "2.5.2", []string{"kata-qemu", "runc"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			version, handlers := parseStatusOutput(tt.output)
+			if version != tt.version {
+				t.Errorf("version %q, want %q", version, tt.version)
+			}
+			if !reflect.DeepEqual(handlers, tt.handlers) {
+				t.Errorf("handlers %v, want %v", handlers, tt.handlers)
+			}
+		})
+	}
+}
+
+func TestParseKataVersion(t *testing.T) {
+	for output, want := range map[string]string{
+		"":                                     "",
+		"kata-runtime  : 3.1.0":                "3.1.0",
+		"kata-runtime  : 3.1.0\n   commit : x": "3.1.0",
+		"Kata Containers containerd shim: id: \"io.containerd.kata.v2\", version: 3.0.2": "3.0.2",
+		"3.1.0": "3.1.0",
+	} {
+		if got := parseKataVersion(output); got != want {
+			t.Errorf("parseKataVersion(%q) = %q, want %q", output, got, want)
+		}
+	}
+}
+
+func TestUnschedulableReason(t *testing.T) {
+	node := func(unschedulable bool, taints ...v1.Taint) *v1.Node {
+		return &v1.Node{
+			ObjectMeta: meta_v1.ObjectMeta{Labels: map[string]string{kataRuntimeLabel: "true"}},
+			Spec:       v1.NodeSpec{Unschedulable: unschedulable, Taints: taints},
+		}
+	}
+	kata := &node_v1.RuntimeClass{Handler: "kata-qemu", Scheduling: &node_v1.Scheduling{
+		NodeSelector: map[string]string{kataRuntimeLabel: "true"},
+		Tolerations:  []v1.Toleration{{Key: "kata", Operator: v1.TolerationOpExists}},
+	}}
+	plain := &node_v1.RuntimeClass{Handler: "kata-qemu"}
+	selective := &node_v1.RuntimeClass{Handler: "kata-qemu", Scheduling: &node_v1.Scheduling{
+		NodeSelector: map[string]string{"gpu": "true"},
+	}}
+	configured := map[string]bool{"kata-qemu": true}
+	tests := []struct {
+		name     string
+		node     *v1.Node
+		class    *node_v1.RuntimeClass
+		handlers map[string]bool
+		reason   string
+	}{
+		{"schedulable", node(false), kata, configured, ""},
+		{"cordoned", node(true), kata, configured, "node is cordoned"},
+		{"selector", node(false), selective, configured, "node selector gpu=true does not match"},
+		{"tolerated taint", node(false, v1.Taint{Key: "kata", Effect: v1.TaintEffectNoSchedule}), kata, configured, ""},
+		{"taint", node(false, v1.Taint{Key: "dedicated", Value: "db", Effect: v1.TaintEffectNoSchedule}), kata, configured, "taint dedicated=db:NoSchedule not tolerated"},
+		{"taint without scheduling", node(false, v1.Taint{Key: "kata", Effect: v1.TaintEffectNoExecute}), plain, configured, "taint kata:NoExecute not tolerated"},
+		{"preferred taint", node(false, v1.Taint{Key: "dedicated", Effect: v1.TaintEffectPreferNoSchedule}), plain, configured, ""},
+		{"unknown configuration", node(false), kata, nil, "runtime configuration unknown"},
+		{"handler missing", node(false), kata, map[string]bool{"runc": true}, "handler kata-qemu not configured"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if reason := unschedulableReason(tt.node, tt.class, tt.handlers); reason != tt.reason {
+				t.Errorf("got %q, want %q", reason, tt.reason)
+			}
+		})
+	}
+}
@@ -2,10 +2,12 @@ package plugin
 
 import (
 	"github.com/Tim-0731-Hzt/knet/pkg/kube"
+	"github.com/Tim-0731-Hzt/knet/pkg/storage"
 	"github.com/goombaio/namegenerator"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"io"
 	v1 "k8s.io/api/core/v1"
 	"os"
 	"os/exec"
@@ -23,6 +25,18 @@ type Tcpdump struct {
 	UserSpecifiedNamespace string
 	UserSpecifiedPodsName  []string
 	UserSpecifiedPods      map[string]*v1.Pod
+	Filter                 string
+	Image                  string
+	Output                 io.Writer
+	Serve                  string
+	Upload                 string
+	S3Endpoint             string
+	PresignExpiry          time.Duration
+	Trigger                bool
+	PreTrigger             time.Duration
+	PostTrigger            time.Duration
+	TriggerBufferSize      int
+	s3                     *storage.S3Client
 }
 
 func NewTcpdumpConfig() *Tcpdump {
@@ -46,6 +60,12 @@ func (t *TcpdumpService) Complete(cmd *cobra.Command, args []string) error {
 		return err
 	}
 	t.Config.UserSpecifiedPods = make(map[string]*v1.Pod)
+	if t.Config.Image == "" {
+		t.Config.Image = kube.DefaultCaptureImage
+	}
+	if t.Config.Output == nil {
+		t.Config.Output = os.Stdout
+	}
 	return nil
 }
 func (t *TcpdumpService) Validate() error {
@@ -60,14 +80,34 @@ func (t *TcpdumpService) Validate() error {
 		}
 		t.Config.UserSpecifiedPods[p] = pod
 	}
+	if t.Config.Trigger && (t.Config.Serve != "" || t.Config.Upload != "") {
+		return errors.New("--trigger cannot be combined with --serve or --upload")
+	}
+	if t.Config.Upload != "" {
+		if _, _, err := storage.ParseS3URL(t.Config.Upload); err != nil {
+			return err
+		}
+		var err error
+		t.Config.s3, err = storage.NewS3ClientFromEnv(t.Config.S3Endpoint)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 func (t *TcpdumpService) Run() error {
-	if len(t.Config.UserSpecifiedPodsName) > 1 {
+	if t.Config.Serve != "" {
+		return t.serve()
+	}
+	if t.Config.Trigger {
+		return t.runTrigger()
+	}
+	if len(t.Config.UserSpecifiedPodsName) > 1 || t.Config.Upload != "" {
 		dir, err := os.Getwd()
 		if err != nil {
 			return err
 		}
+		start := time.Now()
 		errs := make(chan error, 1)
 		go func() {
 			sigchan := make(chan os.Signal, 1)
@@ -82,31 +122,28 @@ func (t *TcpdumpService) Run() error {
 			err = cmd.Run()
 			if err != nil {
 				errs <- err
+				return
 			}
 			log.Println("pcap file will be stored in " + dir + "/merge.pcap")
+			if t.Config.Upload != "" {
+				if err := t.upload(dir, start, time.Now()); err != nil {
+					log.WithError(err).Errorf("failed to upload capture")
+					os.Exit(1)
+				}
+			}
 			os.Exit(0)
 		}()
 		var wg sync.WaitGroup
 		wg.Add(len(t.Config.UserSpecifiedPodsName))
 		for _, p := range t.Config.UserSpecifiedPodsName {
-			log.Infof("creating ephemeral container inside pod %s", p)
-			debugContainerName := namegenerator.NewNameGenerator(time.Now().UTC().UnixNano()).Generate()
-			_, _, err := t.kubeService.GenerateDebugContainer(p, "default", t.Config.UserSpecifiedPods[p].Spec.Containers[0].Name, debugContainerName)
-			if err != nil {
-				log.WithError(err).Errorf("failed to create debug container")
-				return err
-			}
 			f, err := os.OpenFile(dir+"/"+p+".pcap", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
 			if err != nil {
 				panic(err)
 			}
 			defer f.Close()
-			executeTcpdumpRequest := kube.ExecCommandRequest{
-				PodName:   p,
-				Namespace: t.Config.UserSpecifiedNamespace,
-				Container: debugContainerName,
-				Command:   []string{"/usr/bin/tcpdump", "-w", "-"},
-				StdOut:    f,
+			executeTcpdumpRequest, err := t.captureRequest(p, f)
+			if err != nil {
+				return err
 			}
 			log.Infof("start capture")
 			go func() {
@@ -122,20 +159,10 @@ func (t *TcpdumpService) Run() error {
 		}
 		wg.Wait()
 	} else {
-		podName := t.Config.UserSpecifiedPodsName[0]
-		debugContainerName := namegenerator.NewNameGenerator(time.Now().UTC().UnixNano()).Generate()
-		_, _, err := t.kubeService.GenerateDebugContainer(podName, t.Config.UserSpecifiedNamespace, t.Config.UserSpecifiedPods[podName].Spec.Containers[0].Name, debugContainerName)
+		executeTcpdumpRequest, err := t.captureRequest(t.Config.UserSpecifiedPodsName[0], t.Config.Output)
 		if err != nil {
-			log.WithError(err).Errorf("failed to create debug container")
 			return err
 		}
-		executeTcpdumpRequest := kube.ExecCommandRequest{
-			PodName:   podName,
-			Namespace: t.Config.UserSpecifiedNamespace,
-			Container: debugContainerName,
-			Command:   []string{"/usr/bin/tcpdump", "-w", "-"},
-			StdOut:    os.Stdout,
-		}
 		log.Infof("spawning termshark!")
 		_, err = t.kubeService.ExecuteCommand(executeTcpdumpRequest)
 		if err != nil {
@@ -146,6 +173,35 @@ func (t *TcpdumpService) Run() error {
 	return nil
 }
 
+// captureRequest creates an ephemeral debug container inside the pod and
+// returns the request running tcpdump in it, writing the capture to out.
+func (t *TcpdumpService) captureRequest(podName string, out io.Writer) (kube.ExecCommandRequest, error) {
+	log.Infof("creating ephemeral container inside pod %s", podName)
+	debugContainerName := namegenerator.NewNameGenerator(time.Now().UTC().UnixNano()).Generate()
+	_, _, err := t.kubeService.GenerateDebugContainer(podName, t.Config.UserSpecifiedNamespace, t.Config.UserSpecifiedPods[podName].Spec.Containers[0].Name, debugContainerName, t.Config.Image)
+	if err != nil {
+		log.WithError(err).Errorf("failed to create debug container")
+		return kube.ExecCommandRequest{}, err
+	}
+	return kube.ExecCommandRequest{
+		PodName:   podName,
+		Namespace: t.Config.UserSpecifiedNamespace,
+		Container: debugContainerName,
+		Command:   t.tcpdumpCommand(),
+		StdOut:    out,
+	}, nil
+}
+
+// tcpdumpCommand returns the packet-buffered tcpdump invocation so that
+// readers of the stream see packets as soon as they are captured.
+func (t *TcpdumpService) tcpdumpCommand() []string {
+	command := []string{"/usr/bin/tcpdump", "-U", "-w", "-"}
+	if t.Config.Filter != "" {
+		command = append(command, t.Config.Filter)
+	}
+	return command
+}
+
 func (t *TcpdumpService) cleanup() error {
 	return nil
 }
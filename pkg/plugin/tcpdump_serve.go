@@ -0,0 +1,78 @@
+package plugin
+
+import (
+	"github.com/Tim-0731-Hzt/knet/pkg/pcap"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"os/signal"
+)
+
+// serve merges the live captures of all pods into a single pcap stream and
+// serves it over TCP until interrupted.
+func (t *TcpdumpService) serve() error {
+	server, err := pcap.NewServer(t.Config.Serve, pcap.Header{SnapLen: pcap.DefaultSnapLen, LinkType: pcap.LinkTypeEthernet})
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+	for _, p := range t.Config.UserSpecifiedPodsName {
+		r, w := io.Pipe()
+		executeTcpdumpRequest, err := t.captureRequest(p, w)
+		if err != nil {
+			return err
+		}
+		log.Infof("start capture on pod %s", p)
+		go func(podName string) {
+			_, err := t.kubeService.ExecuteCommand(executeTcpdumpRequest)
+			if err != nil {
+				log.WithError(err).Errorf("failed to execute tcpdump on pod %s", podName)
+			}
+			_ = w.CloseWithError(err)
+		}(p)
+		go forwardCapture(p, r, server)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Serve()
+	}()
+	log.Infof("serving pcap on %s", server.Addr())
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, os.Interrupt)
+	select {
+	case <-sigchan:
+		log.Println("stop capture")
+		return nil
+	case err := <-errs:
+		return err
+	}
+}
+
+func forwardCapture(podName string, r *io.PipeReader, server *pcap.Server) {
+	// closing the reader fails the writes of the tcpdump exec, so it does not
+	// block forever on a capture that is no longer read
+	var err error
+	defer func() { _ = r.CloseWithError(err) }()
+	reader, err := pcap.NewReader(r)
+	if err != nil {
+		log.WithError(err).Errorf("failed to read capture of pod %s", podName)
+		return
+	}
+	if reader.Header.LinkType != pcap.LinkTypeEthernet {
+		err = errors.Errorf("capture of pod %s has link type %d, only ethernet can be merged", podName, reader.Header.LinkType)
+		log.Error(err)
+		return
+	}
+	for {
+		var p *pcap.Packet
+		if p, err = reader.Next(); err != nil {
+			if err != io.EOF {
+				log.WithError(err).Errorf("failed to read capture of pod %s", podName)
+			}
+			return
+		}
+		server.WritePacket(p)
+	}
+}
@@ -0,0 +1,258 @@
+package plugin
+
+import (
+	"fmt"
+	"github.com/Tim-0731-Hzt/knet/pkg/pcap"
+	"github.com/Tim-0731-Hzt/knet/pkg/wait"
+	log "github.com/sirupsen/logrus"
+	"io"
+	v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"time"
+)
+
+// triggerEventReasons are the pod event reasons that fire a trigger.
+var triggerEventReasons = map[string]bool{
+	"Unhealthy": true,
+	"BackOff":   true,
+}
+
+// trigger is a reason to save the capture around at. at comes from the
+// cluster, the kubelet's clock, like the packet timestamps of the node.
+type trigger struct {
+	pod    string
+	reason string
+	at     time.Time
+}
+
+// runTrigger keeps the last pre+post trigger window of every pod in memory
+// and writes it to disk whenever one of the pods runs into trouble.
+func (t *TcpdumpService) runTrigger() error {
+	window := t.Config.PreTrigger + t.Config.PostTrigger
+	rings := make(map[string]*pcap.Ring)
+	for _, p := range t.Config.UserSpecifiedPodsName {
+		ring := pcap.NewRing(window, t.Config.TriggerBufferSize)
+		rings[p] = ring
+		r, w := io.Pipe()
+		executeTcpdumpRequest, err := t.captureRequest(p, w)
+		if err != nil {
+			return err
+		}
+		log.Infof("start buffering capture of pod %s", p)
+		go func(podName string) {
+			_, err := t.kubeService.ExecuteCommand(executeTcpdumpRequest)
+			if err != nil {
+				log.WithError(err).Errorf("failed to execute tcpdump on pod %s", podName)
+			}
+			_ = w.CloseWithError(err)
+		}(p)
+		go bufferCapture(p, r, ring)
+	}
+
+	triggers := make(chan trigger, 16)
+	for _, p := range t.Config.UserSpecifiedPodsName {
+		go t.watchPodStatus(p, triggers)
+	}
+	go t.watchPodEvents(triggers)
+
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, os.Interrupt)
+	for {
+		select {
+		case <-sigchan:
+			log.Println("stop capture")
+			return nil
+		case tr := <-triggers:
+			log.Warnf("trigger fired on pod %s: %s, capturing %s more", tr.pod, tr.reason, t.Config.PostTrigger)
+			interrupted := false
+			select {
+			case <-sigchan:
+				interrupted = true
+			case <-time.After(t.Config.PostTrigger):
+			}
+			if err := t.saveTrigger(tr, rings); err != nil {
+				log.WithError(err).Errorf("failed to save triggered capture")
+			}
+			if interrupted {
+				log.Println("stop capture")
+				return nil
+			}
+			// triggers that fired while the window was recorded are
+			// covered by the saved capture
+			drainTriggers(triggers)
+		}
+	}
+}
+
+func (t *TcpdumpService) saveTrigger(tr trigger, rings map[string]*pcap.Ring) error {
+	from, to := tr.at.Add(-t.Config.PreTrigger), tr.at.Add(t.Config.PostTrigger)
+	var packets []*pcap.Packet
+	for _, ring := range rings {
+		for _, p := range ring.Since(from) {
+			if !p.Timestamp.After(to) {
+				packets = append(packets, p)
+			}
+		}
+	}
+	sort.SliceStable(packets, func(i, j int) bool {
+		return packets[i].Timestamp.Before(packets[j].Timestamp)
+	})
+	name := fmt.Sprintf("trigger-%s-%s.pcap", tr.pod, tr.at.UTC().Format("20060102T150405Z"))
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w, err := pcap.NewWriter(f, pcap.Header{SnapLen: pcap.DefaultSnapLen, LinkType: pcap.LinkTypeEthernet})
+	if err != nil {
+		return err
+	}
+	for _, p := range packets {
+		if err := w.WritePacket(p); err != nil {
+			return err
+		}
+	}
+	log.Infof("saved %d packets around the trigger to %s", len(packets), name)
+	return nil
+}
+
+func bufferCapture(podName string, r *io.PipeReader, ring *pcap.Ring) {
+	// like forwardCapture, the tcpdump exec must not block on a capture that
+	// is no longer read
+	var err error
+	defer func() { _ = r.CloseWithError(err) }()
+	reader, err := pcap.NewReader(r)
+	if err != nil {
+		log.WithError(err).Errorf("failed to read capture of pod %s", podName)
+		return
+	}
+	for {
+		var p *pcap.Packet
+		if p, err = reader.Next(); err != nil {
+			if err != io.EOF {
+				log.WithError(err).Errorf("failed to read capture of pod %s", podName)
+			}
+			return
+		}
+		ring.Add(p)
+	}
+}
+
+func drainTriggers(triggers chan trigger) {
+	for {
+		select {
+		case <-triggers:
+		default:
+			return
+		}
+	}
+}
+
+// watchPodStatus fires on container restarts, OOM kills and the pod
+// turning unready.
+func (t *TcpdumpService) watchPodStatus(podName string, triggers chan<- trigger) {
+	previous := t.Config.UserSpecifiedPods[podName]
+	for {
+		w, err := t.kubeService.WatchPod(podName, t.Config.UserSpecifiedNamespace)
+		if err != nil {
+			log.WithError(err).Errorf("failed to watch pod %s", podName)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		for event := range w.ResultChan() {
+			if event.Type != watch.Modified {
+				continue
+			}
+			pod, ok := event.Object.(*v1.Pod)
+			if !ok {
+				continue
+			}
+			if reason, at := podTriggerReason(previous, pod); reason != "" {
+				triggers <- trigger{pod: podName, reason: reason, at: at}
+			}
+			previous = pod
+		}
+	}
+}
+
+func (t *TcpdumpService) watchPodEvents(triggers chan<- trigger) {
+	for {
+		w, err := t.kubeService.WatchPodEvents(t.Config.UserSpecifiedNamespace)
+		if err != nil {
+			log.WithError(err).Errorf("failed to watch events")
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		for e := range w.ResultChan() {
+			// recurring events are reported as modifications of the
+			// original event with an increased count
+			event, ok := e.Object.(*v1.Event)
+			if !ok || (e.Type != watch.Added && e.Type != watch.Modified) {
+				continue
+			}
+			if _, ok := t.Config.UserSpecifiedPods[event.InvolvedObject.Name]; !ok {
+				continue
+			}
+			if triggerEventReasons[event.Reason] {
+				triggers <- trigger{pod: event.InvolvedObject.Name, reason: event.Reason + ": " + strings.TrimSpace(event.Message), at: eventTime(event)}
+			}
+		}
+	}
+}
+
+// podTriggerReason returns why the pod status change fires a trigger, and
+// when the change happened according to the pod status.
+func podTriggerReason(previous *v1.Pod, current *v1.Pod) (string, time.Time) {
+	restarts := make(map[string]int32)
+	for _, s := range previous.Status.ContainerStatuses {
+		restarts[s.Name] = s.RestartCount
+	}
+	for _, s := range current.Status.ContainerStatuses {
+		if s.RestartCount <= restarts[s.Name] {
+			continue
+		}
+		var at meta_v1.Time
+		if terminated := s.LastTerminationState.Terminated; terminated != nil {
+			at = terminated.FinishedAt
+			if terminated.Reason == "OOMKilled" {
+				return fmt.Sprintf("container %s was OOMKilled", s.Name), clusterTime(at)
+			}
+		}
+		return fmt.Sprintf("container %s restarted", s.Name), clusterTime(at)
+	}
+	if wait.PodReady(previous) && !wait.PodReady(current) {
+		for _, c := range current.Status.Conditions {
+			if c.Type == v1.PodReady {
+				return "pod became unready", clusterTime(c.LastTransitionTime)
+			}
+		}
+	}
+	return "", time.Time{}
+}
+
+// eventTime returns when the event last happened.
+func eventTime(event *v1.Event) time.Time {
+	switch {
+	case event.Series != nil && !event.Series.LastObservedTime.IsZero():
+		return event.Series.LastObservedTime.Time
+	case !event.LastTimestamp.IsZero():
+		return event.LastTimestamp.Time
+	case !event.EventTime.IsZero():
+		return event.EventTime.Time
+	}
+	return clusterTime(event.FirstTimestamp)
+}
+
+// clusterTime falls back to the local clock for objects that do not record
+// the time.
+func clusterTime(t meta_v1.Time) time.Time {
+	if t.IsZero() {
+		return time.Now()
+	}
+	return t.Time
+}
@@ -0,0 +1,65 @@
+package plugin
+
+import (
+	v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+	"time"
+)
+
+func TestPodTriggerReason(t *testing.T) {
+	finished := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	unready := finished.Add(time.Minute)
+	pod := func(restarts int32, terminated *v1.ContainerStateTerminated, ready v1.ConditionStatus) *v1.Pod {
+		return &v1.Pod{Status: v1.PodStatus{
+			ContainerStatuses: []v1.ContainerStatus{{
+				Name:                 "app",
+				RestartCount:         restarts,
+				LastTerminationState: v1.ContainerState{Terminated: terminated},
+			}},
+			Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: ready, LastTransitionTime: meta_v1.NewTime(unready)}},
+		}}
+	}
+	tests := []struct {
+		name     string
+		previous *v1.Pod
+		current  *v1.Pod
+		reason   string
+		at       time.Time
+	}{
+		{"no change", pod(0, nil, v1.ConditionTrue), pod(0, nil, v1.ConditionTrue), "", time.Time{}},
+		{"restart", pod(0, nil, v1.ConditionTrue), pod(1, &v1.ContainerStateTerminated{Reason: "Error", FinishedAt: meta_v1.NewTime(finished)}, v1.ConditionTrue), "container app restarted", finished},
+		{"oom kill", pod(1, nil, v1.ConditionTrue), pod(2, &v1.ContainerStateTerminated{Reason: "OOMKilled", FinishedAt: meta_v1.NewTime(finished)}, v1.ConditionFalse), "container app was OOMKilled", finished},
+		{"unready", pod(0, nil, v1.ConditionTrue), pod(0, nil, v1.ConditionFalse), "pod became unready", unready},
+		{"ready again", pod(0, nil, v1.ConditionFalse), pod(0, nil, v1.ConditionTrue), "", time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason, at := podTriggerReason(tt.previous, tt.current)
+			if reason != tt.reason || !at.Equal(tt.at) {
+				t.Errorf("got %q at %v, want %q at %v", reason, at, tt.reason, tt.at)
+			}
+		})
+	}
+}
+
+func TestEventTime(t *testing.T) {
+	first := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	last := first.Add(time.Minute)
+	observed := last.Add(time.Minute)
+	tests := []struct {
+		name  string
+		event v1.Event
+		want  time.Time
+	}{
+		{"first", v1.Event{FirstTimestamp: meta_v1.NewTime(first)}, first},
+		{"recurring", v1.Event{FirstTimestamp: meta_v1.NewTime(first), LastTimestamp: meta_v1.NewTime(last)}, last},
+		{"events.k8s.io", v1.Event{EventTime: meta_v1.NewMicroTime(last)}, last},
+		{"series", v1.Event{EventTime: meta_v1.NewMicroTime(first), Series: &v1.EventSeries{LastObservedTime: meta_v1.NewMicroTime(observed)}}, observed},
+	}
+	for _, tt := range tests {
+		if got := eventTime(&tt.event); !got.Equal(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Tim-0731-Hzt/knet/pkg/storage"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// captureMetadata is uploaded next to the pcap files to describe the capture.
+type captureMetadata struct {
+	Namespace string            `json:"namespace"`
+	Pods      []string          `json:"pods"`
+	Nodes     map[string]string `json:"nodes"`
+	Filter    string            `json:"filter,omitempty"`
+	Start     time.Time         `json:"start"`
+	End       time.Time         `json:"end"`
+	Duration  string            `json:"duration"`
+	Files     []string          `json:"files"`
+}
+
+// upload pushes the per-pod captures, the merged capture and a metadata
+// document to the configured bucket and prints a pre-signed URL for the
+// merged capture.
+func (t *TcpdumpService) upload(dir string, start time.Time, end time.Time) error {
+	bucket, prefix, err := storage.ParseS3URL(t.Config.Upload)
+	if err != nil {
+		return err
+	}
+	prefix = path.Join(prefix, t.Config.UserSpecifiedNamespace+"-"+start.UTC().Format("20060102T150405Z"))
+
+	metadata := captureMetadata{
+		Namespace: t.Config.UserSpecifiedNamespace,
+		Pods:      t.Config.UserSpecifiedPodsName,
+		Nodes:     make(map[string]string),
+		Filter:    t.Config.Filter,
+		Start:     start.UTC(),
+		End:       end.UTC(),
+		Duration:  end.Sub(start).Round(time.Second).String(),
+	}
+	files := []string{"merge.pcap"}
+	for _, p := range t.Config.UserSpecifiedPodsName {
+		metadata.Nodes[p] = t.Config.UserSpecifiedPods[p].Spec.NodeName
+		files = append(files, p+".pcap")
+	}
+	for _, name := range files {
+		key := path.Join(prefix, name)
+		log.Infof("uploading %s to s3://%s/%s", name, bucket, key)
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		err = t.Config.s3.Upload(bucket, key, f, "application/vnd.tcpdump.pcap")
+		f.Close()
+		if err != nil {
+			return err
+		}
+		metadata.Files = append(metadata.Files, key)
+	}
+
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := t.Config.s3.Upload(bucket, path.Join(prefix, "metadata.json"), bytes.NewReader(data), "application/json"); err != nil {
+		return err
+	}
+
+	url, err := t.Config.s3.PresignGet(bucket, path.Join(prefix, "merge.pcap"), t.Config.PresignExpiry)
+	if err != nil {
+		return err
+	}
+	fmt.Println(url)
+	return nil
+}
@@ -0,0 +1,344 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/Tim-0731-Hzt/knet/pkg/kube"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	apps_v1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// versionTag matches image tags naming a kata release, e.g. 3.1.0, v3.1.0,
+// 3.2.0-rc0 or 3.1.0-amd64, the submatch is the version kata reports.
+var versionTag = regexp.MustCompile(`^v?(\d+\.\d+\.\d+(?:-(?:alpha|rc)\d+)?)(?:$|[-_.+])`)
+
+// UpgradeService replaces the kata-deploy image node by node. The DaemonSet
+// is switched to OnDelete while upgrading, so a node is only upgraded once
+// no kata pod runs on it and the next batch only starts once the previous
+// one reports the new kata version.
+type UpgradeService struct {
+	kubeService    *kube.KubernetesApiServiceImpl
+	Image          KataDeployImage
+	To             string
+	MaxUnavailable int
+	Drain          bool
+	Rollback       bool
+	Timeout        time.Duration
+	repositorySet  bool
+	previous       string
+	strategy       apps_v1.DaemonSetUpdateStrategy
+	kataClasses    map[string]bool
+	nodes          []string
+	cordoned       map[string]bool
+}
+
+func NewUpgradeService() *UpgradeService {
+	return &UpgradeService{cordoned: make(map[string]bool)}
+}
+
+func (u *UpgradeService) Complete(cmd *cobra.Command, args []string) error {
+	var err error
+	u.Image.Complete(cmd)
+	u.repositorySet = cmd.Flags().Changed("image") || viper.IsSet("image.repository")
+	if u.To != "" {
+		u.Image.Tag = u.To
+	}
+	u.kubeService, err = kube.NewKubernetesApiServiceImpl()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (u *UpgradeService) Validate() error {
+	if u.To == "" {
+		return errors.New("--to is required")
+	}
+	if u.MaxUnavailable < 1 {
+		return errors.New("--max-unavailable must be at least 1")
+	}
+	daemonSet, err := u.kubeService.GetDaemonSet("kata-deploy")
+	if err != nil {
+		return errors.Wrap(err, "kata-deploy is not deployed, run knet deploy first")
+	}
+	u.previous = daemonSet.Spec.Template.Spec.Containers[0].Image
+	u.strategy = daemonSet.Spec.UpdateStrategy
+	if !u.repositorySet {
+		u.Image.Repository = imageRepository(u.previous)
+	}
+	if err := u.Image.Validate(); err != nil {
+		return err
+	}
+	if err := u.Image.validatePullSecrets(u.kubeService); err != nil {
+		return err
+	}
+	classes, err := u.kubeService.ListRuntimeClasses()
+	if err != nil {
+		return err
+	}
+	u.kataClasses = make(map[string]bool)
+	for i := range classes {
+		if isKataRuntimeClass(&classes[i]) {
+			u.kataClasses[classes[i].Name] = true
+		}
+	}
+	pods, err := u.kubeService.ListDeployPods("name=kata-deploy")
+	if err != nil {
+		return err
+	}
+	for _, pod := range pods {
+		if pod.Spec.Containers[0].Image != u.Image.Reference() {
+			u.nodes = append(u.nodes, pod.Spec.NodeName)
+		}
+	}
+	sort.Strings(u.nodes)
+	return nil
+}
+
+func (u *UpgradeService) Run() error {
+	// a later deploy applies the node selector, keep kata on these nodes
+	running, err := unlabeledDeployNodes(u.kubeService)
+	if err != nil {
+		return err
+	}
+	if err := labelDeployNodes(u.kubeService, running); err != nil {
+		return err
+	}
+	target := u.Image.Reference()
+	if len(u.nodes) == 0 {
+		log.Infof("kata-deploy already runs %s on every node", target)
+		return nil
+	}
+	log.Infof("upgrade kata-deploy from %s to %s on %d nodes", u.previous, target, len(u.nodes))
+	onDelete := apps_v1.DaemonSetUpdateStrategy{Type: apps_v1.OnDeleteDaemonSetStrategyType}
+	if err := u.updateDaemonSet(target, onDelete); err != nil {
+		return err
+	}
+	var upgraded []string
+	err = u.roll(u.nodes, target, expectedVersion(u.To), &upgraded)
+	if err != nil && u.Rollback && len(upgraded) > 0 {
+		log.WithError(err).Errorf("upgrade failed, rolling %s back to %s", strings.Join(upgraded, ", "), u.previous)
+		rollbackErr := u.updateDaemonSet(u.previous, onDelete)
+		if rollbackErr == nil {
+			rollbackErr = u.roll(upgraded, u.previous, "", nil)
+		}
+		if rollbackErr != nil {
+			log.WithError(rollbackErr).Errorf("rollback failed, kata-deploy is left on OnDelete")
+			return errors.Wrapf(err, "upgrade failed, rollback failed: %s", rollbackErr)
+		}
+		log.Infof("rolled back to %s", u.previous)
+	} else if err != nil {
+		log.Errorf("upgrade failed, %s run %s, the other nodes %s", strings.Join(upgraded, ", "), target, u.previous)
+	}
+	if restoreErr := u.updateDaemonSet("", u.strategy); restoreErr != nil {
+		log.WithError(restoreErr).Errorf("failed to restore the update strategy of kata-deploy")
+	}
+	for n := range u.cordoned {
+		log.Warnf("node %s stays cordoned, run kubectl uncordon %s once kata works on it", n, n)
+	}
+	if err != nil {
+		return err
+	}
+	if err := recordImageDigest(u.kubeService, "kata-deploy"); err != nil {
+		log.WithError(err).Warnf("failed to record the image digest")
+	}
+	return nil
+}
+
+// updateDaemonSet sets the image, unless it is empty, and the update
+// strategy of kata-deploy.
+func (u *UpgradeService) updateDaemonSet(image string, strategy apps_v1.DaemonSetUpdateStrategy) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		daemonSet, err := u.kubeService.GetDaemonSet("kata-deploy")
+		if err != nil {
+			return err
+		}
+		daemonSet.Spec.UpdateStrategy = strategy
+		if image != "" {
+			spec := &daemonSet.Spec.Template.Spec
+			for c := range spec.Containers {
+				spec.Containers[c].Image = image
+				spec.Containers[c].ImagePullPolicy = v1.PullPolicy(u.Image.PullPolicy)
+			}
+		}
+		_, err = u.kubeService.UpdateDaemonSet(daemonSet)
+		return err
+	})
+}
+
+// roll replaces the kata-deploy pods of the nodes batch by batch with pods
+// running image and, unless version is empty, checks that the nodes report
+// it. Nodes are added to upgraded before their pod is replaced.
+func (u *UpgradeService) roll(nodes []string, image string, version string, upgraded *[]string) error {
+	waiter := u.kubeService.Waiter(u.Timeout)
+	batches := (&Rollout{BatchSize: u.MaxUnavailable}).batches(nodes)
+	for i, batch := range batches {
+		log.Infof("batch %d/%d: replacing kata-deploy on %s", i+1, len(batches), strings.Join(batch, ", "))
+		for _, n := range batch {
+			if err := u.prepareNode(n); err != nil {
+				return err
+			}
+		}
+		pods, err := u.kubeService.ListDeployPods("name=kata-deploy")
+		if err != nil {
+			return err
+		}
+		replaced := make(map[string]types.UID)
+		for _, pod := range pods {
+			for _, n := range batch {
+				if pod.Spec.NodeName != n {
+					continue
+				}
+				replaced[n] = pod.UID
+				if upgraded != nil {
+					*upgraded = append(*upgraded, n)
+				}
+				if err := u.kubeService.DeleteDeployPod(pod.Name); err != nil {
+					return errors.Wrapf(err, "failed to delete %s on node %s", pod.Name, n)
+				}
+			}
+		}
+		err = waiter.Nodes(context.Background(), "name=kata-deploy", batch, func(node *v1.Node, pod *v1.Pod) string {
+			if pod != nil && node != nil && pod.UID == replaced[node.Name] {
+				return fmt.Sprintf("waiting for %s to be replaced", pod.Name)
+			}
+			if reason := kataInstalled(node, pod); reason != "" {
+				return reason
+			}
+			if pod.Spec.Containers[0].Image != image {
+				return fmt.Sprintf("pod %s runs %s", pod.Name, pod.Spec.Containers[0].Image)
+			}
+			return ""
+		})
+		if err != nil {
+			return errors.Wrapf(err, "batch %d/%d failed", i+1, len(batches))
+		}
+		if err := u.checkVersion(batch, version); err != nil {
+			return err
+		}
+		for _, n := range batch {
+			if u.cordoned[n] {
+				if err := u.kubeService.CordonNode(n, false); err != nil {
+					return errors.Wrapf(err, "failed to uncordon node %s", n)
+				}
+				delete(u.cordoned, n)
+			}
+		}
+	}
+	return nil
+}
+
+// prepareNode makes sure no kata pod runs on the node while kata is
+// replaced, with --drain the node is cordoned and its kata pods are evicted.
+func (u *UpgradeService) prepareNode(nodeName string) error {
+	pods, err := u.kubeService.ListPodsOnNode(nodeName)
+	if err != nil {
+		return err
+	}
+	var kataPods []v1.Pod
+	var names []string
+	for _, pod := range pods {
+		if pod.Spec.RuntimeClassName == nil || !u.kataClasses[*pod.Spec.RuntimeClassName] {
+			continue
+		}
+		if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		kataPods = append(kataPods, pod)
+		names = append(names, pod.Namespace+"/"+pod.Name)
+	}
+	if len(kataPods) == 0 {
+		return nil
+	}
+	if !u.Drain {
+		return errors.Errorf("node %s runs kata pods %s, move them away or use --drain", nodeName, strings.Join(names, ", "))
+	}
+	node, err := u.kubeService.GetNode(nodeName)
+	if err != nil {
+		return err
+	}
+	if !node.Spec.Unschedulable {
+		log.Infof("cordon node %s", nodeName)
+		if err := u.kubeService.CordonNode(nodeName, true); err != nil {
+			return errors.Wrapf(err, "failed to cordon node %s", nodeName)
+		}
+		u.cordoned[nodeName] = true
+	}
+	for i := range kataPods {
+		log.Infof("evict %s/%s from node %s", kataPods[i].Namespace, kataPods[i].Name, nodeName)
+		if err := u.kubeService.EvictPod(&kataPods[i]); err != nil {
+			return errors.Wrapf(err, "failed to evict %s/%s", kataPods[i].Namespace, kataPods[i].Name)
+		}
+	}
+	return u.kubeService.Waiter(u.Timeout).PodsGone(context.Background(), nodeName, kataPods)
+}
+
+// checkVersion checks that the nodes report the kata version, or only logs
+// it when no version is expected.
+func (u *UpgradeService) checkVersion(nodes []string, version string) error {
+	pods, err := u.kubeService.ListDeployPods("name=kata-deploy")
+	if err != nil {
+		return err
+	}
+	for i := range pods {
+		pod := &pods[i]
+		for _, n := range nodes {
+			if pod.Spec.NodeName != n || pod.DeletionTimestamp != nil {
+				continue
+			}
+			var stdout, stderr bytes.Buffer
+			versionRequest := kube.ExecCommandRequest{
+				PodName:   pod.Name,
+				Namespace: pod.Namespace,
+				Container: "kube-kata",
+				Command:   []string{"/opt/kata/bin/kata-runtime", "--version"},
+				StdOut:    &stdout,
+				StdErr:    &stderr,
+			}
+			if _, err := u.kubeService.ExecuteCommand(versionRequest); err != nil {
+				return errors.Wrapf(err, "failed to read the kata version of node %s: %s", n, strings.TrimSpace(stderr.String()))
+			}
+			reported := parseKataVersion(stdout.String())
+			if version != "" && reported != version {
+				return errors.Errorf("node %s reports kata %s, expected %s", n, reported, version)
+			}
+			log.Infof("%s: kata %s", n, reported)
+		}
+	}
+	return nil
+}
+
+// expectedVersion returns the kata version an image tag names, or "" when
+// the tag does not name a release.
+func expectedVersion(tag string) string {
+	if m := versionTag.FindStringSubmatch(tag); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// imageRepository strips the tag and digest off an image reference.
+func imageRepository(image string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image
+}
+
+func (u *UpgradeService) cleanup() error {
+	return nil
+}
@@ -0,0 +1,42 @@
+package plugin
+
+import "testing"
+
+func TestExpectedVersion(t *testing.T) {
+	for tag, want := range map[string]string{
+		"3.1.0":           "3.1.0",
+		"v3.1.0":          "3.1.0",
+		"3.1.0-amd64":     "3.1.0",
+		"v3.1.0_arm64":    "3.1.0",
+		"3.2.0-rc0":       "3.2.0-rc0",
+		"3.0.0-alpha1":    "3.0.0-alpha1",
+		"3.2.0-rc0-amd64": "3.2.0-rc0",
+		"3.1.10":          "3.1.10",
+		"latest":          "",
+		"stable":          "",
+		"3.1":             "",
+		"3.1.0rc":         "",
+		"x3.1.0":          "",
+	} {
+		if got := expectedVersion(tag); got != want {
+			t.Errorf("expectedVersion(%q) = %q, want %q", tag, got, want)
+		}
+	}
+}
+
+func TestImageRepository(t *testing.T) {
+	for image, want := range map[string]string{
+		"quay.io/kata-containers/kata-deploy":                   "quay.io/kata-containers/kata-deploy",
+		"quay.io/kata-containers/kata-deploy:3.1.0":             "quay.io/kata-containers/kata-deploy",
+		"quay.io/kata-containers/kata-deploy@sha256:abc":        "quay.io/kata-containers/kata-deploy",
+		"quay.io/kata-containers/kata-deploy:3.1.0@sha256:abc":  "quay.io/kata-containers/kata-deploy",
+		"registry.local:5000/kata-deploy":                       "registry.local:5000/kata-deploy",
+		"registry.local:5000/kata-deploy:3.1.0":                 "registry.local:5000/kata-deploy",
+		"registry.local:5000/kata/kata-deploy:3.1.0@sha256:abc": "registry.local:5000/kata/kata-deploy",
+		"kata-deploy:latest":                                    "kata-deploy",
+	} {
+		if got := imageRepository(image); got != want {
+			t.Errorf("imageRepository(%q) = %q, want %q", image, got, want)
+		}
+	}
+}
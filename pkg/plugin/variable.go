@@ -80,6 +80,9 @@ var (
 				},
 				Spec: api_v1.PodSpec{
 					ServiceAccountName: "kata-label-node",
+					NodeSelector: map[string]string{
+						deployNodeLabel: "true",
+					},
 					Containers: []api_v1.Container{
 						{
 							Name:    "kube-kata",
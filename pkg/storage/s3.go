@@ -0,0 +1,364 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// partSize is the size of each multipart upload part, S3 requires at
+	// least 5MiB for all but the last part.
+	partSize = 8 << 20
+
+	amzDateFormat   = "20060102T150405Z"
+	shortDateFormat = "20060102"
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// S3Client uploads objects to AWS S3 or any S3-compatible endpoint such as
+// MinIO, signing requests with AWS Signature Version 4.
+type S3Client struct {
+	endpoint     *url.URL
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	pathStyle    bool
+	httpClient   *http.Client
+}
+
+// NewS3ClientFromEnv reads credentials and region from the standard AWS
+// environment variables. An empty endpoint falls back to AWS_ENDPOINT_URL
+// and then to AWS S3 itself. Custom endpoints use path-style addressing.
+func NewS3ClientFromEnv(endpoint string) (*S3Client, error) {
+	c := &S3Client{
+		region:       os.Getenv("AWS_REGION"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		httpClient:   http.DefaultClient,
+	}
+	if c.region == "" {
+		c.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if c.region == "" {
+		c.region = "us-east-1"
+	}
+	if c.accessKey == "" || c.secretKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set to upload captures")
+	}
+	if endpoint == "" {
+		endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", c.region)
+	} else {
+		c.pathStyle = true
+	}
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	var err error
+	c.endpoint, err = url.Parse(endpoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid s3 endpoint %q", endpoint)
+	}
+	return c, nil
+}
+
+// ParseS3URL splits s3://bucket/prefix into its bucket and prefix.
+func ParseS3URL(s string) (string, string, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Scheme != "s3" || u.Host == "" {
+		return "", "", errors.Errorf("invalid upload location %q, expected s3://bucket/prefix", s)
+	}
+	return u.Host, strings.Trim(u.Path, "/"), nil
+}
+
+// Upload stores the content of r under bucket/key using a multipart upload.
+func (c *S3Client) Upload(bucket, key string, r io.Reader, contentType string) error {
+	uploadID, err := c.createMultipartUpload(bucket, key, contentType)
+	if err != nil {
+		return err
+	}
+	var parts []completedPart
+	buf := make([]byte, partSize)
+	for number := 1; ; number++ {
+		n, readErr := io.ReadFull(r, buf)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			c.abortMultipartUpload(bucket, key, uploadID)
+			return readErr
+		}
+		if n == 0 && number > 1 {
+			break
+		}
+		etag, err := c.uploadPart(bucket, key, uploadID, number, buf[:n])
+		if err != nil {
+			c.abortMultipartUpload(bucket, key, uploadID)
+			return err
+		}
+		parts = append(parts, completedPart{PartNumber: number, ETag: etag})
+		if readErr != nil {
+			break
+		}
+	}
+	if err := c.completeMultipartUpload(bucket, key, uploadID, parts); err != nil {
+		c.abortMultipartUpload(bucket, key, uploadID)
+		return err
+	}
+	return nil
+}
+
+// PresignGet returns a URL that downloads bucket/key without credentials
+// until it expires.
+func (c *S3Client) PresignGet(bucket, key string, expires time.Duration) (string, error) {
+	return c.presignGet(bucket, key, expires, time.Now().UTC())
+}
+
+func (c *S3Client) presignGet(bucket, key string, expires time.Duration, now time.Time) (string, error) {
+	u := c.objectURL(bucket, key)
+	q := url.Values{}
+	q.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	q.Set("X-Amz-Credential", c.accessKey+"/"+c.scope(now))
+	q.Set("X-Amz-Date", now.Format(amzDateFormat))
+	q.Set("X-Amz-Expires", strconv.Itoa(int(expires.Seconds())))
+	q.Set("X-Amz-SignedHeaders", "host")
+	if c.sessionToken != "" {
+		q.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+	u.RawQuery = canonicalQuery(q)
+	canonical := strings.Join([]string{
+		http.MethodGet,
+		u.EscapedPath(),
+		u.RawQuery,
+		"host:" + u.Host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+	u.RawQuery += "&X-Amz-Signature=" + c.signature(now, canonical)
+	return u.String(), nil
+}
+
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+type initiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (c *S3Client) createMultipartUpload(bucket, key, contentType string) (string, error) {
+	header := http.Header{}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	body, _, err := c.do(http.MethodPost, bucket, key, url.Values{"uploads": {""}}, header, nil)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create multipart upload for %s", key)
+	}
+	var result initiateMultipartUploadResult
+	if err := xml.Unmarshal(body, &result); err != nil {
+		return "", err
+	}
+	return result.UploadID, nil
+}
+
+func (c *S3Client) uploadPart(bucket, key, uploadID string, number int, data []byte) (string, error) {
+	q := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+	_, header, err := c.do(http.MethodPut, bucket, key, q, http.Header{}, data)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to upload part %d of %s", number, key)
+	}
+	return header.Get("ETag"), nil
+}
+
+func (c *S3Client) completeMultipartUpload(bucket, key, uploadID string, parts []completedPart) error {
+	data, err := xml.Marshal(completeMultipartUpload{Parts: parts})
+	if err != nil {
+		return err
+	}
+	body, _, err := c.do(http.MethodPost, bucket, key, url.Values{"uploadId": {uploadID}}, http.Header{}, data)
+	if err != nil {
+		return errors.Wrapf(err, "failed to complete multipart upload of %s", key)
+	}
+	// S3 may report a failed completion with a 200 status code.
+	var e s3Error
+	if xml.Unmarshal(body, &e) == nil && e.Code != "" {
+		return errors.Errorf("failed to complete multipart upload of %s: %s: %s", key, e.Code, e.Message)
+	}
+	return nil
+}
+
+func (c *S3Client) abortMultipartUpload(bucket, key, uploadID string) {
+	_, _, _ = c.do(http.MethodDelete, bucket, key, url.Values{"uploadId": {uploadID}}, http.Header{}, nil)
+}
+
+func (c *S3Client) do(method, bucket, key string, q url.Values, header http.Header, payload []byte) ([]byte, http.Header, error) {
+	u := c.objectURL(bucket, key)
+	u.RawQuery = canonicalQuery(q)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(payload))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header = header
+	c.sign(req, payload)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		var e s3Error
+		if xml.Unmarshal(body, &e) == nil && e.Code != "" {
+			return nil, nil, errors.Errorf("%s: %s", e.Code, e.Message)
+		}
+		return nil, nil, errors.Errorf("unexpected status %s", resp.Status)
+	}
+	return body, resp.Header, nil
+}
+
+func (c *S3Client) objectURL(bucket, key string) *url.URL {
+	u := *c.endpoint
+	if c.pathStyle {
+		u.Path = "/" + bucket + "/" + key
+	} else {
+		u.Host = bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	u.RawPath = escapePath(u.Path)
+	return &u
+}
+
+func (c *S3Client) sign(req *http.Request, payload []byte) {
+	c.signAt(req, payload, time.Now().UTC())
+}
+
+func (c *S3Client) signAt(req *http.Request, payload []byte, now time.Time) {
+	sum := sha256.Sum256(payload)
+	payloadHash := hex.EncodeToString(sum[:])
+	req.Header.Set("X-Amz-Date", now.Format(amzDateFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, c.scope(now), signedHeaders, c.signature(now, canonical)))
+}
+
+func (c *S3Client) scope(t time.Time) string {
+	return t.Format(shortDateFormat) + "/" + c.region + "/s3/aws4_request"
+}
+
+func (c *S3Client) signature(t time.Time, canonicalRequest string) string {
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		t.Format(amzDateFormat),
+		c.scope(t),
+		hex.EncodeToString(sum[:]),
+	}, "\n")
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), t.Format(shortDateFormat))
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes q sorted by key with the strict escaping SigV4
+// requires.
+func canonicalQuery(q url.Values) string {
+	var keys []string
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		for _, v := range q[k] {
+			pairs = append(pairs, escape(k)+"="+escape(v))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func escapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		segments[i] = escape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+func escape(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,330 @@
+package wait
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	apps_v1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout is how long deploy, delete and config wait for kata-deploy
+// by default.
+const DefaultTimeout = 10 * time.Minute
+
+// watchTimeout ends watches before the client times the request out, the
+// informers restart them.
+const watchTimeout = 25 * time.Second
+
+// Waiter waits for the pods of the kata DaemonSets in kube-system by
+// watching them and reports the progress node by node.
+type Waiter struct {
+	client    kubernetes.Interface
+	namespace string
+	timeout   time.Duration
+}
+
+func New(client kubernetes.Interface, timeout time.Duration) *Waiter {
+	return &Waiter{client: client, namespace: "kube-system", timeout: timeout}
+}
+
+// NodeCondition returns why a node is not done yet, or "" when it is. pod is
+// nil when no matching pod runs on the node, node is nil when the node does
+// not exist.
+type NodeCondition func(node *v1.Node, pod *v1.Pod) string
+
+// DaemonSetReady waits until the DaemonSet runs an up to date, ready pod on
+// every node it is scheduled to, like kubectl rollout status.
+func (w *Waiter) DaemonSetReady(ctx context.Context, name string, selector string) error {
+	daemonSets := w.source(&apps_v1.DaemonSet{}, func(o *metav1.ListOptions) {
+		o.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+	}, func(o metav1.ListOptions) (runtime.Object, error) {
+		return w.client.AppsV1().DaemonSets(w.namespace).List(ctx, o)
+	}, func(o metav1.ListOptions) (watch.Interface, error) {
+		return w.client.AppsV1().DaemonSets(w.namespace).Watch(ctx, o)
+	})
+	pods := w.pods(ctx, selector)
+	return w.until(ctx, name+" to be ready", []*source{daemonSets, pods}, func() (int, map[string]string) {
+		pending := make(map[string]string)
+		items := daemonSets.store.List()
+		if len(items) == 0 {
+			pending[name] = "DaemonSet not found"
+			return 1, pending
+		}
+		ds := items[0].(*apps_v1.DaemonSet)
+		status := ds.Status
+		if status.ObservedGeneration < ds.Generation {
+			pending[name] = "waiting for the DaemonSet controller"
+			return 1, pending
+		}
+		scheduled := 0
+		for _, item := range pods.store.List() {
+			pod := item.(*v1.Pod)
+			if pod.DeletionTimestamp != nil {
+				continue
+			}
+			scheduled++
+			if !PodReady(pod) {
+				pending[nodeOf(pod)] = fmt.Sprintf("pod %s is not ready: %s", pod.Name, ContainerState(pod))
+			}
+		}
+		if missing := int(status.DesiredNumberScheduled) - scheduled; missing > 0 {
+			pending[name] = fmt.Sprintf("%d pods not created yet", missing)
+		} else if len(pending) == 0 && status.UpdatedNumberScheduled < status.DesiredNumberScheduled {
+			pending[name] = fmt.Sprintf("%d/%d pods updated", status.UpdatedNumberScheduled, status.DesiredNumberScheduled)
+		}
+		return int(status.DesiredNumberScheduled), pending
+	})
+}
+
+// PodsDeleted waits until no pod matching the selector is left.
+func (w *Waiter) PodsDeleted(ctx context.Context, selector string) error {
+	pods := w.pods(ctx, selector)
+	total := -1
+	return w.until(ctx, "pods "+selector+" to be deleted", []*source{pods}, func() (int, map[string]string) {
+		pending := make(map[string]string)
+		for _, item := range pods.store.List() {
+			pod := item.(*v1.Pod)
+			reason := "not deleted yet"
+			if pod.DeletionTimestamp != nil {
+				reason = "terminating: " + ContainerState(pod)
+			}
+			pending[nodeOf(pod)] = fmt.Sprintf("pod %s is %s", pod.Name, reason)
+		}
+		if total < 0 {
+			total = len(pending)
+		}
+		return total, pending
+	})
+}
+
+// PodsGone waits until the pods, of any namespace, are gone from the node.
+func (w *Waiter) PodsGone(ctx context.Context, nodeName string, gone []v1.Pod) error {
+	pods := w.source(&v1.Pod{}, func(o *metav1.ListOptions) {
+		o.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", nodeName).String()
+	}, func(o metav1.ListOptions) (runtime.Object, error) {
+		return w.client.CoreV1().Pods("").List(ctx, o)
+	}, func(o metav1.ListOptions) (watch.Interface, error) {
+		return w.client.CoreV1().Pods("").Watch(ctx, o)
+	})
+	return w.until(ctx, fmt.Sprintf("%d pods to leave %s", len(gone), nodeName), []*source{pods}, func() (int, map[string]string) {
+		pending := make(map[string]string)
+		for _, item := range pods.store.List() {
+			pod := item.(*v1.Pod)
+			for _, g := range gone {
+				if pod.UID == g.UID {
+					pending[pod.Namespace+"/"+pod.Name] = "still " + ContainerState(pod)
+				}
+			}
+		}
+		return len(gone), pending
+	})
+}
+
+// Nodes waits until the condition holds on every one of the nodes, looking
+// at the pod matching the selector on each of them.
+func (w *Waiter) Nodes(ctx context.Context, selector string, names []string, condition NodeCondition) error {
+	pods := w.pods(ctx, selector)
+	nodes := w.source(&v1.Node{}, nil, func(o metav1.ListOptions) (runtime.Object, error) {
+		return w.client.CoreV1().Nodes().List(ctx, o)
+	}, func(o metav1.ListOptions) (watch.Interface, error) {
+		return w.client.CoreV1().Nodes().Watch(ctx, o)
+	})
+	return w.until(ctx, fmt.Sprintf("%d nodes", len(names)), []*source{pods, nodes}, func() (int, map[string]string) {
+		podOnNode := make(map[string]*v1.Pod)
+		for _, item := range pods.store.List() {
+			pod := item.(*v1.Pod)
+			if pod.DeletionTimestamp == nil {
+				podOnNode[pod.Spec.NodeName] = pod
+			}
+		}
+		pending := make(map[string]string)
+		for _, name := range names {
+			var node *v1.Node
+			if item, ok, _ := nodes.store.GetByKey(name); ok {
+				node = item.(*v1.Node)
+			}
+			if reason := condition(node, podOnNode[name]); reason != "" {
+				pending[name] = reason
+			}
+		}
+		return len(names), pending
+	})
+}
+
+// source is a list and watch feeding an informer store.
+type source struct {
+	lw    cache.ListerWatcher
+	obj   runtime.Object
+	store cache.Store
+}
+
+func (w *Waiter) source(obj runtime.Object, options func(*metav1.ListOptions), list cache.ListFunc, watchFunc cache.WatchFunc) *source {
+	if options == nil {
+		options = func(*metav1.ListOptions) {}
+	}
+	return &source{
+		obj: obj,
+		lw: &cache.ListWatch{
+			ListFunc: func(o metav1.ListOptions) (runtime.Object, error) {
+				options(&o)
+				return list(o)
+			},
+			WatchFunc: func(o metav1.ListOptions) (watch.Interface, error) {
+				options(&o)
+				timeout := int64(watchTimeout / time.Second)
+				o.TimeoutSeconds = &timeout
+				return watchFunc(o)
+			},
+		},
+	}
+}
+
+func (w *Waiter) pods(ctx context.Context, selector string) *source {
+	return w.source(&v1.Pod{}, func(o *metav1.ListOptions) {
+		o.LabelSelector = selector
+	}, func(o metav1.ListOptions) (runtime.Object, error) {
+		return w.client.CoreV1().Pods(w.namespace).List(ctx, o)
+	}, func(o metav1.ListOptions) (watch.Interface, error) {
+		return w.client.CoreV1().Pods(w.namespace).Watch(ctx, o)
+	})
+}
+
+// until runs informers for the sources and evaluates check on every change
+// until nothing is pending. check returns how many nodes are waited for and
+// why each pending one is not done.
+func (w *Waiter) until(ctx context.Context, what string, sources []*source, check func() (int, map[string]string)) error {
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+	changed := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { notify() },
+		UpdateFunc: func(interface{}, interface{}) { notify() },
+		DeleteFunc: func(interface{}) { notify() },
+	}
+	var synced []cache.InformerSynced
+	for _, s := range sources {
+		var controller cache.Controller
+		s.store, controller = cache.NewInformer(s.lw, s.obj, 0, handler)
+		go controller.Run(ctx.Done())
+		synced = append(synced, controller.HasSynced)
+	}
+	if !cache.WaitForCacheSync(ctx.Done(), synced...) {
+		return errors.Errorf("failed to list the objects to wait for %s within %s", what, w.timeout)
+	}
+	log.Infof("waiting up to %s for %s", w.timeout, what)
+	reported := make(map[string]string)
+	for {
+		total, pending := check()
+		report(total, reported, pending)
+		reported = pending
+		if len(pending) == 0 {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return errors.Errorf("timed out after %s waiting for %s: %s", w.timeout, what, describe(pending))
+			}
+			return errors.Wrapf(ctx.Err(), "waiting for %s: %s", what, describe(pending))
+		}
+	}
+}
+
+// report logs the nodes that are done and the ones whose reason changed.
+func report(total int, previous map[string]string, pending map[string]string) {
+	var done []string
+	for name := range previous {
+		if _, ok := pending[name]; !ok {
+			done = append(done, name)
+		}
+	}
+	sort.Strings(done)
+	for _, name := range done {
+		log.Infof("%s: done (%d/%d)", name, total-len(pending), total)
+	}
+	for _, name := range sortedKeys(pending) {
+		if previous[name] != pending[name] {
+			log.Infof("%s: %s", name, pending[name])
+		}
+	}
+}
+
+func describe(pending map[string]string) string {
+	var reasons []string
+	for _, name := range sortedKeys(pending) {
+		reasons = append(reasons, fmt.Sprintf("%s: %s", name, pending[name]))
+	}
+	return strings.Join(reasons, "; ")
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func nodeOf(pod *v1.Pod) string {
+	if pod.Spec.NodeName == "" {
+		return pod.Name + " (unscheduled)"
+	}
+	return pod.Spec.NodeName
+}
+
+// PodReady tells whether the Ready condition of the pod is true.
+func PodReady(pod *v1.Pod) bool {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == v1.PodReady {
+			return c.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// ContainerState describes why the containers of a pod are not running.
+func ContainerState(pod *v1.Pod) string {
+	var states []string
+	for _, s := range pod.Status.ContainerStatuses {
+		switch {
+		case s.State.Waiting != nil:
+			state := fmt.Sprintf("%s waiting (%s)", s.Name, s.State.Waiting.Reason)
+			if s.State.Waiting.Message != "" {
+				state += " " + s.State.Waiting.Message
+			}
+			states = append(states, state)
+		case s.State.Terminated != nil:
+			states = append(states, fmt.Sprintf("%s terminated (%s) exit code %d", s.Name, s.State.Terminated.Reason, s.State.Terminated.ExitCode))
+		case s.State.Running != nil && !s.Ready:
+			states = append(states, fmt.Sprintf("%s running, not ready, %d restarts", s.Name, s.RestartCount))
+		}
+	}
+	if len(states) == 0 {
+		for _, c := range pod.Status.Conditions {
+			if c.Type == v1.PodScheduled && c.Status != v1.ConditionTrue {
+				return fmt.Sprintf("unschedulable: %s", c.Message)
+			}
+		}
+		return string(pod.Status.Phase)
+	}
+	return strings.Join(states, ", ")
+}
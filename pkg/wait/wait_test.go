@@ -0,0 +1,123 @@
+package wait
+
+import (
+	"context"
+	apps_v1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8s_testing "k8s.io/client-go/testing"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func daemonSet(desired int32, updated int32) *apps_v1.DaemonSet {
+	return &apps_v1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "kata-deploy", Namespace: "kube-system", Generation: 1},
+		Status: apps_v1.DaemonSetStatus{
+			ObservedGeneration:     1,
+			DesiredNumberScheduled: desired,
+			UpdatedNumberScheduled: updated,
+		},
+	}
+}
+
+func deployPod(node string, ready bool) *v1.Pod {
+	status := v1.ConditionFalse
+	containerStatus := v1.ContainerStatus{Name: "kube-kata", State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "ImagePullBackOff"}}}
+	if ready {
+		status = v1.ConditionTrue
+		containerStatus = v1.ContainerStatus{Name: "kube-kata", Ready: true, State: v1.ContainerState{Running: &v1.ContainerStateRunning{}}}
+	}
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "kata-deploy-" + node, Namespace: "kube-system", Labels: map[string]string{"name": "kata-deploy"}},
+		Spec:       v1.PodSpec{NodeName: node},
+		Status: v1.PodStatus{
+			Conditions:        []v1.PodCondition{{Type: v1.PodReady, Status: status}},
+			ContainerStatuses: []v1.ContainerStatus{containerStatus},
+		},
+	}
+}
+
+func TestDaemonSetReady(t *testing.T) {
+	tests := []struct {
+		name    string
+		objects []runtime.Object
+		err     string
+	}{
+		{"ready", []runtime.Object{daemonSet(2, 2), deployPod("n1", true), deployPod("n2", true)}, ""},
+		{"missing pod", []runtime.Object{daemonSet(2, 2), deployPod("n1", true)}, "kata-deploy: 1 pods not created yet"},
+		{"not updated", []runtime.Object{daemonSet(2, 1), deployPod("n1", true), deployPod("n2", true)}, "kata-deploy: 1/2 pods updated"},
+		{"not ready", []runtime.Object{daemonSet(2, 2), deployPod("n1", true), deployPod("n2", false)},
+			"n2: pod kata-deploy-n2 is not ready: kube-kata waiting (ImagePullBackOff)"},
+		{"not observed", []runtime.Object{func() *apps_v1.DaemonSet {
+			ds := daemonSet(1, 1)
+			ds.Generation = 2
+			return ds
+		}(), deployPod("n1", true)}, "kata-deploy: waiting for the DaemonSet controller"},
+		{"no DaemonSet", nil, "kata-deploy: DaemonSet not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := New(fake.NewSimpleClientset(tt.objects...), 200*time.Millisecond)
+			err := w.DaemonSetReady(context.Background(), "kata-deploy", "name=kata-deploy")
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatal(err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Fatalf("got %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestPodsDeleted(t *testing.T) {
+	client := fake.NewSimpleClientset(deployPod("n1", true), deployPod("n2", true))
+	var once sync.Once
+	watching := make(chan struct{})
+	client.PrependWatchReactor("pods", func(k8s_testing.Action) (bool, watch.Interface, error) {
+		once.Do(func() { close(watching) })
+		return false, nil, nil
+	})
+	go func() {
+		<-watching
+		time.Sleep(50 * time.Millisecond)
+		for _, n := range []string{"n1", "n2"} {
+			_ = client.CoreV1().Pods("kube-system").Delete(context.Background(), "kata-deploy-"+n, metav1.DeleteOptions{})
+		}
+	}()
+	if err := New(client, 5*time.Second).PodsDeleted(context.Background(), "name=kata-deploy"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNodesTimeout(t *testing.T) {
+	node := func(name string, labeled bool) *v1.Node {
+		n := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{}}}
+		if labeled {
+			n.Labels["katacontainers.io/kata-runtime"] = "true"
+		}
+		return n
+	}
+	client := fake.NewSimpleClientset(node("n1", true), node("n2", false), deployPod("n1", true), deployPod("n2", true))
+	installed := func(node *v1.Node, pod *v1.Pod) string {
+		switch {
+		case node == nil:
+			return "node not found"
+		case pod == nil:
+			return "no pod"
+		case node.Labels["katacontainers.io/kata-runtime"] != "true":
+			return "not labeled"
+		}
+		return ""
+	}
+	err := New(client, 200*time.Millisecond).Nodes(context.Background(), "name=kata-deploy", []string{"n1", "n2", "n3"}, installed)
+	want := "timed out after 200ms waiting for 3 nodes: n2: not labeled; n3: node not found"
+	if err == nil || err.Error() != want {
+		t.Fatalf("got %v, want %q", err, want)
+	}
+}